@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"time"
@@ -11,6 +12,61 @@ import (
 )
 
 func main() {
+	preserveToning := flag.Bool("preserve-toning", false, "Process monochrome and sepia prints as luminance and re-apply their toning")
+	denoise := flag.Bool("denoise", false, "Run non-local means denoising before mask creation")
+	nlmPatch := flag.Int("nlm-patch", 3, "Patch radius of the non-local means denoiser")
+	nlmSearch := flag.Int("nlm-search", 7, "Search window radius of the non-local means denoiser")
+	nlmH := flag.Float64("nlm-h", 10, "Filtering strength of the non-local means denoiser (0-255 scale)")
+	median := flag.String("median", "none", "Median filter for salt-and-pepper dust: none, median or adaptive")
+	medianRadius := flag.Int("median-radius", 2, "Radius of the median filter")
+	dustArea := flag.Int("dust-area", 0, "Repair mask regions up to this many pixels with a median (0 disables)")
+	unsharp := flag.Bool("unsharp", false, "Sharpen with a luminance unsharp mask instead of the fixed kernel")
+	unsharpRadius := flag.Float64("unsharp-radius", 1.5, "Blur radius (sigma) of the unsharp mask")
+	unsharpAmount := flag.Float64("unsharp-amount", 0.8, "Strength of the unsharp mask")
+	unsharpThreshold := flag.Float64("unsharp-threshold", 4, "Minimum local contrast sharpened by the unsharp mask (0-255 scale)")
+	canny := flag.Bool("canny", false, "Use the Canny edge detector to guide feathering and inpainting")
+	edgeLevels := flag.Int("edge-levels", 1, "Pyramid levels combined by the edge detector (1 disables multi-scale detection)")
+	cannyAuto := flag.Bool("canny-auto", false, "Derive the Canny thresholds from the image")
+	edgeOperator := flag.String("edge-operator", "sobel", "Edge operator: sobel, scharr, prewitt, roberts or log")
+	gray := flag.String("gray", "average", "Grayscale conversion for edge detection: average, rec601 or rec709")
+	isophotes := flag.Bool("isophotes", false, "Inpaint along local isophotes to reconnect lines across scratches")
+	pyramidLevels := flag.Int("pyramid-levels", 1, "Pyramid levels for coarse-to-fine inpainting (1 inpaints at full resolution only)")
+	linear := flag.Bool("linear", false, "Inpaint and blur in linear light, so blended areas are not darkened")
+	equalize := flag.Bool("equalize", true, "Correct contrast after inpainting (false skips equalisation)")
+	compactWeights := flag.Bool("compact-weights", false, "Store the edge and feathered weight maps with 8 bits per pixel to save memory")
+	useCLAHE := flag.Bool("clahe", false, "Correct contrast with CLAHE instead of global histogram equalisation")
+	claheTiles := flag.Int("clahe-tiles", 8, "Number of CLAHE tiles across and down the image")
+	claheClip := flag.Float64("clahe-clip", 2, "CLAHE clip limit as a multiple of the average histogram bin (0 disables clipping)")
+	equalizeSpace := flag.String("equalize-space", "rgb", "Colour space whose lightness is equalised: rgb (every channel), ycbcr, hsv or lab")
+	autoLevels := flag.Bool("auto-levels", false, "Stretch every channel between its own black and white point")
+	levelsClip := flag.Float64("levels-clip", 0.005, "Fraction of pixels clipped at each end by -auto-levels")
+	gamma := flag.Float64("gamma", 1, "Gamma applied to every channel after the levels (above 1 brightens midtones)")
+	recipe := flag.String("recipe", "", "JSON recipe with levels, gamma and tone curves (overrides -auto-levels, -levels-clip and -gamma)")
+	whiteBalance := flag.String("white-balance", "none", "Colour cast removal: none, grayworld, whitepatch or shadesofgray")
+	reference := flag.String("reference", "", "Reference photo whose colours are transferred to the restored image")
+	transfer := flag.String("transfer", "reinhard", "Colour transfer used with -reference: reinhard or histogram")
+	border := flag.String("border", "clamp", "Border handling of every filter: clamp, reflect, wrap or constant")
+	format := flag.String("format", "auto", "Format of the restored image: jpeg, png, tiff, bmp or auto (from the extension of -output, else the format of the photo)")
+	output := flag.String("output", "", "Where to write the restored image (default assets/restored_photo with the extension of the format)")
+	quality := flag.Int("quality", 75, "JPEG quality of the restored image (1-100)")
+	keepMetadata := flag.Bool("keep-metadata", true, "Copy the EXIF, XMP, ICC and comment segments of the photo into the restored JPEG or PNG")
+	history := flag.Bool("history", false, "Add a comment listing the restoration steps to the restored JPEG or PNG")
+	memoryLimit := flag.Int("memory-limit", 0, "Process the photo in bands, limiting the working memory of the restoration stages to this many megabytes; non-interlaced PNG photos are decoded band by band and the restored image is kept in a temporary file and written in bands, while other formats are decoded whole into memory (0 processes it whole)")
+	outputProfile := flag.String("output-profile", "source", "Colour profile of the restored image when the photo has one: source or srgb (always srgb for TIFF and BMP)")
+	flag.Parse()
+
+	mode, err := restoration.ParseBorderMode(*border)
+	if err != nil {
+		log.Fatalf("Error parsing border mode: %v\n", err)
+	}
+
+	encodeOpts := restoration.DefaultEncodeOptions()
+	encodeOpts.Quality = *quality
+	encodeOpts.Format, err = restoration.ParseFormat(*format)
+	if err != nil {
+		log.Fatalf("Error parsing output format: %v\n", err)
+	}
+
 	numWorkers := runtime.NumCPU()
 	fmt.Printf("Number of workers used: %d\n", numWorkers)
 	rootDir, _ := os.Getwd() // Current directory is cmd/restore
@@ -18,45 +74,188 @@ func main() {
 
 	imagePath := filepath.Join(projectDir, "assets", "old_photo.jpeg")
 	maskImagePath := filepath.Join(projectDir, "assets", "new_photo_mask.jpeg")
-	restoredImagePath := filepath.Join(projectDir, "assets", "restored_photo.jpg")
 
-	// Load the image
-	img, err := restoration.LoadImage(imagePath)
+	// Load the image, into a temporary file when processing in bands
+	load := restoration.LoadImageWithMetadata
+	if *memoryLimit > 0 {
+		load = restoration.LoadImageToDisk
+	}
+	img, metadata, err := load(imagePath)
 	if err != nil {
 		log.Fatalf("Error loading image: %v\n", err)
 	}
+	if stored, ok := img.(*restoration.StoredImage); ok {
+		defer stored.Close()
+	}
 
-	start := time.Now()
+	// Output format from -format, the extension of -output or the format of the photo
+	restoredImagePath := *output
+	if encodeOpts.Format == restoration.FormatAuto {
+		if restoredImagePath != "" {
+			encodeOpts.Format, err = restoration.FormatFromPath(restoredImagePath)
+			if err != nil {
+				log.Fatalf("Error choosing output format: %v\n", err)
+			}
+		} else {
+			encodeOpts.Format = metadata.Format
+			if encodeOpts.Format == restoration.FormatAuto {
+				encodeOpts.Format = restoration.FormatJPEG
+			}
+		}
+	}
+	if restoredImagePath == "" {
+		restoredImagePath = filepath.Join(projectDir, "assets", "restored_photo"+encodeOpts.Format.Extension())
+	}
+	carriesMetadata := encodeOpts.Format == restoration.FormatJPEG || encodeOpts.Format == restoration.FormatPNG
 
-	// Create the mask in chunks
-	mask, err := restoration.CreateMaskByChunks(img, maskImagePath, numWorkers)
+	// Colour management of tagged scans; only JPEG and PNG output carry the profile
+	profile, err := metadata.ICCProfile()
 	if err != nil {
-		log.Fatalf("Error creating mask: %v\n", err)
+		log.Printf("Ignoring colour profile: %v\n", err)
+		profile = nil
+	}
+	if profile != nil {
+		fmt.Printf("Colour profile: %s\n", profile.Description)
+	}
+	outProfile, err := restoration.ParseOutputProfile(*outputProfile)
+	if err != nil {
+		log.Fatalf("Error parsing output profile: %v\n", err)
+	}
+	if !carriesMetadata {
+		outProfile = restoration.OutputProfileSRGB
 	}
 
-	// edge mask for blending
-	edgeMask := restoration.EdgeDetectionConcurrent(img, numWorkers)
-
-	// feather the mask
-	featheredMask := restoration.FeatherMaskConcurrent(mask, 5, edgeMask, numWorkers)
-
-	// apply scratch removal in chunks
-	restoredImg := restoration.InpaintByChunks(img, featheredMask, edgeMask, numWorkers)
+	start := time.Now()
 
-	// Apply color correction (histogram equalization)
-	colorCorrectedImg := restoration.HistEqualConcurrent(restoredImg, numWorkers)
+	opts := restoration.DefaultOptions(numWorkers)
+	opts.MaskPath = maskImagePath
+	opts.Border = mode
+	opts.PreserveToning = *preserveToning
+	opts.Denoise = *denoise
+	opts.NLMeans.PatchRadius = *nlmPatch
+	opts.NLMeans.SearchRadius = *nlmSearch
+	opts.NLMeans.H = *nlmH
+	opts.MedianRadius = *medianRadius
+	opts.DustMaxArea = *dustArea
+	if *edgeLevels > 1 {
+		opts.Edges = restoration.EdgeSourceMultiScale
+		opts.EdgeLevels = *edgeLevels
+	}
+	if *canny {
+		opts.Edges = restoration.EdgeSourceCanny
+	}
+	opts.Canny.AutoThreshold = *cannyAuto
+	opts.EdgeOptions.Operator, err = restoration.ParseEdgeOperator(*edgeOperator)
+	if err != nil {
+		log.Fatalf("Error parsing edge operator: %v\n", err)
+	}
+	opts.EdgeOptions.Gray, err = restoration.ParseGrayMode(*gray)
+	if err != nil {
+		log.Fatalf("Error parsing grayscale mode: %v\n", err)
+	}
+	opts.Canny.Operator = opts.EdgeOptions.Operator
+	opts.Canny.Gray = opts.EdgeOptions.Gray
+	opts.FollowIsophotes = *isophotes
+	opts.PyramidLevels = *pyramidLevels
+	opts.LinearLight = *linear
+	opts.CompactWeights = *compactWeights
+	opts.Profile = profile
+	opts.OutputProfile = outProfile
+	if *autoLevels || *gamma != 1 {
+		opts.AdjustLevels = true
+		opts.LevelsOptions.Auto = *autoLevels
+		opts.LevelsOptions.Clip = *levelsClip
+		opts.LevelsOptions.Gamma = [3]float64{*gamma, *gamma, *gamma}
+	}
+	if *recipe != "" {
+		opts.AdjustLevels = true
+		opts.LevelsOptions, err = restoration.LoadLevelsRecipe(*recipe)
+		if err != nil {
+			log.Fatalf("Error loading levels recipe: %v\n", err)
+		}
+	}
+	opts.WhiteBalance.Method, err = restoration.ParseWhiteBalanceMethod(*whiteBalance)
+	if err != nil {
+		log.Fatalf("Error parsing white balance method: %v\n", err)
+	}
+	if *useCLAHE {
+		opts.ColorCorrection = restoration.ColorCorrectionCLAHE
+	}
+	if !*equalize {
+		opts.ColorCorrection = restoration.ColorCorrectionNone
+	}
+	opts.CLAHE.TilesX = *claheTiles
+	opts.CLAHE.TilesY = *claheTiles
+	opts.CLAHE.ClipLimit = *claheClip
+	opts.EqualizeSpace, err = restoration.ParseColorSpace(*equalizeSpace)
+	if err != nil {
+		log.Fatalf("Error parsing colour space: %v\n", err)
+	}
+	if *reference != "" {
+		opts.Reference, err = restoration.LoadImage(*reference)
+		if err != nil {
+			log.Fatalf("Error loading reference image: %v\n", err)
+		}
+		opts.Transfer, err = restoration.ParseTransferMethod(*transfer)
+		if err != nil {
+			log.Fatalf("Error parsing colour transfer method: %v\n", err)
+		}
+	}
+	if *unsharp {
+		opts.Sharpen = restoration.SharpenUnsharp
+	}
+	opts.Unsharp.Radius = *unsharpRadius
+	opts.Unsharp.Amount = *unsharpAmount
+	opts.Unsharp.Threshold = *unsharpThreshold
+	switch *median {
+	case "none":
+	case "median":
+		opts.NoiseFilter = restoration.NoiseFilterMedian
+	case "adaptive":
+		opts.NoiseFilter = restoration.NoiseFilterAdaptiveMedian
+	default:
+		log.Fatalf("Unknown median filter: %s\n", *median)
+	}
 
-	// Post-process for sharpening and smoothing
-	finalImg := restoration.ApplySmoothing(colorCorrectedImg, numWorkers)
+	// Run the restoration pipeline
+	var result *restoration.Result
+	if *memoryLimit > 0 {
+		result, err = restoration.RestoreTiledToDisk(img, opts, int64(*memoryLimit)<<20)
+	} else {
+		result, err = restoration.Restore(img, opts)
+	}
+	if err != nil {
+		log.Fatalf("Error restoring image: %v\n", err)
+	}
 
 	elapsed := time.Since(start)
 
 	// Save the final image
-	err = restoration.SaveImage(finalImg, restoredImagePath)
+	if !carriesMetadata && (*keepMetadata || *history) {
+		log.Printf("%v output cannot carry metadata: not copying it\n", encodeOpts.Format)
+		*keepMetadata, *history = false, false
+	}
+	if *keepMetadata {
+		encodeOpts.Metadata = metadata
+		if profile != nil && outProfile == restoration.OutputProfileSRGB {
+			encodeOpts.Metadata = metadata.WithoutICCProfile()
+		}
+	}
+	if *history {
+		encodeOpts.History = restoration.HistoryNote(opts, result, time.Now())
+	}
+	err = restoration.SaveImageWithOptions(result.Image, restoredImagePath, encodeOpts)
+	if stored, ok := result.Image.(*restoration.StoredImage); ok {
+		stored.Close()
+	}
 	if err != nil {
 		log.Fatalf("Error saving restored image: %v\n", err)
 	}
 
 	fmt.Printf("Restored image saved to: %s\n", restoredImagePath)
+	fmt.Printf("Colour cast: %v\n", result.Cast)
+	if *preserveToning {
+		fmt.Printf("Toning: %v (chroma %.1f, spread %.1f)\n", result.Toning.Kind, result.Toning.Chroma, result.Toning.Spread)
+	}
 	fmt.Printf("Processing time: %v\n", elapsed)
 }
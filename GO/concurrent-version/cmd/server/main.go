@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"image"
 	"io"
 	"log"
 	"net"
-	"os"
 	"runtime"
 	"time"
 	"GO/concurrent-version/restoration"
@@ -14,6 +16,23 @@ import (
 
 const port = ":8080" // Server port
 
+var (
+	denoise        = flag.Bool("denoise", false, "Run non-local means denoising before mask creation")
+	preserveToning = flag.Bool("preserve-toning", false, "Process monochrome and sepia prints as luminance and re-apply their toning")
+	whiteBalance   = flag.String("white-balance", "none", "Colour cast removal: none, grayworld, whitepatch or shadesofgray")
+	reference      = flag.String("reference", "", "Reference photo whose colours are transferred to every restored image")
+	transfer       = flag.String("transfer", "reinhard", "Colour transfer used with -reference: reinhard or histogram")
+	border         = flag.String("border", "clamp", "Border handling of every filter: clamp, reflect, wrap or constant")
+)
+
+// Parsed flags shared by every connection
+var (
+	borderMode         restoration.BorderMode
+	whiteBalanceMethod restoration.WhiteBalanceMethod
+	transferMethod     restoration.TransferMethod
+	referenceImg       image.Image
+)
+
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	fmt.Println("Client connected!")
@@ -41,65 +60,53 @@ func handleConnection(conn net.Conn) {
 	}
 	fmt.Println("Image received!")
 
-	// Generate unique file names for this connection
-	timestamp := time.Now().UnixNano()
-	tempInput := fmt.Sprintf("temp_input_%d.jpg", timestamp)
-	tempMask := fmt.Sprintf("temp_mask_%d.jpg", timestamp)
-	tempOutput := fmt.Sprintf("temp_output_%d.jpg", timestamp)
-
-	// 3. Save the received image to a temporary file
-	err = os.WriteFile(tempInput, imgData, 0644)
+	// 3. Decode the received image in memory
+	img, photoMetadata, err := restoration.DecodeImageWithMetadata(bytes.NewReader(imgData))
 	if err != nil {
-		log.Println("Error saving received image:", err)
+		log.Println("Error decoding image:", err)
 		return
 	}
-	defer os.Remove(tempInput) // Clean up the temporary input file
 
 	// 4. Process the image using the restoration logic
 	fmt.Println("Processing image...")
-	img, err := restoration.LoadImage(tempInput)
+
+	// Run the restoration pipeline; the debug mask is not written
+	opts := restoration.DefaultOptions(numWorkers)
+	opts.Border = borderMode
+	opts.PreserveToning = *preserveToning
+	opts.Denoise = *denoise
+	opts.WhiteBalance.Method = whiteBalanceMethod
+	opts.Transfer = transferMethod
+	opts.Reference = referenceImg
+	opts.Profile, err = photoMetadata.ICCProfile()
 	if err != nil {
-		log.Println("Error loading image:", err)
-		return
+		log.Println("Ignoring colour profile:", err)
+		opts.Profile = nil
 	}
-
-	// Create a mask
-	mask, err := restoration.CreateMaskByChunks(img, tempMask, numWorkers)
+	result, err := restoration.Restore(img, opts)
 	if err != nil {
-		log.Println("Error creating mask:", err)
+		log.Println("Error restoring image:", err)
 		return
 	}
-	defer os.Remove(tempMask) // Clean up the temporary mask file
-
-	// Generate edge mask
-	edgeMask := restoration.EdgeDetectionConcurrent(img, numWorkers)
-
-	// Feather the mask
-	featheredMask := restoration.FeatherMaskConcurrent(mask, 5, edgeMask, numWorkers)
-
-	// Apply scratch removal
-	restoredImg := restoration.InpaintByChunks(img, featheredMask, edgeMask, numWorkers)
 
-	// Apply color correction
-	colorCorrectedImg := restoration.HistEqualConcurrent(restoredImg, numWorkers)
-
-	// Post-process for sharpening and smoothing
-	finalImg := restoration.ApplySmoothing(colorCorrectedImg, numWorkers)
-
-	// Save the final output
-	err = restoration.SaveImage(finalImg, tempOutput)
+	// Encode the final output as JPEG, keeping the metadata of the upload
+	var restored bytes.Buffer
+	encodeOpts := restoration.DefaultEncodeOptions()
+	encodeOpts.Format = restoration.FormatJPEG
+	encodeOpts.Metadata = photoMetadata
+	err = restoration.EncodeImage(&restored, result.Image, encodeOpts)
 	if err != nil {
-		log.Println("Error saving restored image:", err)
+		log.Println("Error encoding restored image:", err)
 		return
 	}
-	defer os.Remove(tempOutput) // Clean up the temporary output file
 
 	// Calculate processing time
 	elapsed := time.Since(start)
 	fmt.Printf("Image processing completed in: %v\n", elapsed)
 
-	// 5. Send metadata (number of workers and processing time) to the client
-	metadata := fmt.Sprintf("Workers: %d, Processing Time: %v", numWorkers, elapsed)
+	// 5. Send metadata (number of workers, processing time, colour cast and toning) to the client
+	metadata := fmt.Sprintf("Workers: %d, Processing Time: %v, Colour Cast: %v, Toning: %v",
+		numWorkers, elapsed, result.Cast, result.Toning.Kind)
 	metadataSize := int64(len(metadata))
 	err = binary.Write(conn, binary.LittleEndian, metadataSize)
 	if err != nil {
@@ -113,13 +120,8 @@ func handleConnection(conn net.Conn) {
 		return
 	}
 
-	// 6. Read the restored image and send it back to the client
-	restoredData, err := os.ReadFile(tempOutput)
-	if err != nil {
-		log.Println("Error reading restored image:", err)
-		return
-	}
-
+	// 6. Send the restored image back to the client
+	restoredData := restored.Bytes()
 	restoredSize := int64(len(restoredData))
 	err = binary.Write(conn, binary.LittleEndian, restoredSize)
 	if err != nil {
@@ -137,6 +139,27 @@ func handleConnection(conn net.Conn) {
 }
 
 func main() {
+	flag.Parse()
+	mode, err := restoration.ParseBorderMode(*border)
+	if err != nil {
+		log.Fatalf("Error parsing border mode: %v\n", err)
+	}
+	borderMode = mode
+	whiteBalanceMethod, err = restoration.ParseWhiteBalanceMethod(*whiteBalance)
+	if err != nil {
+		log.Fatalf("Error parsing white balance method: %v\n", err)
+	}
+	if *reference != "" {
+		referenceImg, err = restoration.LoadImage(*reference)
+		if err != nil {
+			log.Fatalf("Error loading reference image: %v\n", err)
+		}
+		transferMethod, err = restoration.ParseTransferMethod(*transfer)
+		if err != nil {
+			log.Fatalf("Error parsing colour transfer method: %v\n", err)
+		}
+	}
+
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("Error starting server: %v\n", err)
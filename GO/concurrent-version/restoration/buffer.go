@@ -0,0 +1,192 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"sync"
+)
+
+// floatImage is a working copy of an image with one float32 sample per channel.
+// Samples are stored unpremultiplied in R, G, B, A order and scaled to [0, 1].
+// Coordinates are local: (0, 0) is the top-left corner of Rect.
+type floatImage struct {
+	Rect          image.Rectangle
+	Width, Height int
+	Pix           []float32
+}
+
+// newFloatImage allocates a blank floatImage covering the given bounds.
+func newFloatImage(bounds image.Rectangle) *floatImage {
+	return &floatImage{
+		Rect:   bounds,
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Pix:    make([]float32, 4*bounds.Dx()*bounds.Dy()),
+	}
+}
+
+// toFloatImage converts any image.Image into a floatImage, reading rows in parallel.
+func toFloatImage(img image.Image, numWorkers int) *floatImage {
+	bounds := img.Bounds()
+	f := newFloatImage(bounds)
+
+	parallelRows(f.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			i := f.offset(0, y)
+			for x := 0; x < f.Width; x++ {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				f.Pix[i] = float32(c.R) / 0xffff
+				f.Pix[i+1] = float32(c.G) / 0xffff
+				f.Pix[i+2] = float32(c.B) / 0xffff
+				f.Pix[i+3] = float32(c.A) / 0xffff
+				i += 4
+			}
+		}
+	})
+	return f
+}
+
+// offset returns the index of the R sample of the pixel at local (x, y).
+func (f *floatImage) offset(x, y int) int {
+	return 4 * (y*f.Width + x)
+}
+
+// toNRGBA64 converts the working copy back to a 16-bit non-premultiplied image, clamping
+// out-of-range samples. 16 bits keep the detail of archival scans that 8 bits would band.
+func (f *floatImage) toNRGBA64(numWorkers int) *image.NRGBA64 {
+	out := image.NewNRGBA64(f.Rect)
+
+	parallelRows(f.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			row := out.Pix[y*out.Stride : y*out.Stride+8*f.Width]
+			for i, v := range f.Pix[f.offset(0, y):f.offset(0, y+1)] {
+				s := to16(v)
+				row[2*i] = uint8(s >> 8)
+				row[2*i+1] = uint8(s)
+			}
+		}
+	})
+	return out
+}
+
+// toNRGBA converts the working copy to an 8-bit non-premultiplied image, used for 8-bit
+// inputs with transparency.
+func (f *floatImage) toNRGBA(numWorkers int) *image.NRGBA {
+	out := image.NewNRGBA(f.Rect)
+
+	parallelRows(f.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			row := out.Pix[y*out.Stride : y*out.Stride+4*f.Width]
+			for i, v := range f.Pix[f.offset(0, y):f.offset(0, y+1)] {
+				row[i] = uint8(clamp01(v)*0xff + 0.5)
+			}
+		}
+	})
+	return out
+}
+
+// transparent reports whether the pixel starting at offset i is fully transparent.
+// Transparent pixels carry no colour and are left out of histograms, statistics and
+// inpainting neighbourhoods.
+func (f *floatImage) transparent(i int) bool {
+	return f.Pix[i+3] <= 0
+}
+
+// opaque reports whether every pixel of the working copy is fully opaque.
+func (f *floatImage) opaque() bool {
+	for i := 3; i < len(f.Pix); i += 4 {
+		if f.Pix[i] < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAlpha reports whether an image has transparent or translucent pixels.
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	return false
+}
+
+// is16Bit reports whether an image stores more than 8 bits per channel.
+func is16Bit(img image.Image) bool {
+	switch img := img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16, *image.Alpha16:
+		return true
+	case *StoredImage:
+		return img.ColorModel() == color.NRGBA64Model
+	}
+	return false
+}
+
+// to16 clamps a [0, 1] sample and rounds it to 16 bits.
+func to16(v float32) uint16 {
+	return uint16(clamp01(v)*0xffff + 0.5)
+}
+
+// clamp01 restricts a sample to the [0, 1] range.
+func clamp01(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// parallelRows splits [0, height) into one band per worker and runs fn on every band concurrently.
+func parallelRows(height, numWorkers int, fn func(startY, endY int)) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	chunkHeight := (height + numWorkers - 1) / numWorkers
+	if chunkHeight < 1 {
+		chunkHeight = 1
+	}
+
+	var wg sync.WaitGroup
+	for startY := 0; startY < height; startY += chunkHeight {
+		endY := min(startY+chunkHeight, height)
+		wg.Add(1)
+		go func(startY, endY int) {
+			defer wg.Done()
+			fn(startY, endY)
+		}(startY, endY)
+	}
+	wg.Wait()
+}
+
+// parallelTiles splits a width x height area into square tiles and hands them to a pool of numWorkers goroutines.
+func parallelTiles(width, height, tileSize, numWorkers int, fn func(xStart, xEnd, yStart, yEnd int)) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if tileSize < 1 {
+		tileSize = 1
+	}
+
+	type tile struct{ xStart, xEnd, yStart, yEnd int }
+	tiles := make(chan tile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				fn(t.xStart, t.xEnd, t.yStart, t.yEnd)
+			}
+		}()
+	}
+
+	for yStart := 0; yStart < height; yStart += tileSize {
+		for xStart := 0; xStart < width; xStart += tileSize {
+			tiles <- tile{xStart, min(xStart+tileSize, width), yStart, min(yStart+tileSize, height)}
+		}
+	}
+	close(tiles)
+	wg.Wait()
+}
@@ -0,0 +1,181 @@
+package restoration
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// CannyOptions tunes the Canny edge detector.
+type CannyOptions struct {
+	Sigma         float64 // Standard deviation of the Gaussian pre-blur
+	Low, High     float64 // Hysteresis thresholds on the normalised gradient magnitude [0, 1]
+	AutoThreshold bool    // Derive Low and High from the median gradient magnitude instead
+
+	Operator EdgeOperator // Gradient operator (the Laplacian of Gaussian falls back to Sobel)
+	Gray     GrayMode     // Grayscale conversion
+	Border   BorderMode   // How pixels outside the image are read
+}
+
+// DefaultCannyOptions returns thresholds that keep the main contours of a portrait.
+func DefaultCannyOptions() CannyOptions {
+	return CannyOptions{
+		Sigma: 1.4,
+		Low:   0.1,
+		High:  0.25,
+	}
+}
+
+// CannyEdgeDetectionConcurrent detects one-pixel-wide edges with the Canny algorithm:
+// Gaussian pre-blur, gradients (Sobel by default), non-maximum suppression along the
+// gradient direction and double-threshold hysteresis. The result is a bit-packed mask
+// with 1.0 on edge pixels and 0.0 elsewhere.
+func CannyEdgeDetectionConcurrent(img image.Image, opts CannyOptions, numWorkers int) *BitMask {
+	src := toFloatImage(img, numWorkers)
+	width, height := src.Width, src.Height
+
+	// Smooth the grayscale image and compute gradients
+	gray := gaussianBlurPlane(grayPlane(src, opts.Gray, numWorkers), opts.Sigma, opts.Border, numWorkers)
+	gx, gy := gradients(gray, opts.Operator, opts.Border, numWorkers)
+
+	// Gradient magnitudes, normalised to [0, 1]
+	magnitude := newPlane(width, height)
+	var maxGradient float32
+	var mu sync.Mutex
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		var localMax float32
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				dx, dy := gx.at(x, y), gy.at(x, y)
+				m := float32(math.Sqrt(float64(dx*dx + dy*dy)))
+				magnitude.set(x, y, m)
+				if m > localMax {
+					localMax = m
+				}
+			}
+		}
+		mu.Lock()
+		if localMax > maxGradient {
+			maxGradient = localMax
+		}
+		mu.Unlock()
+	})
+	if maxGradient > 0 {
+		for i := range magnitude.data {
+			magnitude.data[i] /= maxGradient
+		}
+	}
+
+	low, high := opts.Low, opts.High
+	if opts.AutoThreshold {
+		low, high = autoCannyThresholds(magnitude)
+	}
+
+	suppressed := nonMaximumSuppression(magnitude, gx, gy, numWorkers)
+	return hysteresis(suppressed, float32(low), float32(high))
+}
+
+// nonMaximumSuppression keeps only the pixels whose magnitude is a local maximum along the
+// gradient direction, quantised to 0, 45, 90 or 135 degrees.
+func nonMaximumSuppression(magnitude, gx, gy plane, numWorkers int) plane {
+	width, height := magnitude.width, magnitude.height
+	out := newPlane(width, height)
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				m := magnitude.at(x, y)
+				if m == 0 {
+					continue
+				}
+
+				// Pick the two neighbours across the edge
+				angle := math.Atan2(float64(gy.at(x, y)), float64(gx.at(x, y))) * 180 / math.Pi
+				if angle < 0 {
+					angle += 180
+				}
+				var dx, dy int
+				switch {
+				case angle < 22.5 || angle >= 157.5:
+					dx, dy = 1, 0
+				case angle < 67.5:
+					dx, dy = 1, 1
+				case angle < 112.5:
+					dx, dy = 0, 1
+				default:
+					dx, dy = -1, 1
+				}
+
+				// Strictly above one neighbour, so a plateau keeps a single pixel across the edge
+				before := magnitude.sample(x-dx, y-dy, BorderClamp, 0)
+				after := magnitude.sample(x+dx, y+dy, BorderClamp, 0)
+				if m > before && m >= after {
+					out.set(x, y, m)
+				}
+			}
+		}
+	})
+	return out
+}
+
+// hysteresis keeps strong edges (above high) and the weak edges (above low) connected to them.
+// A high threshold of zero or less, as autoCannyThresholds returns for a flat image, marks no edges.
+func hysteresis(magnitude plane, low, high float32) *BitMask {
+	width, height := magnitude.width, magnitude.height
+	edges := NewBitMask(width, height)
+	if high <= 0 {
+		return edges
+	}
+
+	var stack []image.Point
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if magnitude.at(x, y) >= high && edges.At(x, y) == 0 {
+				edges.Set(x, y, 1.0)
+				stack = append(stack, image.Pt(x, y))
+			}
+
+			// Follow weak edges connected to the strong pixel
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := p.X+dx, p.Y+dy
+						if nx >= 0 && nx < width && ny >= 0 && ny < height &&
+							edges.At(nx, ny) == 0 && magnitude.at(nx, ny) >= low {
+							edges.Set(nx, ny, 1.0)
+							stack = append(stack, image.Pt(nx, ny))
+						}
+					}
+				}
+			}
+		}
+	}
+	return edges
+}
+
+// autoCannyThresholds derives hysteresis thresholds from the median of the non-zero
+// gradient magnitudes (0.66 and 1.33 times the median). The median is read from a 16-bit
+// histogram of the magnitudes rather than by sorting them. When there is no gradient, or the
+// median falls in the lowest bin, both thresholds are 0 and hysteresis marks no edges.
+func autoCannyThresholds(magnitude plane) (low, high float64) {
+	hist := make([]int, maxHistogramBins)
+	count := 0
+	for _, m := range magnitude.data {
+		if m > 0 {
+			hist[binOf(m, maxHistogramBins)]++
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+
+	bin, seen := 0, 0
+	for ; seen+hist[bin] <= count/2; bin++ {
+		seen += hist[bin]
+	}
+	median := float64(bin) / (maxHistogramBins - 1)
+	return math.Min(0.66*median, 1), math.Min(1.33*median, 1)
+}
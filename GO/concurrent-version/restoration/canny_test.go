@@ -0,0 +1,87 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCannyEdgesOnePixelWide(t *testing.T) {
+	tests := []struct {
+		name  string
+		sigma float64
+		step  int // Column where the image turns white
+	}{
+		{"sharp step", 0.5, 8},
+		{"blurred step", 1.4, 8},
+		{"step near the border", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewGray(image.Rect(0, 0, 16, 12))
+			for y := 0; y < 12; y++ {
+				for x := tt.step; x < 16; x++ {
+					img.SetGray(x, y, color.Gray{0xff})
+				}
+			}
+			opts := DefaultCannyOptions()
+			opts.Sigma = tt.sigma
+			edges := CannyEdgeDetectionConcurrent(img, opts, 3)
+
+			for y := 0; y < 12; y++ {
+				var cols []int
+				for x := 0; x < 16; x++ {
+					if edges.At(x, y) == 1 {
+						cols = append(cols, x)
+					}
+				}
+				if len(cols) != 1 || (cols[0] != tt.step-1 && cols[0] != tt.step) {
+					t.Fatalf("row %d: edge pixels at %v, want one next to column %d", y, cols, tt.step)
+				}
+			}
+		})
+	}
+}
+
+func TestAutoCannyThresholds(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 7, 1000} {
+		p := newPlane(n, 1)
+		var values []float64
+		for i := range p.data {
+			if rng.Intn(3) > 0 {
+				p.data[i] = float32(rng.Intn(0x10000)) / 0xffff
+				values = append(values, float64(p.data[i]))
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		sort.Float64s(values)
+		median := values[len(values)/2]
+
+		low, high := autoCannyThresholds(p)
+		if math.Abs(low-0.66*median) > 1e-6 || math.Abs(high-math.Min(1.33*median, 1)) > 1e-6 {
+			t.Errorf("%d samples: thresholds (%v, %v), want (%v, %v)", n, low, high, 0.66*median, math.Min(1.33*median, 1))
+		}
+	}
+
+	// A flat image has no edges, whatever the thresholds
+	flat := image.NewNRGBA64(image.Rect(0, 0, 16, 16))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0x80
+	}
+	opts := DefaultCannyOptions()
+	opts.AutoThreshold = true
+	edges := CannyEdgeDetectionConcurrent(flat, opts, 3)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if edges.At(x, y) != 0 {
+				t.Fatalf("flat image: pixel (%d, %d) marked as an edge", x, y)
+			}
+		}
+	}
+}
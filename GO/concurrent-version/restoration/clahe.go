@@ -0,0 +1,178 @@
+package restoration
+
+import (
+	"image"
+	"math"
+)
+
+// CLAHEOptions tunes contrast limited adaptive histogram equalisation.
+type CLAHEOptions struct {
+	TilesX, TilesY int     // Number of tiles across and down the image
+	ClipLimit      float64 // Histogram bins are clipped at this multiple of the average bin count (0 disables clipping)
+}
+
+// DefaultCLAHEOptions returns an 8x8 tile grid with a moderate clip limit.
+func DefaultCLAHEOptions() CLAHEOptions {
+	return CLAHEOptions{
+		TilesX:    8,
+		TilesY:    8,
+		ClipLimit: 2,
+	}
+}
+
+// CLAHEConcurrent applies contrast limited adaptive histogram equalisation to the R, G and B
+// channels of an image. The image is split into a grid of tiles and every tile gets its own
+// equalisation mapping, computed in parallel; clipping the tile histograms limits how much
+// the contrast of flat areas, and their noise, can be amplified. Each pixel is mapped by
+// bilinear interpolation between the mappings of the four nearest tile centres, so no tile
+// borders are visible. Alpha is left unchanged.
+func CLAHEConcurrent(img image.Image, opts CLAHEOptions, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return clahe(src, opts, ChannelsRGB, numWorkers).toNRGBA64(numWorkers)
+}
+
+// clahe equalises the selected channels of a working copy.
+func clahe(src *floatImage, opts CLAHEOptions, channels Channels, numWorkers int) *floatImage {
+	grid := newCLAHEGrid(src.Width, src.Height, opts, channels)
+
+	// One lookup table per tile and channel
+	parallelRows(len(grid.luts), numWorkers, func(start, end int) {
+		for t := start; t < end; t++ {
+			x0, x1, y0, y1 := grid.tile(t)
+			for c := 0; c < 4; c++ {
+				if channels&(1<<c) != 0 {
+					hist, total := tileHistogram(src, c, x0, x1, y0, y1)
+					grid.luts[t][c] = clippedEqualization(hist, total, opts.ClipLimit)
+				}
+			}
+		}
+	})
+	return grid.apply(src, 0, numWorkers)
+}
+
+// claheGrid holds the tile grid of CLAHE over an image and the lookup table of every tile and channel.
+type claheGrid struct {
+	width, height  int
+	tilesX, tilesY int
+	tileW, tileH   float64
+	channels       Channels
+	luts           [][4][]float32
+}
+
+// newCLAHEGrid lays the tile grid of opts over an image of the given size.
+func newCLAHEGrid(width, height int, opts CLAHEOptions, channels Channels) *claheGrid {
+	tilesX, tilesY := clampInt(opts.TilesX, 1, width), clampInt(opts.TilesY, 1, height)
+	return &claheGrid{
+		width:    width,
+		height:   height,
+		tilesX:   tilesX,
+		tilesY:   tilesY,
+		tileW:    float64(width) / float64(tilesX),
+		tileH:    float64(height) / float64(tilesY),
+		channels: channels,
+		luts:     make([][4][]float32, tilesX*tilesY),
+	}
+}
+
+// tile returns the pixel columns [x0, x1) and rows [y0, y1) of tile t.
+func (g *claheGrid) tile(t int) (x0, x1, y0, y1 int) {
+	tx, ty := t%g.tilesX, t/g.tilesX
+	x0, x1 = int(float64(tx)*g.tileW), int(float64(tx+1)*g.tileW)
+	y0, y1 = int(float64(ty)*g.tileH), int(float64(ty+1)*g.tileH)
+	return x0, x1, y0, y1
+}
+
+// apply maps the selected channels of rows of the image, whose first row is image row y0,
+// by interpolating between the tables of the four nearest tile centres.
+func (g *claheGrid) apply(src *floatImage, y0 int, numWorkers int) *floatImage {
+	tilesX := g.tilesX
+	dst := newFloatImage(src.Rect)
+	copy(dst.Pix, src.Pix)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			ty0, ty1, wy := tileNeighbours(y0+y, g.tileH, g.tilesY)
+			for x := 0; x < src.Width; x++ {
+				tx0, tx1, wx := tileNeighbours(x, g.tileW, tilesX)
+				o := src.offset(x, y)
+				for c := 0; c < 4; c++ {
+					if g.channels&(1<<c) == 0 {
+						continue
+					}
+					v := src.Pix[o+c]
+					top := lookup(g.luts[ty0*tilesX+tx0][c], v)*(1-wx) + lookup(g.luts[ty0*tilesX+tx1][c], v)*wx
+					bottom := lookup(g.luts[ty1*tilesX+tx0][c], v)*(1-wx) + lookup(g.luts[ty1*tilesX+tx1][c], v)*wx
+					dst.Pix[o+c] = top*(1-wy) + bottom*wy
+				}
+			}
+		}
+	})
+	return dst
+}
+
+// tileNeighbours returns the two tiles whose centres surround pixel i along one axis and the
+// interpolation weight of the second one. Pixels beyond the outer tile centres use that tile only.
+func tileNeighbours(i int, tileSize float64, tiles int) (t0, t1 int, w float32) {
+	pos := (float64(i)+0.5)/tileSize - 0.5
+	t0 = int(math.Floor(pos))
+	if t0 < 0 {
+		return 0, 0, 0
+	}
+	if t0 >= tiles-1 {
+		return tiles - 1, tiles - 1, 0
+	}
+	return t0, t0 + 1, float32(pos - float64(t0))
+}
+
+// tileBins returns the number of histogram bins of a tile. Large tiles of 16-bit scans get
+// more bins, so the mapping keeps their tonal resolution.
+func tileBins(x0, x1, y0, y1 int) int {
+	return histogramBins((x1 - x0) * (y1 - y0))
+}
+
+// tileHistogram counts the samples of one channel over a tile and returns the histogram with
+// the number of visible pixels.
+func tileHistogram(src *floatImage, c, x0, x1, y0, y1 int) (hist []float64, total float64) {
+	bins := tileBins(x0, x1, y0, y1)
+	hist = make([]float64, bins)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			if i := src.offset(x, y); !src.transparent(i) {
+				hist[binOf(src.Pix[i+c], bins)]++
+				total++
+			}
+		}
+	}
+	return hist, total
+}
+
+// clippedEqualization builds the clipped equalisation mapping of a tile histogram over total
+// pixels. The histogram is clipped in place.
+func clippedEqualization(hist []float64, total, clipLimit float64) []float32 {
+	if total == 0 {
+		return []float32{0, 1} // Fully transparent tile: identity
+	}
+	bins := len(hist)
+
+	// Clip the histogram and spread the excess evenly over all bins
+	if clipLimit > 0 {
+		limit := math.Max(1, clipLimit*total/float64(bins))
+		excess := 0.0
+		for i, h := range hist {
+			if h > limit {
+				excess += h - limit
+				hist[i] = limit
+			}
+		}
+		for i := range hist {
+			hist[i] += excess / float64(bins)
+		}
+	}
+
+	lut := make([]float32, bins)
+	cumulative := 0.0
+	for i, h := range hist {
+		cumulative += h
+		lut[i] = float32(cumulative / total)
+	}
+	return lut
+}
@@ -0,0 +1,143 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestHistogramBins(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{0, 256},
+		{1023, 256},
+		{1024, 512},
+		{64 * 64, 2048},
+		{256 * 256, 32768},
+		{2*65536 - 1, 32768},
+		{2 * 65536, 65536},
+		{20000 * 15000, 65536},
+	}
+	for _, tt := range tests {
+		if got := histogramBins(tt.n); got != tt.want {
+			t.Errorf("histogramBins(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestClippedEqualization(t *testing.T) {
+	// A spike of 910 samples in bin 2 over 1000 samples in 10 bins
+	hist := []float64{10, 10, 910, 10, 10, 10, 10, 10, 10, 10}
+	plain := clippedEqualization(append([]float64(nil), hist...), 1000, 0)
+	clipped := clippedEqualization(append([]float64(nil), hist...), 1000, 2)
+
+	// Without clipping the spike takes 91% of the output range, with a clip limit of twice the
+	// average bin (200) it keeps 20%, and the 710 clipped samples are spread over every bin
+	if step := plain[2] - plain[1]; math.Abs(float64(step)-0.91) > 1e-6 {
+		t.Errorf("unclipped spike step %v, want 0.91", step)
+	}
+	if step := clipped[2] - clipped[1]; math.Abs(float64(step)-0.271) > 1e-6 {
+		t.Errorf("clipped spike step %v, want 0.2 plus 0.071 of redistributed excess", step)
+	}
+	if step := clipped[5] - clipped[4]; math.Abs(float64(step)-0.081) > 1e-6 {
+		t.Errorf("clipped flat step %v, want 0.01 plus 0.071 of redistributed excess", step)
+	}
+	for _, lut := range [][]float32{plain, clipped} {
+		if math.Abs(float64(lut[len(lut)-1])-1) > 1e-6 {
+			t.Errorf("mapping ends at %v, want 1 (no samples lost)", lut[len(lut)-1])
+		}
+		for i := 1; i < len(lut); i++ {
+			if lut[i] < lut[i-1] {
+				t.Errorf("mapping decreases at bin %d: %v", i, lut)
+			}
+		}
+	}
+
+	// Fully transparent tiles keep their values
+	if lut := clippedEqualization(make([]float64, 10), 0, 2); lookup(lut, 0.3) != 0.3 {
+		t.Errorf("empty tile maps 0.3 to %v, want the identity", lookup(lut, 0.3))
+	}
+}
+
+func TestCLAHEFlatImageKeepsValue(t *testing.T) {
+	for _, v := range []uint16{0x3333, 0x8000, 0xcccc} {
+		img := image.NewNRGBA64(image.Rect(0, 0, 128, 128))
+		for y := 0; y < 128; y++ {
+			for x := 0; x < 128; x++ {
+				img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+			}
+		}
+		got := CLAHEConcurrent(img, CLAHEOptions{TilesX: 2, TilesY: 2, ClipLimit: 2}, 3)
+
+		// Clipping spreads the single full bin evenly over the whole range, so every tile maps
+		// the level close to itself
+		want := float64(v) / 0xffff
+		for y := 0; y < 128; y++ {
+			for x := 0; x < 128; x++ {
+				if c := float64(got.NRGBA64At(x, y).R) / 0xffff; math.Abs(c-want) > 1.0/255 {
+					t.Fatalf("flat %.3f: pixel (%d, %d) mapped to %.3f", want, x, y, c)
+				}
+			}
+		}
+	}
+}
+
+func TestCLAHENoTileSeams(t *testing.T) {
+	// Every tile of a ramp stretches its own slice of the range; blending the mappings of the
+	// neighbouring tiles must keep the rows rising, without a jump where one tile meets the next
+	const width, height = 128, 32
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint16(0x2000 + 0x180*x)
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+		}
+	}
+	opts := CLAHEOptions{TilesX: 4, TilesY: 1, ClipLimit: 2}
+	got := CLAHEConcurrent(img, opts, 3)
+
+	tileWidth := width / opts.TilesX
+	for y := 0; y < height; y++ {
+		var inner, border float64
+		for x := 1; x < width; x++ {
+			step := float64(got.NRGBA64At(x, y).R) - float64(got.NRGBA64At(x-1, y).R)
+			if step < 0 {
+				t.Fatalf("row %d decreases at x=%d", y, x)
+			}
+			if x%tileWidth == 0 {
+				border = math.Max(border, step)
+			} else {
+				inner = math.Max(inner, step)
+			}
+		}
+		if border > 1.5*inner {
+			t.Fatalf("row %d: step of %.0f across a tile border, at most %.0f inside tiles", y, border, inner)
+		}
+	}
+}
+
+func TestCLAHEKeeps16BitLevels(t *testing.T) {
+	// 256 adjacent 16-bit levels, all inside one 8-bit bin: a 256-bin histogram would map them
+	// to a single value, the adaptive bins of a 256x256 image stretch them apart
+	const size = 256
+	img := image.NewNRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := uint16(0x8000 + x)
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+		}
+	}
+	got := CLAHEConcurrent(img, CLAHEOptions{TilesX: 1, TilesY: 1}, 3)
+	levels := map[uint16]bool{}
+	for x := 0; x < size; x++ {
+		levels[got.NRGBA64At(x, 0).R] = true
+	}
+	if len(levels) < 32 {
+		t.Errorf("%d distinct output levels, want the input levels kept apart", len(levels))
+	}
+	if lo, hi := got.NRGBA64At(0, 0).R, got.NRGBA64At(size-1, 0).R; hi-lo < 0x8000 {
+		t.Errorf("output spans %#x-%#x, want the narrow input range stretched", lo, hi)
+	}
+}
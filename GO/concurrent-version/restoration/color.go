@@ -3,101 +3,14 @@ package restoration
 import (
 	"image"
 	"image/color"
-	"math"
-	"sync"
 )
 
 // HistEqualConcurrent applies histogram equalization to an image using concurrent processing.
 // This enhances the contrast of the image by redistributing pixel intensity values.
-func HistEqualConcurrent(img image.Image, numWorkers int) *image.RGBA {
-	bounds := img.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
-	newImg := image.NewRGBA(bounds)
-
-	// Create histograms for each channel
-	histR, histG, histB := make([]int, 256), make([]int, 256), make([]int, 256)
-
-	// Mutex to synchronize access to shared histogram data
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	// Determine chunk size for dividing work among workers
-	chunkHeight := int(math.Ceil(float64(height) / float64(numWorkers)))
-
-	// Function to process a chunk of the image and calculate local histograms
-	processChunk := func(startY, endY int) {
-		defer wg.Done()
-		localHistR, localHistG, localHistB := make([]int, 256), make([]int, 256), make([]int, 256)
-
-		for y := startY; y < endY; y++ {
-			for x := 0; x < width; x++ {
-				c := img.At(x, y)
-				r, g, b, _ := c.RGBA()
-				localHistR[r>>8]++
-				localHistG[g>>8]++
-				localHistB[b>>8]++
-			}
-		}
-
-		// Merge local histograms into the global histograms
-		mu.Lock()
-		for i := 0; i < 256; i++ {
-			histR[i] += localHistR[i]
-			histG[i] += localHistG[i]
-			histB[i] += localHistB[i]
-		}
-		mu.Unlock()
-	}
-
-	// Launch workers to compute histograms in parallel
-	for startY := 0; startY < height; startY += chunkHeight {
-		endY := startY + chunkHeight
-		if endY > height {
-			endY = height
-		}
-		wg.Add(1)
-		go processChunk(startY, endY)
-	}
-
-	wg.Wait()
-
-	// Compute cumulative distribution function (CDF) for each color channel
-	cdfR := computeCDF(histR)
-	cdfG := computeCDF(histG)
-	cdfB := computeCDF(histB)
-
-	// Find minimum and maximum CDF values for normalization
-	minR, maxR := findMinMax(cdfR)
-	minG, maxG := findMinMax(cdfG)
-	minB, maxB := findMinMax(cdfB)
-
-	// Function to apply histogram equalization to a chunk of the image
-	wg = sync.WaitGroup{}
-	processEqualizationChunk := func(startY, endY int) {
-		defer wg.Done()
-		for y := startY; y < endY; y++ {
-			for x := 0; x < width; x++ {
-				r, g, b, a := img.At(x, y).RGBA()
-				newR := uint8(((cdfR[r>>8] - minR) * 255) / (maxR - minR))
-				newG := uint8(((cdfG[g>>8] - minG) * 255) / (maxG - minG))
-				newB := uint8(((cdfB[b>>8] - minB) * 255) / (maxB - minB))
-				newImg.SetRGBA(x, y, color.RGBA{R: newR, G: newG, B: newB, A: uint8(a >> 8)})
-			}
-		}
-	}
-
-	// Launch workers to apply histogram equalization in parallel
-	for startY := 0; startY < height; startY += chunkHeight {
-		endY := startY + chunkHeight
-		if endY > height {
-			endY = height
-		}
-		wg.Add(1)
-		go processEqualizationChunk(startY, endY)
-	}
-
-	wg.Wait()
-	return newImg
+// Histograms are built in parallel with up to 65536 bins, so 16-bit scans keep their precision.
+func HistEqualConcurrent(img image.Image, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return histEqualize(src, ChannelsRGB, numWorkers).toNRGBA64(numWorkers)
 }
 
 // findMinMax finds the minimum and maximum non-zero values in a CDF for normalization
@@ -126,29 +39,39 @@ func computeCDF(hist []int) []int {
 
 // GetGlobalAverageColor calculates the average color of an image by summing all pixel values
 func GetGlobalAverageColor(img image.Image) color.Color {
-	var rSum, gSum, bSum uint64
-	var count uint64
+	return averageColor(colorSums(img))
+}
 
+// colorSums sums the 16-bit R, G and B values of the visible pixels of an image and counts them.
+func colorSums(img image.Image) (sums [3]uint64, count uint64) {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
 	// Iterate over each pixel to sum up RGB values
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			c := img.At(x, y)
-			r, g, b, _ := c.RGBA()
-			rSum += uint64(r)
-			gSum += uint64(g)
-			bSum += uint64(b)
+			c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+			if c.A == 0 {
+				continue // Transparent pixels have no colour
+			}
+			sums[0] += uint64(c.R)
+			sums[1] += uint64(c.G)
+			sums[2] += uint64(c.B)
 			count++
 		}
 	}
+	return sums, count
+}
 
-	// Compute the average color
-	return color.RGBA{
-		R: uint8((rSum / count) >> 8),
-		G: uint8((gSum / count) >> 8),
-		B: uint8((bSum / count) >> 8),
-		A: 255,
+// averageColor divides the sums of colorSums by the pixel count.
+func averageColor(sums [3]uint64, count uint64) color.Color {
+	if count == 0 {
+		return color.RGBA64{A: 0xffff}
+	}
+	return color.RGBA64{
+		R: uint16(sums[0] / count),
+		G: uint16(sums[1] / count),
+		B: uint16(sums[2] / count),
+		A: 0xffff,
 	}
 }
@@ -0,0 +1,377 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// ColorSpace selects the colour space in which contrast is equalised.
+type ColorSpace int
+
+const (
+	ColorSpaceRGB   ColorSpace = iota // R, G and B equalised independently
+	ColorSpaceYCbCr                   // Luma Y only, chroma Cb and Cr kept
+	ColorSpaceHSV                     // Value V only, hue and saturation kept
+	ColorSpaceLab                     // Lightness L* only, a* and b* kept
+)
+
+// ParseColorSpace converts a command line name (rgb, ycbcr, hsv, lab) into a ColorSpace.
+func ParseColorSpace(name string) (ColorSpace, error) {
+	switch name {
+	case "rgb":
+		return ColorSpaceRGB, nil
+	case "ycbcr":
+		return ColorSpaceYCbCr, nil
+	case "hsv":
+		return ColorSpaceHSV, nil
+	case "lab":
+		return ColorSpaceLab, nil
+	}
+	return ColorSpaceRGB, fmt.Errorf("unknown colour space %q", name)
+}
+
+// D65 reference white used by the CIE L*a*b* conversions.
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// rgbSpace describes the RGB space the colour conversions work in: its primaries and white as
+// matrices to and from CIE XYZ, and the luma weights they give. Components are encoded with the
+// sRGB transfer curve in every space.
+type rgbSpace struct {
+	toXYZ   [3][3]float64 // Linear RGB to CIE XYZ, relative to white
+	fromXYZ [3][3]float64 // Inverse of toXYZ
+	white   [3]float64    // Reference white of CIE L*a*b*
+	luma    [3]float64    // Weights of R, G and B in the luma Y
+}
+
+// srgbSpace is sRGB with a D65 white and BT.601 luma, the space of untagged photos.
+var srgbSpace = &rgbSpace{
+	toXYZ: [3][3]float64{
+		{0.4124564, 0.3575761, 0.1804375},
+		{0.2126729, 0.7151522, 0.0721750},
+		{0.0193339, 0.1191920, 0.9503041},
+	},
+	fromXYZ: [3][3]float64{
+		{3.2404542, -1.5371385, -0.4985314},
+		{-0.9692660, 1.8760108, 0.0415560},
+		{0.0556434, -0.2040259, 1.0572252},
+	},
+	white: [3]float64{whiteX, whiteY, whiteZ},
+	luma:  [3]float64{0.299, 0.587, 0.114},
+}
+
+// workingSpace has the primaries and D65 white of ITU-R BT.2020, which hold sRGB, Adobe RGB and
+// nearly every printed colour. Scans with a colour profile are processed in it, see
+// ProfileToWorkingConcurrent.
+var workingSpace = newRGBSpace([3][3]float64{
+	{0.6369580, 0.1446169, 0.1688810},
+	{0.2627002, 0.6779981, 0.0593017},
+	{0.0000000, 0.0280727, 1.0609851},
+})
+
+// newRGBSpace derives the white and the luma weights of a space from its matrix to XYZ.
+func newRGBSpace(toXYZ [3][3]float64) *rgbSpace {
+	s := &rgbSpace{toXYZ: toXYZ, fromXYZ: invertMatrix(toXYZ)}
+	for i := range s.white {
+		s.white[i] = toXYZ[i][0] + toXYZ[i][1] + toXYZ[i][2]
+	}
+	for c := range s.luma {
+		s.luma[c] = toXYZ[1][c] / s.white[1]
+	}
+	return s
+}
+
+// toYCbCr converts components in [0, 1] to full-range YCbCr with the luma weights of the space.
+func (s *rgbSpace) toYCbCr(r, g, b float64) (y, cb, cr float64) {
+	y = s.luma[0]*r + s.luma[1]*g + s.luma[2]*b
+	cb = (b - y) / (2 * (1 - s.luma[2]))
+	cr = (r - y) / (2 * (1 - s.luma[0]))
+	return y, cb, cr
+}
+
+// fromYCbCr inverts toYCbCr.
+func (s *rgbSpace) fromYCbCr(y, cb, cr float64) (r, g, b float64) {
+	r = y + 2*(1-s.luma[0])*cr
+	b = y + 2*(1-s.luma[2])*cb
+	g = (y - s.luma[0]*r - s.luma[2]*b) / s.luma[1]
+	return r, g, b
+}
+
+// toLab converts components in [0, 1] to CIE L*a*b* relative to the white of the space.
+func (s *rgbSpace) toLab(r, g, b float64) (lStar, aStar, bStar float64) {
+	lr, lg, lb := srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	m := &s.toXYZ
+	x := (m[0][0]*lr + m[0][1]*lg + m[0][2]*lb) / s.white[0]
+	y := (m[1][0]*lr + m[1][1]*lg + m[1][2]*lb) / s.white[1]
+	z := (m[2][0]*lr + m[2][1]*lg + m[2][2]*lb) / s.white[2]
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// fromLab inverts toLab. Colours outside the gamut of the space give components outside [0, 1].
+func (s *rgbSpace) fromLab(lStar, aStar, bStar float64) (r, g, b float64) {
+	fy := (lStar + 16) / 116
+	fx := fy + aStar/500
+	fz := fy - bStar/200
+	x, y, z := labFInv(fx)*s.white[0], labFInv(fy)*s.white[1], labFInv(fz)*s.white[2]
+
+	m := &s.fromXYZ
+	lr := m[0][0]*x + m[0][1]*y + m[0][2]*z
+	lg := m[1][0]*x + m[1][1]*y + m[1][2]*z
+	lb := m[2][0]*x + m[2][1]*y + m[2][2]*z
+	return linearToSRGB(lr), linearToSRGB(lg), linearToSRGB(lb)
+}
+
+// RGBToYCbCr converts sRGB components in [0, 1] to full-range BT.601 YCbCr.
+// Y is in [0, 1]; Cb and Cr are centred on zero, in [-0.5, 0.5].
+func RGBToYCbCr(r, g, b float64) (y, cb, cr float64) {
+	return srgbSpace.toYCbCr(r, g, b)
+}
+
+// YCbCrToRGB converts full-range BT.601 YCbCr back to sRGB components.
+func YCbCrToRGB(y, cb, cr float64) (r, g, b float64) {
+	return srgbSpace.fromYCbCr(y, cb, cr)
+}
+
+// RGBToHSV converts sRGB components in [0, 1] to hue in degrees [0, 360), saturation and value in [0, 1].
+func RGBToHSV(r, g, b float64) (h, s, v float64) {
+	v = math.Max(r, math.Max(g, b))
+	chroma := v - math.Min(r, math.Min(g, b))
+	if v > 0 {
+		s = chroma / v
+	}
+	if chroma == 0 {
+		return 0, s, v // Gray: hue is undefined
+	}
+	switch v {
+	case r:
+		h = math.Mod((g-b)/chroma, 6)
+	case g:
+		h = (b-r)/chroma + 2
+	default:
+		h = (r-g)/chroma + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, v
+}
+
+// HSVToRGB converts hue in degrees, saturation and value back to sRGB components.
+func HSVToRGB(h, s, v float64) (r, g, b float64) {
+	chroma := v * s
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	sector := h / 60
+	x := chroma * (1 - math.Abs(math.Mod(sector, 2)-1))
+	switch int(sector) {
+	case 0:
+		r, g, b = chroma, x, 0
+	case 1:
+		r, g, b = x, chroma, 0
+	case 2:
+		r, g, b = 0, chroma, x
+	case 3:
+		r, g, b = 0, x, chroma
+	case 4:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	m := v - chroma
+	return r + m, g + m, b + m
+}
+
+// RGBToLab converts sRGB components in [0, 1] to CIE L*a*b* under a D65 white point.
+// L* is in [0, 100]; a* and b* are roughly in [-128, 127].
+func RGBToLab(r, g, b float64) (lStar, aStar, bStar float64) {
+	return srgbSpace.toLab(r, g, b)
+}
+
+// LabToRGB converts CIE L*a*b* under a D65 white point back to sRGB components.
+// Colours outside the sRGB gamut give components outside [0, 1].
+func LabToRGB(lStar, aStar, bStar float64) (r, g, b float64) {
+	return srgbSpace.fromLab(lStar, aStar, bStar)
+}
+
+// labF is the cube-root compression of the CIE L*a*b* transform, linear near black.
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// labFInv inverts labF.
+func labFInv(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta {
+		return t * t * t
+	}
+	return 3 * delta * delta * (t - 4.0/29)
+}
+
+// srgbToLinear removes the sRGB transfer curve from a component in [0, 1].
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB applies the sRGB transfer curve to a linear component.
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// toColorSpace converts the R, G and B channels of a working copy in the RGB space rgb into the
+// given colour space. Channel 0 holds the lightness component scaled to [0, 1] (Y, V or L*/100), channels 1 and 2
+// hold the chroma components unscaled. Alpha is copied.
+func toColorSpace(src *floatImage, space ColorSpace, rgb *rgbSpace, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.Width; x++ {
+				o := src.offset(x, y)
+				r, g, b := float64(src.Pix[o]), float64(src.Pix[o+1]), float64(src.Pix[o+2])
+				var c0, c1, c2 float64
+				switch space {
+				case ColorSpaceYCbCr:
+					c0, c1, c2 = rgb.toYCbCr(r, g, b)
+				case ColorSpaceHSV:
+					c1, c2, c0 = RGBToHSV(r, g, b)
+				case ColorSpaceLab:
+					c0, c1, c2 = rgb.toLab(r, g, b)
+					c0 /= 100
+				default:
+					c0, c1, c2 = r, g, b
+				}
+				dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = float32(c0), float32(c1), float32(c2), src.Pix[o+3]
+			}
+		}
+	})
+	return dst
+}
+
+// fromColorSpace converts a working copy produced by toColorSpace back to the RGB space rgb.
+func fromColorSpace(src *floatImage, space ColorSpace, rgb *rgbSpace, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.Width; x++ {
+				o := src.offset(x, y)
+				c0, c1, c2 := float64(src.Pix[o]), float64(src.Pix[o+1]), float64(src.Pix[o+2])
+				var r, g, b float64
+				switch space {
+				case ColorSpaceYCbCr:
+					r, g, b = rgb.fromYCbCr(c0, c1, c2)
+				case ColorSpaceHSV:
+					r, g, b = HSVToRGB(c1, c2, c0)
+				case ColorSpaceLab:
+					r, g, b = rgb.fromLab(c0*100, c1, c2)
+				default:
+					r, g, b = c0, c1, c2
+				}
+				dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = float32(r), float32(g), float32(b), src.Pix[o+3]
+			}
+		}
+	})
+	return dst
+}
+
+// HistEqualLightnessConcurrent equalises the histogram of the lightness channel of the given
+// colour space only, leaving hue and chroma untouched, so skin and sky keep their colour.
+// ColorSpaceRGB equalises R, G and B independently like HistEqualConcurrent.
+func HistEqualLightnessConcurrent(img image.Image, space ColorSpace, numWorkers int) *image.NRGBA64 {
+	return histEqualLightness(img, space, srgbSpace, numWorkers)
+}
+
+// histEqualLightness equalises the lightness of an image in the RGB space rgb.
+func histEqualLightness(img image.Image, space ColorSpace, rgb *rgbSpace, numWorkers int) *image.NRGBA64 {
+	channels := lightnessChannels(space)
+	src := toColorSpace(toFloatImage(img, numWorkers), space, rgb, numWorkers)
+	equalized := histEqualize(src, channels, numWorkers)
+	return fromColorSpace(equalized, space, rgb, numWorkers).toNRGBA64(numWorkers)
+}
+
+// CLAHELightnessConcurrent applies CLAHE to the lightness channel of the given colour space only.
+// ColorSpaceRGB equalises R, G and B independently like CLAHEConcurrent.
+func CLAHELightnessConcurrent(img image.Image, opts CLAHEOptions, space ColorSpace, numWorkers int) *image.NRGBA64 {
+	return claheLightness(img, opts, space, srgbSpace, numWorkers)
+}
+
+// claheLightness applies CLAHE to the lightness of an image in the RGB space rgb.
+func claheLightness(img image.Image, opts CLAHEOptions, space ColorSpace, rgb *rgbSpace, numWorkers int) *image.NRGBA64 {
+	channels := lightnessChannels(space)
+	src := toColorSpace(toFloatImage(img, numWorkers), space, rgb, numWorkers)
+	equalized := clahe(src, opts, channels, numWorkers)
+	return fromColorSpace(equalized, space, rgb, numWorkers).toNRGBA64(numWorkers)
+}
+
+// lightnessChannels returns the channels equalised in a colour space: the lightness, held in
+// channel 0 by toColorSpace, or R, G and B for ColorSpaceRGB.
+func lightnessChannels(space ColorSpace) Channels {
+	if space == ColorSpaceRGB {
+		return ChannelsRGB
+	}
+	return ChannelR
+}
+
+// histEqualize applies global histogram equalisation to the selected channels of a working copy.
+// The histograms use up to 65536 bins and the mapping is interpolated between them, so the
+// output keeps the tonal resolution of 16-bit scans.
+func histEqualize(src *floatImage, channels Channels, numWorkers int) *floatImage {
+	bins := histogramBins(src.Width * src.Height)
+	var luts [4][]float32
+	for c := range luts {
+		if channels&(1<<c) != 0 {
+			luts[c] = equalizationLUT(channelHistogram(src, c, bins, numWorkers))
+		}
+	}
+	return applyChannelLUTs(src, luts, numWorkers)
+}
+
+// equalizationLUT returns the equalisation mapping of a channel histogram, or nil for a flat
+// channel, which has nothing to stretch.
+func equalizationLUT(hist []int) []float32 {
+	cdf := computeCDF(hist)
+	minCDF, maxCDF := findMinMax(cdf)
+	if maxCDF == minCDF {
+		return nil
+	}
+	lut := make([]float32, len(cdf))
+	for i, v := range cdf {
+		lut[i] = clamp01(float32(v-minCDF) / float32(maxCDF-minCDF))
+	}
+	return lut
+}
+
+// applyChannelLUTs reads every channel of a working copy that has a lookup table through it and
+// copies the others.
+func applyChannelLUTs(src *floatImage, luts [4][]float32, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	copy(dst.Pix, src.Pix)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for c, lut := range luts {
+			if lut == nil {
+				continue
+			}
+			for i := src.offset(0, startY) + c; i < src.offset(0, endY); i += 4 {
+				dst.Pix[i] = lookup(lut, src.Pix[i])
+			}
+		}
+	})
+	return dst
+}
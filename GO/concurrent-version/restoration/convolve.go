@@ -0,0 +1,413 @@
+package restoration
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// BorderMode selects how filters read pixels that fall outside the image.
+type BorderMode int
+
+const (
+	BorderDefault  BorderMode = iota // Clamp, or the Border of Options in the stages of Restore
+	BorderClamp                      // Replicate the edge pixel: aaa|abcd|ddd
+	BorderReflect                    // Mirror around the edge pixel: cb|abcd|cb
+	BorderWrap                       // Tile the image: cd|abcd|ab
+	BorderConstant                   // Pad with a constant colour (opaque black unless specified)
+)
+
+// Channels is a set of image channels a convolution is applied to.
+type Channels uint8
+
+const (
+	ChannelR Channels = 1 << iota
+	ChannelG
+	ChannelB
+	ChannelA
+
+	ChannelsRGB = ChannelR | ChannelG | ChannelB
+	ChannelsAll = ChannelsRGB | ChannelA
+)
+
+// Kernel is a convolution kernel, either a full 2-D matrix or a separable pair of 1-D kernels.
+// Kernels are centred on the output pixel, so their sizes must be odd (see Validate).
+type Kernel struct {
+	Width, Height int       // Size of a 2-D kernel
+	Data          []float64 // Row-major weights of a 2-D kernel
+	Row, Col      []float64 // Weights of a separable kernel, applied along x then y
+	Normalize     bool      // Divide the weights by their sum before convolving
+}
+
+// ConvolveOptions controls how Convolve applies a kernel.
+type ConvolveOptions struct {
+	Border      BorderMode  // How pixels outside the image are read
+	BorderValue color.Color // Padding colour for BorderConstant, opaque black when nil
+	Channels    Channels    // Channels to convolve, the others are copied (zero means RGB)
+	NumWorkers  int         // Number of goroutines
+}
+
+// NewKernel builds a 2-D kernel from its rows.
+func NewKernel(rows [][]float64) Kernel {
+	if len(rows) == 0 {
+		return Kernel{}
+	}
+	k := Kernel{Height: len(rows), Width: len(rows[0])}
+	for _, row := range rows {
+		k.Data = append(k.Data, row...)
+	}
+	return k
+}
+
+// NewSeparableKernel builds a separable kernel: row is applied along x and col along y.
+func NewSeparableKernel(row, col []float64) Kernel {
+	return Kernel{Width: len(row), Height: len(col), Row: row, Col: col}
+}
+
+// GaussianKernel builds a normalised separable Gaussian kernel covering three standard deviations.
+func GaussianKernel(sigma float64) Kernel {
+	weights := gaussianKernel1D(sigma)
+	return NewSeparableKernel(weights, weights)
+}
+
+// Separable reports whether the kernel is stored as a row/column pair.
+func (k Kernel) Separable() bool {
+	return k.Data == nil && k.Row != nil && k.Col != nil
+}
+
+// Validate checks that the kernel can be centred on a pixel: a 2-D kernel needs an odd, positive
+// Width and Height and Width*Height weights, a separable kernel odd-length Row and Col weights.
+func (k Kernel) Validate() error {
+	if k.Data == nil && (k.Row != nil || k.Col != nil) {
+		if len(k.Row)%2 == 0 || len(k.Col)%2 == 0 {
+			return fmt.Errorf("separable kernel needs odd-length row and column weights, got %d and %d", len(k.Row), len(k.Col))
+		}
+		return nil
+	}
+	switch {
+	case k.Row != nil || k.Col != nil:
+		return errors.New("kernel has both 2-D and separable weights")
+	case k.Width <= 0 || k.Height <= 0 || k.Width%2 == 0 || k.Height%2 == 0:
+		return fmt.Errorf("kernel size %dx%d is not odd and positive", k.Width, k.Height)
+	case len(k.Data) != k.Width*k.Height:
+		return fmt.Errorf("%dx%d kernel has %d weights, want %d", k.Width, k.Height, len(k.Data), k.Width*k.Height)
+	}
+	return nil
+}
+
+// sum returns the sum of the kernel weights.
+func (k Kernel) sum() float64 {
+	total := func(weights []float64) float64 {
+		s := 0.0
+		for _, w := range weights {
+			s += w
+		}
+		return s
+	}
+	if k.Separable() {
+		return total(k.Row) * total(k.Col)
+	}
+	return total(k.Data)
+}
+
+// normalized returns a copy of the kernel whose weights sum to one.
+// Kernels summing to zero (edge detectors) are returned unchanged.
+func (k Kernel) normalized() Kernel {
+	scale := func(weights []float64) []float64 {
+		sum := 0.0
+		for _, w := range weights {
+			sum += w
+		}
+		if sum == 0 {
+			return weights
+		}
+		out := make([]float64, len(weights))
+		for i, w := range weights {
+			out[i] = w / sum
+		}
+		return out
+	}
+
+	n := k
+	n.Normalize = false
+	if k.Separable() {
+		n.Row, n.Col = scale(k.Row), scale(k.Col)
+	} else {
+		n.Data = scale(k.Data)
+	}
+	return n
+}
+
+// Convolve applies a user kernel to an image concurrently.
+// Rows are split between opts.NumWorkers goroutines, pixels outside the image are read with
+// opts.Border and only the channels in opts.Channels are filtered. Colours are weighted by
+// their alpha, so transparent pixels do not bleed into their visible neighbours.
+// Kernels that fail Validate are rejected.
+func Convolve(img image.Image, k Kernel, opts ConvolveOptions) (*image.NRGBA64, error) {
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	return convolve(img, k, opts), nil
+}
+
+// convolve applies a kernel known to be valid to an image.
+func convolve(img image.Image, k Kernel, opts ConvolveOptions) *image.NRGBA64 {
+	src := toFloatImage(img, opts.NumWorkers)
+	return convolveImage(src, k, opts).toNRGBA64(opts.NumWorkers)
+}
+
+// ParseBorderMode converts a command line name (clamp, reflect, wrap, constant) into a BorderMode.
+func ParseBorderMode(name string) (BorderMode, error) {
+	switch name {
+	case "clamp":
+		return BorderClamp, nil
+	case "reflect":
+		return BorderReflect, nil
+	case "wrap":
+		return BorderWrap, nil
+	case "constant":
+		return BorderConstant, nil
+	}
+	return BorderDefault, fmt.Errorf("unknown border mode %q", name)
+}
+
+// resolve replaces BorderDefault with clamping.
+func (m BorderMode) resolve() BorderMode {
+	if m == BorderDefault {
+		return BorderClamp
+	}
+	return m
+}
+
+// or returns the mode, or fallback when the mode is BorderDefault.
+func (m BorderMode) or(fallback BorderMode) BorderMode {
+	if m == BorderDefault {
+		return fallback
+	}
+	return m
+}
+
+// borderIndex maps a coordinate to a valid index in [0, n) according to the border mode.
+// It returns false when the constant border value must be used instead.
+func borderIndex(i, n int, mode BorderMode) (int, bool) {
+	if i >= 0 && i < n {
+		return i, true
+	}
+	switch mode.resolve() {
+	case BorderReflect:
+		if n == 1 {
+			return 0, true
+		}
+		period := 2 * (n - 1)
+		i %= period
+		if i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - i
+		}
+		return i, true
+	case BorderWrap:
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		return i, true
+	case BorderConstant:
+		return 0, false
+	default:
+		return clampInt(i, 0, n-1), true
+	}
+}
+
+// plane addresses one channel of a sample buffer.
+// Pixel (x, y) is stored at data[(y*width+x)*step], so a floatImage channel is
+// plane{Pix[c:], width, height, 4} and a single-channel buffer uses step 1.
+type plane struct {
+	data          []float32
+	width, height int
+	step          int
+}
+
+// newPlane allocates a zeroed single-channel plane.
+func newPlane(width, height int) plane {
+	return plane{data: make([]float32, width*height), width: width, height: height, step: 1}
+}
+
+// channel returns a view of one channel of a working copy.
+func (f *floatImage) channel(c int) plane {
+	return plane{data: f.Pix[c:], width: f.Width, height: f.Height, step: 4}
+}
+
+// at reads the sample at (x, y), which must be inside the plane.
+func (p plane) at(x, y int) float32 {
+	return p.data[(y*p.width+x)*p.step]
+}
+
+// set writes the sample at (x, y).
+func (p plane) set(x, y int, v float32) {
+	p.data[(y*p.width+x)*p.step] = v
+}
+
+// sample reads the sample at (x, y), resolving coordinates outside the plane with the border mode.
+func (p plane) sample(x, y int, border BorderMode, constant float32) float32 {
+	nx, okX := borderIndex(x, p.width, border)
+	ny, okY := borderIndex(y, p.height, border)
+	if !okX || !okY {
+		return constant
+	}
+	return p.at(nx, ny)
+}
+
+// convolvePlane convolves src with a kernel into dst. Kernels are centred on the pixel.
+func convolvePlane(dst, src plane, k Kernel, border BorderMode, constant float32, numWorkers int) {
+	if k.Separable() {
+		convolvePlaneSeparable(dst, src, k.Row, k.Col, border, constant, numWorkers)
+		return
+	}
+
+	offsetX := k.Width / 2
+	offsetY := k.Height / 2
+
+	parallelRows(src.height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.width; x++ {
+				var sum float64
+				for ky := 0; ky < k.Height; ky++ {
+					for kx := 0; kx < k.Width; kx++ {
+						weight := k.Data[ky*k.Width+kx]
+						if weight == 0 {
+							continue
+						}
+						sum += float64(src.sample(x+kx-offsetX, y+ky-offsetY, border, constant)) * weight
+					}
+				}
+				dst.set(x, y, float32(sum))
+			}
+		}
+	})
+}
+
+// convolvePlaneSeparable convolves src with a separable kernel, first along rows then along columns.
+func convolvePlaneSeparable(dst, src plane, row, col []float64, border BorderMode, constant float32, numWorkers int) {
+	tmp := newPlane(src.width, src.height)
+	offsetX := len(row) / 2
+	offsetY := len(col) / 2
+
+	// Horizontal pass
+	parallelRows(src.height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.width; x++ {
+				var sum float64
+				for k, weight := range row {
+					sum += float64(src.sample(x+k-offsetX, y, border, constant)) * weight
+				}
+				tmp.set(x, y, float32(sum))
+			}
+		}
+	})
+
+	// Vertical pass
+	parallelRows(src.height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.width; x++ {
+				var sum float64
+				for k, weight := range col {
+					sum += float64(tmp.sample(x, y+k-offsetY, border, constant)) * weight
+				}
+				dst.set(x, y, float32(sum))
+			}
+		}
+	})
+}
+
+// convolveImage convolves the selected channels of a working copy; the other channels are copied.
+func convolveImage(src *floatImage, k Kernel, opts ConvolveOptions) *floatImage {
+	if k.Normalize {
+		k = k.normalized()
+	}
+	channels := opts.Channels
+	if channels == 0 {
+		channels = ChannelsRGB
+	}
+
+	// Constant border colour, unpremultiplied like the working copy
+	constant := [4]float32{0, 0, 0, 1}
+	if opts.BorderValue != nil {
+		c := color.NRGBA64Model.Convert(opts.BorderValue).(color.NRGBA64)
+		constant = [4]float32{float32(c.R) / 0xffff, float32(c.G) / 0xffff, float32(c.B) / 0xffff, float32(c.A) / 0xffff}
+	}
+
+	if channels&ChannelsRGB != 0 && !src.opaque() {
+		return convolvePremultiplied(src, k, channels, opts.Border, constant, opts.NumWorkers)
+	}
+
+	dst := newFloatImage(src.Rect)
+	for c := 0; c < 4; c++ {
+		if channels&(1<<c) == 0 {
+			copyChannel(dst, src, c)
+			continue
+		}
+		convolvePlane(dst.channel(c), src.channel(c), k, opts.Border, constant[c], opts.NumWorkers)
+	}
+	return dst
+}
+
+// convolvePremultiplied convolves a working copy with transparency. Colours are multiplied by
+// alpha before filtering and divided by the filtered alpha afterwards, so every neighbour counts
+// in proportion to its opacity and fully transparent pixels do not count at all.
+func convolvePremultiplied(src *floatImage, k Kernel, channels Channels, border BorderMode, constant [4]float32, numWorkers int) *floatImage {
+	premultiplied := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			a := src.Pix[i+3]
+			premultiplied.Pix[i], premultiplied.Pix[i+1], premultiplied.Pix[i+2] = src.Pix[i]*a, src.Pix[i+1]*a, src.Pix[i+2]*a
+			premultiplied.Pix[i+3] = a
+		}
+	})
+	alpha := newPlane(src.Width, src.Height)
+	convolvePlane(alpha, src.channel(3), k, border, constant[3], numWorkers)
+
+	// Kernels that sum to zero (edge detectors) keep the premultiplied response
+	ksum := float32(k.sum())
+
+	dst := newFloatImage(src.Rect)
+	for c := 0; c < 3; c++ {
+		if channels&(1<<c) == 0 {
+			copyChannel(dst, src, c)
+			continue
+		}
+		out := dst.channel(c)
+		convolvePlane(out, premultiplied.channel(c), k, border, constant[c]*constant[3], numWorkers)
+		if ksum == 0 {
+			continue
+		}
+		parallelRows(src.Height, numWorkers, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < src.Width; x++ {
+					if a := alpha.at(x, y); a > 1e-6 {
+						out.set(x, y, out.at(x, y)*ksum/a)
+					} else {
+						out.set(x, y, src.Pix[src.offset(x, y)+c]) // No visible neighbour: keep the colour
+					}
+				}
+			}
+		})
+	}
+	if channels&ChannelA != 0 {
+		for i := 3; i < len(dst.Pix); i += 4 {
+			dst.Pix[i] = alpha.data[i/4]
+		}
+	} else {
+		copyChannel(dst, src, 3)
+	}
+	return dst
+}
+
+// copyChannel copies one channel of src into dst.
+func copyChannel(dst, src *floatImage, c int) {
+	for i := c; i < len(src.Pix); i += 4 {
+		dst.Pix[i] = src.Pix[i]
+	}
+}
@@ -0,0 +1,230 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBorderIndex(t *testing.T) {
+	tests := []struct {
+		mode BorderMode
+		n    int
+		in   []int
+		want []int // -1 for the constant border value
+	}{
+		{BorderClamp, 4, []int{-3, -1, 0, 3, 4, 7}, []int{0, 0, 0, 3, 3, 3}},
+		{BorderReflect, 4, []int{-3, -2, -1, 0, 3, 4, 5, 6, 7}, []int{3, 2, 1, 0, 3, 2, 1, 0, 1}},
+		{BorderReflect, 1, []int{-2, 0, 2}, []int{0, 0, 0}},
+		{BorderWrap, 4, []int{-5, -1, 0, 3, 4, 9}, []int{3, 3, 0, 3, 0, 1}},
+		{BorderConstant, 4, []int{-1, 0, 3, 4}, []int{-1, 0, 3, -1}},
+	}
+	for _, tt := range tests {
+		for i, in := range tt.in {
+			got, ok := borderIndex(in, tt.n, tt.mode)
+			if !ok {
+				got = -1
+			}
+			if got != tt.want[i] {
+				t.Errorf("borderIndex(%d, %d, %v) = %d, want %d", in, tt.n, tt.mode, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBorderDefaultResolves(t *testing.T) {
+	if got, _ := borderIndex(-1, 4, BorderDefault); got != 0 {
+		t.Errorf("BorderDefault: got %d, want 0 (clamped)", got)
+	}
+
+	// The border of the pipeline reaches every stage that does not choose its own
+	opts := testOptions()
+	opts.Border = BorderWrap
+	opts.Unsharp.Border = BorderReflect
+	opts = opts.withBorder()
+	for name, got := range map[string]BorderMode{
+		"edges":   opts.EdgeOptions.Border,
+		"canny":   opts.Canny.Border,
+		"denoise": opts.NLMeans.Border,
+	} {
+		if got != BorderWrap {
+			t.Errorf("%s border is %v, want the pipeline's wrap", name, got)
+		}
+	}
+	if opts.Unsharp.Border != BorderReflect {
+		t.Errorf("unsharp border is %v, want its own reflect", opts.Unsharp.Border)
+	}
+}
+
+func TestConvolveNoBlackFrame(t *testing.T) {
+	// A box blur of a flat image must stay flat up to the edges in every border mode
+	// except constant, which pads with black.
+	img := image.NewNRGBA64(image.Rect(2, 3, 9, 8))
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{0x8000, 0x8000, 0x8000, 0xffff})
+		}
+	}
+	box := NewKernel([][]float64{{1, 1, 1}, {1, 1, 1}, {1, 1, 1}})
+	box.Normalize = true
+
+	for _, mode := range []BorderMode{BorderClamp, BorderReflect, BorderWrap} {
+		out, err := Convolve(img, box, ConvolveOptions{Border: mode, NumWorkers: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Bounds() != img.Bounds() {
+			t.Fatalf("mode %v: bounds %v, want %v", mode, out.Bounds(), img.Bounds())
+		}
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if c := out.NRGBA64At(x, y); c.R != 0x8000 || c.A != 0xffff {
+					t.Fatalf("mode %v: pixel (%d, %d) = %v", mode, x, y, c)
+				}
+			}
+		}
+	}
+
+	out, err := Convolve(img, box, ConvolveOptions{Border: BorderConstant, NumWorkers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := out.NRGBA64At(2, 3); c.R >= 0x8000 {
+		t.Errorf("constant border: corner %v not darkened by the black padding", c)
+	}
+}
+
+func TestKernelValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		k     Kernel
+		valid bool
+	}{
+		{"3x3", NewKernel([][]float64{{0, 1, 0}, {1, 1, 1}, {0, 1, 0}}), true},
+		{"1x5", NewKernel([][]float64{{1, 1, 1, 1, 1}}), true},
+		{"separable", NewSeparableKernel([]float64{1, 2, 1}, []float64{1}), true},
+		{"zero value", Kernel{}, false},
+		{"no rows", NewKernel(nil), false},
+		{"even size", NewKernel([][]float64{{1, 1}, {1, 1}}), false},
+		{"ragged rows", NewKernel([][]float64{{1, 1, 1}, {1}, {1, 1, 1}}), false},
+		{"too few weights", Kernel{Width: 3, Height: 3, Data: []float64{1}}, false},
+		{"negative size", Kernel{Width: -1, Height: 1, Data: []float64{1}}, false},
+		{"row only", Kernel{Row: []float64{1, 2, 1}}, false},
+		{"column only", Kernel{Col: []float64{1, 2, 1}}, false},
+		{"even row", NewSeparableKernel([]float64{1, 1}, []float64{1, 2, 1}), false},
+		{"both forms", Kernel{Width: 1, Height: 1, Data: []float64{1}, Row: []float64{1}, Col: []float64{1}}, false},
+	}
+	img := randomImage(9, 7, false, 1)
+	for _, tt := range tests {
+		err := tt.k.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+		out, err := Convolve(img, tt.k, ConvolveOptions{NumWorkers: 3})
+		if (err == nil) != tt.valid || (out != nil) != tt.valid {
+			t.Errorf("%s: Convolve returned %T, %v, want valid %v", tt.name, out, err, tt.valid)
+		}
+	}
+}
+
+func TestConvolveSeparableMatches2D(t *testing.T) {
+	img := randomImage(13, 11, false, 2)
+	row, col := []float64{1, 2, 1}, []float64{-1, 0, 3, 0, -1}
+	full := Kernel{Width: len(row), Height: len(col)}
+	for _, c := range col {
+		for _, r := range row {
+			full.Data = append(full.Data, r*c)
+		}
+	}
+	for _, normalize := range []bool{false, true} {
+		separable := NewSeparableKernel(row, col)
+		separable.Normalize, full.Normalize = normalize, normalize
+		for _, mode := range []BorderMode{BorderClamp, BorderReflect, BorderWrap, BorderConstant} {
+			opts := ConvolveOptions{Border: mode, NumWorkers: 3}
+			got, err := Convolve(img, separable, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := Convolve(img, full, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeImages(t, got, want, 1)
+		}
+	}
+}
+
+func TestConvolveNormalize(t *testing.T) {
+	// Weights summing to 16 brighten a flat image 16 times unless normalised
+	img := image.NewNRGBA64(image.Rect(0, 0, 5, 5))
+	for i := range img.Pix {
+		img.Pix[i] = 0x08
+	}
+	binomial := NewKernel([][]float64{{1, 2, 1}, {2, 4, 2}, {1, 2, 1}})
+	raw, err := Convolve(img, binomial, ConvolveOptions{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binomial.Normalize = true
+	normalized, err := Convolve(img, binomial, ConvolveOptions{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := img.NRGBA64At(2, 2)
+	if got := normalized.NRGBA64At(2, 2); got != want {
+		t.Errorf("normalised kernel: %v, want %v", got, want)
+	}
+	if got := raw.NRGBA64At(2, 2); got.R != 16*want.R {
+		t.Errorf("raw kernel: red %#x, want %#x", got.R, 16*want.R)
+	}
+
+	// Zero-sum kernels are left as they are, so a flat image gives zero
+	laplacian := NewKernel([][]float64{{0, 1, 0}, {1, -4, 1}, {0, 1, 0}})
+	laplacian.Normalize = true
+	edges, err := Convolve(img, laplacian, ConvolveOptions{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := edges.NRGBA64At(2, 2); got.R != 0 {
+		t.Errorf("zero-sum kernel: red %#x on a flat image, want 0", got.R)
+	}
+}
+
+func TestConvolveChannels(t *testing.T) {
+	img := randomImage(8, 6, false, 3)
+	blur := GaussianKernel(1)
+	tests := []struct {
+		name     string
+		channels Channels
+		filtered [4]bool
+	}{
+		{"default is RGB", 0, [4]bool{true, true, true, false}},
+		{"red only", ChannelR, [4]bool{true, false, false, false}},
+		{"green and blue", ChannelG | ChannelB, [4]bool{false, true, true, false}},
+	}
+	for _, tt := range tests {
+		got, err := Convolve(img, blur, ConvolveOptions{Channels: tt.channels, NumWorkers: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := Convolve(img, blur, ConvolveOptions{Channels: ChannelsRGB, NumWorkers: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 6; y++ {
+			for x := 0; x < 8; x++ {
+				g, a, src := got.NRGBA64At(x, y), all.NRGBA64At(x, y), img.NRGBA64At(x, y)
+				samples := [4][3]uint16{{g.R, a.R, src.R}, {g.G, a.G, src.G}, {g.B, a.B, src.B}, {g.A, a.A, src.A}}
+				for c, s := range samples {
+					want := s[2] // Copied channel
+					if tt.filtered[c] {
+						want = s[1]
+					}
+					if s[0] != want {
+						t.Fatalf("%s: channel %d at (%d, %d) = %#x, want %#x", tt.name, c, x, y, s[0], want)
+					}
+				}
+			}
+		}
+	}
+}
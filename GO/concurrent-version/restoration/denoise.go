@@ -0,0 +1,145 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// NLMeansOptions tunes the non-local means denoiser.
+type NLMeansOptions struct {
+	PatchRadius  int        // Half-size of the compared patches (3 gives 7x7 patches)
+	SearchRadius int        // Half-size of the window searched for similar patches
+	H            float64    // Filtering strength on the 0-255 scale, higher values remove more grain
+	TileSize     int        // Side of the square tiles handed to each worker
+	Border       BorderMode // How pixels outside the image are read
+}
+
+// DefaultNLMeansOptions returns settings suited to the grain of scanned prints.
+func DefaultNLMeansOptions() NLMeansOptions {
+	return NLMeansOptions{
+		PatchRadius:  3,
+		SearchRadius: 7,
+		H:            10,
+		TileSize:     64,
+	}
+}
+
+// validate rejects radii and strengths the filter cannot run with.
+func (o NLMeansOptions) validate() error {
+	switch {
+	case o.PatchRadius < 0:
+		return fmt.Errorf("non-local means patch radius %d is negative", o.PatchRadius)
+	case o.SearchRadius < 0:
+		return fmt.Errorf("non-local means search radius %d is negative", o.SearchRadius)
+	case !(o.H > 0):
+		return fmt.Errorf("non-local means strength %v is not positive", o.H)
+	}
+	return nil
+}
+
+// NLMeansDenoiseConcurrent removes film grain with a non-local means filter.
+// Each pixel is replaced by an average of the pixels in its search window, weighted by how
+// similar their surrounding patches are; transparent pixels are never averaged in.
+// The image is split into tiles processed in parallel.
+func NLMeansDenoiseConcurrent(img image.Image, opts NLMeansOptions, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return nlMeans(src, opts, numWorkers).toNRGBA64(numWorkers)
+}
+
+// nlMeans runs the non-local means filter on a working copy.
+// Patch distances are computed per search offset with an integral image, so the cost
+// does not grow with the patch size.
+func nlMeans(src *floatImage, opts NLMeansOptions, numWorkers int) *floatImage {
+	width, height := src.Width, src.Height
+	dst := newFloatImage(src.Rect)
+	p, s := opts.PatchRadius, opts.SearchRadius
+	h := opts.H / 255
+	invH2 := 1 / (h * h)
+	patchArea := float64((2*p + 1) * (2*p + 1))
+
+	// sample reads one colour channel, resolving out-of-range pixels with the border mode
+	channels := [4]plane{src.channel(0), src.channel(1), src.channel(2), src.channel(3)}
+	sample := func(x, y, c int) float64 {
+		return float64(channels[c].sample(x, y, opts.Border, 0))
+	}
+
+	parallelTiles(width, height, opts.TileSize, numWorkers, func(xStart, xEnd, yStart, yEnd int) {
+		tw, th := xEnd-xStart, yEnd-yStart
+		// The distance image covers the tile plus a patch-radius halo
+		ew, eh := tw+2*p, th+2*p
+		integral := make([]float64, (ew+1)*(eh+1))
+		sumR := make([]float64, tw*th)
+		sumG := make([]float64, tw*th)
+		sumB := make([]float64, tw*th)
+		weightSum := make([]float64, tw*th)
+		maxWeight := make([]float64, tw*th)
+
+		for dy := -s; dy <= s; dy++ {
+			for dx := -s; dx <= s; dx++ {
+				if dx == 0 && dy == 0 {
+					continue // The centre pixel is added once its weight is known
+				}
+
+				// Integral image of the squared colour difference for this offset
+				for ey := 0; ey < eh; ey++ {
+					y := yStart - p + ey
+					var rowSum float64
+					for ex := 0; ex < ew; ex++ {
+						x := xStart - p + ex
+						var d float64
+						for c := 0; c < 3; c++ {
+							diff := sample(x, y, c) - sample(x+dx, y+dy, c)
+							d += diff * diff
+						}
+						rowSum += d / 3
+						integral[(ey+1)*(ew+1)+ex+1] = integral[ey*(ew+1)+ex+1] + rowSum
+					}
+				}
+
+				// Accumulate weighted contributions for every pixel of the tile
+				for ty := 0; ty < th; ty++ {
+					for tx := 0; tx < tw; tx++ {
+						x0, y0 := tx, ty
+						x1, y1 := tx+2*p+1, ty+2*p+1
+						dist := integral[y1*(ew+1)+x1] - integral[y0*(ew+1)+x1] -
+							integral[y1*(ew+1)+x0] + integral[y0*(ew+1)+x0]
+						dist /= patchArea
+
+						// Candidates count in proportion to their opacity, transparent ones not at all
+						x, y := xStart+tx+dx, yStart+ty+dy
+						weight := math.Exp(-dist*invH2) * sample(x, y, 3)
+						i := ty*tw + tx
+						sumR[i] += weight * sample(x, y, 0)
+						sumG[i] += weight * sample(x, y, 1)
+						sumB[i] += weight * sample(x, y, 2)
+						weightSum[i] += weight
+						if weight > maxWeight[i] {
+							maxWeight[i] = weight
+						}
+					}
+				}
+			}
+		}
+
+		// Add the centre pixel with the best neighbour weight and normalise
+		for ty := 0; ty < th; ty++ {
+			for tx := 0; tx < tw; tx++ {
+				i := ty*tw + tx
+				x, y := xStart+tx, yStart+ty
+				w := maxWeight[i]
+				if w == 0 {
+					w = 1 // No neighbours (search radius 0): keep the pixel as is
+				}
+				total := weightSum[i] + w
+				o := src.offset(x, y)
+				dst.Pix[o] = float32((sumR[i] + w*sample(x, y, 0)) / total)
+				dst.Pix[o+1] = float32((sumG[i] + w*sample(x, y, 1)) / total)
+				dst.Pix[o+2] = float32((sumB[i] + w*sample(x, y, 2)) / total)
+				dst.Pix[o+3] = src.Pix[o+3]
+			}
+		}
+	})
+
+	return dst
+}
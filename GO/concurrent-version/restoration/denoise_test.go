@@ -0,0 +1,97 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestNLMeansReducesGrain(t *testing.T) {
+	// Left half dark, right half bright, both with the same grain
+	const width, height = 48, 32
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			base := 0.25
+			if x >= width/2 {
+				base = 0.75
+			}
+			v := uint16(clamp01(float32(base+rng.NormFloat64()*0.02)) * 0xffff)
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+		}
+	}
+
+	got := NLMeansDenoiseConcurrent(img, DefaultNLMeansOptions(), 3)
+
+	// Mean and variance of the red channel over a patch well inside one half
+	stats := func(img *image.NRGBA64, x0, x1 int) (mean, variance float64) {
+		var sum, sum2, n float64
+		for y := 8; y < height-8; y++ {
+			for x := x0; x < x1; x++ {
+				v := float64(img.NRGBA64At(x, y).R) / 0xffff
+				sum += v
+				sum2 += v * v
+				n++
+			}
+		}
+		mean = sum / n
+		return mean, sum2/n - mean*mean
+	}
+	for _, half := range []struct {
+		name   string
+		x0, x1 int
+	}{{"dark", 4, width/2 - 4}, {"bright", width/2 + 4, width - 4}} {
+		mean, before := stats(img, half.x0, half.x1)
+		gotMean, after := stats(got, half.x0, half.x1)
+		if after > before/4 {
+			t.Errorf("%s half: variance %.3g after denoising, want below a quarter of %.3g", half.name, after, before)
+		}
+		if math.Abs(gotMean-mean) > 0.01 {
+			t.Errorf("%s half: mean moved from %.4f to %.4f", half.name, mean, gotMean)
+		}
+	}
+
+	// The step stays sharp: the columns either side of it keep their levels
+	for y := 0; y < height; y++ {
+		left := float64(got.NRGBA64At(width/2-1, y).R) / 0xffff
+		right := float64(got.NRGBA64At(width/2, y).R) / 0xffff
+		if right-left < 0.4 {
+			t.Fatalf("row %d: step blurred to %.3f-%.3f", y, left, right)
+		}
+	}
+}
+
+func TestRestoreRejectsNLMeansOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*NLMeansOptions)
+	}{
+		{"negative patch radius", func(o *NLMeansOptions) { o.PatchRadius = -1 }},
+		{"negative search radius", func(o *NLMeansOptions) { o.SearchRadius = -2 }},
+		{"zero strength", func(o *NLMeansOptions) { o.H = 0 }},
+		{"negative strength", func(o *NLMeansOptions) { o.H = -5 }},
+		{"NaN strength", func(o *NLMeansOptions) { o.H = math.NaN() }},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.Denoise = true
+		tt.set(&opts.NLMeans)
+		if _, err := Restore(scratchedPhoto(16, 16), opts); err == nil {
+			t.Errorf("%s: Restore accepted %+v", tt.name, opts.NLMeans)
+		}
+		if _, err := RestoreTiled(scratchedPhoto(16, 16), opts, 1<<30); err == nil {
+			t.Errorf("%s: RestoreTiled accepted %+v", tt.name, opts.NLMeans)
+		}
+	}
+
+	// Radius 0 is valid and leaves nothing to average
+	opts := testOptions()
+	opts.Denoise = true
+	opts.NLMeans.SearchRadius = 0
+	if _, err := Restore(scratchedPhoto(16, 16), opts); err != nil {
+		t.Errorf("search radius 0: %v", err)
+	}
+}
@@ -1,103 +1,315 @@
 package restoration
 
 import (
+	"fmt"
 	"image"
 	"math"
 	"sync"
 )
 
+// EdgeOperator selects the derivative operator used for edge detection.
+type EdgeOperator int
+
+const (
+	OperatorSobel   EdgeOperator = iota // 3x3 Sobel gradient
+	OperatorScharr                      // 3x3 Scharr gradient, more accurate orientation
+	OperatorPrewitt                     // 3x3 Prewitt gradient, no centre weighting
+	OperatorRoberts                     // 2x2 Roberts cross, finest but most noise sensitive
+	OperatorLoG                         // Laplacian of Gaussian zero crossings
+)
+
+// GrayMode selects how colour pixels are converted to grayscale before edge detection.
+type GrayMode int
+
+const (
+	GrayAverage GrayMode = iota // (r + g + b) / 3
+	GrayRec601                  // Rec. 601 luma, for SD-era scans and most JPEGs
+	GrayRec709                  // Rec. 709 luma, for sRGB and HD sources
+)
+
+// EdgeOptions configures EdgeDetectionWithOptions.
+type EdgeOptions struct {
+	Operator  EdgeOperator // Derivative operator
+	Gray      GrayMode     // Grayscale conversion
+	Threshold float64      // Normalised magnitudes below this value are cut to zero
+	LoGSigma  float64      // Standard deviation of the Laplacian of Gaussian
+	Scale     float64      // Edge strength mapped to 1 (0 uses the strongest edge of the image)
+	Border    BorderMode   // How pixels outside the image are read
+}
+
+// DefaultEdgeOptions returns the settings of EdgeDetectionConcurrent.
+func DefaultEdgeOptions() EdgeOptions {
+	return EdgeOptions{
+		Operator:  OperatorSobel,
+		Gray:      GrayAverage,
+		Threshold: 0.2,
+		LoGSigma:  1.4,
+	}
+}
+
+// ParseEdgeOperator converts a command line name (sobel, scharr, prewitt, roberts, log) into an EdgeOperator.
+func ParseEdgeOperator(name string) (EdgeOperator, error) {
+	switch name {
+	case "sobel":
+		return OperatorSobel, nil
+	case "scharr":
+		return OperatorScharr, nil
+	case "prewitt":
+		return OperatorPrewitt, nil
+	case "roberts":
+		return OperatorRoberts, nil
+	case "log":
+		return OperatorLoG, nil
+	}
+	return OperatorSobel, fmt.Errorf("unknown edge operator %q", name)
+}
+
+// ParseGrayMode converts a command line name (average, rec601, rec709) into a GrayMode.
+func ParseGrayMode(name string) (GrayMode, error) {
+	switch name {
+	case "average":
+		return GrayAverage, nil
+	case "rec601":
+		return GrayRec601, nil
+	case "rec709":
+		return GrayRec709, nil
+	}
+	return GrayAverage, fmt.Errorf("unknown grayscale mode %q", name)
+}
+
 // EdgeDetectionConcurrent performs Sobel edge detection on an image using concurrent processing.
-// It splits the image into chunks processed in parallel, computing gradient magnitudes for each pixel.
-func EdgeDetectionConcurrent(img image.Image, numWorkers int) [][]float64 {
-	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	edges := make([][]float64, height)
-	for i := range edges {
-		edges[i] = make([]float64, width)
+// The gradients are computed with the convolution engine, so border pixels are clamped
+// instead of being skipped. Magnitudes are normalised to [0, 1] and values
+// below 0.2 are cut to zero.
+func EdgeDetectionConcurrent(img image.Image, numWorkers int) *FloatMask {
+	return EdgeDetectionWithOptions(img, DefaultEdgeOptions(), numWorkers)
+}
+
+// EdgeDetectionWithOptions computes a normalised edge strength map with the chosen operator and
+// grayscale conversion. Gradient operators return the gradient magnitude; the Laplacian of
+// Gaussian returns the contrast across its zero crossings. A fixed Scale makes the map of a part
+// of a photo match the map of the whole photo, as the tiled pipeline needs.
+func EdgeDetectionWithOptions(img image.Image, opts EdgeOptions, numWorkers int) *FloatMask {
+	src := toFloatImage(img, numWorkers)
+	var edges *FloatMask
+	if opts.Scale > 0 {
+		edges = edgeMagnitude(src, opts, numWorkers)
+		scaleEdges(edges, opts.Scale, numWorkers)
+	} else {
+		edges = edgeStrength(src, opts, numWorkers)
 	}
 
-	// Sobel kernels for gradient computation
-	sobelX := [][]int{
-		{-1, 0, 1},
-		{-2, 0, 2},
-		{-1, 0, 1},
+	// Apply a threshold for edge detection
+	for i, v := range edges.Pix {
+		if float64(v) < opts.Threshold {
+			edges.Pix[i] = 0.0 // Discard weak gradients
+		}
 	}
-	sobelY := [][]int{
-		{-1, -2, -1},
-		{0, 0, 0},
-		{1, 2, 1},
+	return edges
+}
+
+// edgeStrength computes the edge strength of a working copy normalised to [0, 1], without cut-off.
+func edgeStrength(src *floatImage, opts EdgeOptions, numWorkers int) *FloatMask {
+	edges := edgeMagnitude(src, opts, numWorkers)
+	normalizeEdges(edges, numWorkers)
+	return edges
+}
+
+// edgeMagnitude computes the raw edge strength of a working copy, before normalisation.
+func edgeMagnitude(src *floatImage, opts EdgeOptions, numWorkers int) *FloatMask {
+	width, height := src.Width, src.Height
+	edges := NewFloatMask(width, height)
+
+	// Convert to grayscale and compute the edge strength
+	gray := grayPlane(src, opts.Gray, numWorkers)
+	if opts.Operator == OperatorLoG {
+		logZeroCrossings(gray, opts.LoGSigma, opts.Border, edges, numWorkers)
+	} else {
+		gx, gy := gradients(gray, opts.Operator, opts.Border, numWorkers)
+		parallelRows(height, numWorkers, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < width; x++ {
+					dx, dy := float64(gx.at(x, y)), float64(gy.at(x, y))
+					edges.Set(x, y, math.Sqrt(dx*dx+dy*dy))
+				}
+			}
+		})
 	}
+	return edges
+}
 
+// normalizeEdges divides an edge map by its maximum so that it spans [0, 1].
+func normalizeEdges(edges *FloatMask, numWorkers int) {
+	scaleEdges(edges, maxEdge(edges, numWorkers), numWorkers)
+}
+
+// maxEdge returns the highest value of an edge map.
+func maxEdge(edges *FloatMask, numWorkers int) float64 {
 	var maxGradient float64
 	maxGradientMutex := &sync.Mutex{} // Protects access to maxGradient
 
-	// Worker function to process a chunk of the image
-	processChunk := func(xStart, xEnd, yStart, yEnd int, wg *sync.WaitGroup) {
-		defer wg.Done()
-		for y := yStart; y < yEnd; y++ {
-			if y <= 0 || y >= height-1 {
-				continue // Skip edge rows to avoid out-of-bounds access
-			}
-			for x := xStart; x < xEnd; x++ {
-				if x <= 0 || x >= width-1 {
-					continue // Skip edge columns to avoid out-of-bounds access
-				}
-				var gx, gy float64
-				// Compute gradients using Sobel operator
-				for ky := -1; ky <= 1; ky++ {
-					for kx := -1; kx <= 1; kx++ {
-						px := img.At(x+kx, y+ky)
-						r, g, b, _ := px.RGBA()
-						gray := float64(r+g+b) / (3.0 * 256.0)	// Convert to grayscale
-						gx += gray * float64(sobelX[ky+1][kx+1])
-						gy += gray * float64(sobelY[ky+1][kx+1])
-					}
-				}
-				// Compute gradient magnitude
-				gradient := math.Sqrt(gx*gx + gy*gy)
-				edges[y][x] = gradient
-
-				// Safely update maxGradient to track the highest gradient value
-				maxGradientMutex.Lock()
-				if gradient > maxGradient {
-					maxGradient = gradient
-				}
-				maxGradientMutex.Unlock()
-			}
+	// Track the highest edge strength
+	parallelRows(edges.height, numWorkers, func(startY, endY int) {
+		localMax := 0.0
+		for _, v := range edges.Pix[startY*edges.width : endY*edges.width] {
+			localMax = math.Max(localMax, float64(v))
 		}
+		maxGradientMutex.Lock()
+		if localMax > maxGradient {
+			maxGradient = localMax
+		}
+		maxGradientMutex.Unlock()
+	})
+	return maxGradient
+}
+
+// scaleEdges divides an edge map by scale and clips it at 1, as a fixed scale may be below the
+// strongest edge. The map is left unchanged when scale is 0.
+func scaleEdges(edges *FloatMask, scale float64, numWorkers int) {
+	if scale == 0 {
+		return
+	}
+	parallelRows(edges.height, numWorkers, func(startY, endY int) {
+		row := edges.Pix[startY*edges.width : endY*edges.width]
+		for i := range row {
+			row[i] = float32(math.Min(1, float64(row[i])/scale)) // Normalize gradient values
+		}
+	})
+}
+
+// grayPlane converts a working copy to grayscale with the given conversion.
+func grayPlane(src *floatImage, mode GrayMode, numWorkers int) plane {
+	wr, wg, wb := float32(1.0/3), float32(1.0/3), float32(1.0/3)
+	switch mode {
+	case GrayRec601:
+		wr, wg, wb = 0.299, 0.587, 0.114
+	case GrayRec709:
+		wr, wg, wb = 0.2126, 0.7152, 0.0722
 	}
 
-	// Divide work into chunks and distribute to workers
-	chunkSize := int(math.Sqrt(float64((width * height) / numWorkers)))
-	wg := &sync.WaitGroup{}
-	for yStart := 0; yStart < height; yStart += chunkSize {
-		for xStart := 0; xStart < width; xStart += chunkSize {
-			xEnd := xStart + chunkSize
-			yEnd := yStart + chunkSize
-			if xEnd > width {
-				xEnd = width
-			}
-			if yEnd > height {
-				yEnd = height
+	gray := newPlane(src.Width, src.Height)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.Width; x++ {
+				o := src.offset(x, y)
+				gray.set(x, y, wr*src.Pix[o]+wg*src.Pix[o+1]+wb*src.Pix[o+2])
 			}
-			wg.Add(1)
-			go processChunk(xStart, xEnd, yStart, yEnd, wg)
 		}
+	})
+	return gray
+}
+
+// gradientKernels returns the horizontal and vertical kernels of a gradient operator.
+// The Roberts cross is padded to 3x3 so that it stays centred on the pixel.
+func gradientKernels(op EdgeOperator) (kx, ky Kernel) {
+	switch op {
+	case OperatorScharr:
+		kx = NewKernel([][]float64{
+			{-3, 0, 3},
+			{-10, 0, 10},
+			{-3, 0, 3},
+		})
+		ky = NewKernel([][]float64{
+			{-3, -10, -3},
+			{0, 0, 0},
+			{3, 10, 3},
+		})
+	case OperatorPrewitt:
+		kx = NewKernel([][]float64{
+			{-1, 0, 1},
+			{-1, 0, 1},
+			{-1, 0, 1},
+		})
+		ky = NewKernel([][]float64{
+			{-1, -1, -1},
+			{0, 0, 0},
+			{1, 1, 1},
+		})
+	case OperatorRoberts:
+		kx = NewKernel([][]float64{
+			{0, 0, 0},
+			{0, 1, 0},
+			{0, 0, -1},
+		})
+		ky = NewKernel([][]float64{
+			{0, 0, 0},
+			{0, 0, 1},
+			{0, -1, 0},
+		})
+	default:
+		// Sobel kernels for gradient computation
+		kx = NewKernel([][]float64{
+			{-1, 0, 1},
+			{-2, 0, 2},
+			{-1, 0, 1},
+		})
+		ky = NewKernel([][]float64{
+			{-1, -2, -1},
+			{0, 0, 0},
+			{1, 2, 1},
+		})
 	}
-	wg.Wait()
-
-	// Normalize the gradient values and apply a threshold for edge detection
-	threshold := 0.2
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			edges[y][x] /= maxGradient	// Normalize gradient values
-			if edges[y][x] < threshold {
-				edges[y][x] = 0.0	// Normalize gradient values
-			}
+	return kx, ky
+}
+
+// gradients computes the horizontal and vertical derivatives of a plane with a gradient operator.
+// The Laplacian of Gaussian has no directional derivatives, so Sobel is used in its place.
+func gradients(gray plane, op EdgeOperator, border BorderMode, numWorkers int) (gx, gy plane) {
+	kx, ky := gradientKernels(op)
+	gx, gy = newPlane(gray.width, gray.height), newPlane(gray.width, gray.height)
+	convolvePlane(gx, gray, kx, border, 0, numWorkers)
+	convolvePlane(gy, gray, ky, border, 0, numWorkers)
+	return gx, gy
+}
+
+// logKernel builds a zero-sum Laplacian of Gaussian kernel covering three standard deviations.
+func logKernel(sigma float64) Kernel {
+	radius := int(math.Ceil(3 * sigma))
+	size := 2*radius + 1
+	k := Kernel{Width: size, Height: size, Data: make([]float64, size*size)}
+	s2 := sigma * sigma
+	sum := 0.0
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			r2 := float64(x*x + y*y)
+			v := (r2 - 2*s2) / (s2 * s2) * math.Exp(-r2/(2*s2))
+			k.Data[(y+radius)*size+x+radius] = v
+			sum += v
 		}
 	}
 
-	return edges
+	// Remove the truncation error so flat areas give exactly zero
+	mean := sum / float64(size*size)
+	for i := range k.Data {
+		k.Data[i] -= mean
+	}
+	return k
 }
 
+// logZeroCrossings filters the plane with a Laplacian of Gaussian and marks its zero crossings.
+// The strength of a crossing is the absolute difference of the responses on either side.
+func logZeroCrossings(gray plane, sigma float64, border BorderMode, edges *FloatMask, numWorkers int) {
+	response := newPlane(gray.width, gray.height)
+	convolvePlane(response, gray, logKernel(sigma), border, 0, numWorkers)
 
+	parallelRows(gray.height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < gray.width; x++ {
+				v := response.at(x, y)
+				strength := 0.0
+				// Compare with the right, lower and diagonal neighbours
+				for _, d := range [][2]int{{1, 0}, {0, 1}, {1, 1}, {1, -1}} {
+					nx, ny := x+d[0], y+d[1]
+					if nx >= gray.width || ny < 0 || ny >= gray.height {
+						continue
+					}
+					n := response.at(nx, ny)
+					if (v < 0) != (n < 0) {
+						strength = math.Max(strength, math.Abs(float64(v-n)))
+					}
+				}
+				edges.Set(x, y, strength)
+			}
+		}
+	})
+}
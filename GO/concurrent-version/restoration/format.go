@@ -0,0 +1,195 @@
+package restoration
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+
+	// Decoders for LoadImage; JPEG and PNG are registered by the imports above
+	_ "golang.org/x/image/webp"
+)
+
+// Format is an image file format the restored photo can be written in.
+type Format int
+
+const (
+	FormatAuto Format = iota // Chosen from the file extension, JPEG when there is none
+	FormatJPEG               // Lossy, 8 bits per channel, no alpha
+	FormatPNG                // Lossless, keeps 16-bit samples and alpha
+	FormatTIFF               // Lossless (Deflate), keeps 16-bit samples and alpha
+	FormatBMP                // Uncompressed, 8 bits per channel
+)
+
+// errWebPOutput is returned for WebP output: WebP files can be read but not written.
+var errWebPOutput = errors.New("webp images can be read but not written")
+
+// ParseFormat converts a command line name (auto, jpeg, png, tiff, bmp) into a Format.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "auto":
+		return FormatAuto, nil
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "tiff", "tif":
+		return FormatTIFF, nil
+	case "bmp":
+		return FormatBMP, nil
+	case "webp":
+		return FormatAuto, errWebPOutput
+	}
+	return FormatAuto, fmt.Errorf("unknown image format %q", name)
+}
+
+// FormatFromPath returns the format matching the extension of a file name.
+// Files without an extension are written as JPEG; other extensions are an error, so that
+// a file never gets contents that do not match its name.
+func FormatFromPath(path string) (Format, error) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return FormatJPEG, nil
+	}
+	format, err := ParseFormat(ext)
+	if err == errWebPOutput {
+		return FormatAuto, err
+	}
+	if err != nil || format == FormatAuto {
+		return FormatAuto, fmt.Errorf("no image format for the extension of %q (use .jpg, .png, .tif or .bmp)", path)
+	}
+	return format, nil
+}
+
+// String returns the lower case name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatJPEG:
+		return "jpeg"
+	case FormatPNG:
+		return "png"
+	case FormatTIFF:
+		return "tiff"
+	case FormatBMP:
+		return "bmp"
+	}
+	return "auto"
+}
+
+// Extension returns the usual file extension of the format, with its dot.
+func (f Format) Extension() string {
+	switch f {
+	case FormatPNG:
+		return ".png"
+	case FormatTIFF:
+		return ".tiff"
+	case FormatBMP:
+		return ".bmp"
+	}
+	return ".jpg"
+}
+
+// EncodeOptions selects the output format and its settings.
+type EncodeOptions struct {
+	Format  Format // Output format; FormatAuto follows the file extension in SaveImageWithOptions
+	Quality int    // JPEG quality from 1 to 100 (0 means jpeg.DefaultQuality)
+
+	// JPEG and PNG only: metadata of the source photo copied into the output (nil for none),
+	// and a restoration history note appended as a comment (empty for none)
+	Metadata *Metadata
+	History  string
+}
+
+// DefaultEncodeOptions returns the format chosen by extension and the default JPEG quality.
+func DefaultEncodeOptions() EncodeOptions {
+	return EncodeOptions{
+		Format:  FormatAuto,
+		Quality: jpeg.DefaultQuality,
+	}
+}
+
+// EncodeImage writes an image to w in the format selected by opts.
+// FormatAuto writes JPEG, as there is no file name to take the format from.
+// The lossless formats keep the full precision of 16-bit results. Metadata and the history
+// note are written to JPEG segments or PNG chunks; TIFF and BMP output cannot carry them and
+// gives an error when they are set. In JPEG output, XMP packets larger than a segment are split
+// as ExtendedXMP, and other metadata too large for a segment gives an error.
+// The encoders read the image row by row, so a StoredImage is written without loading it
+// whole; TIFF output from one is written in strips, uncompressed when w cannot seek, and BMP
+// output is 24-bit without alpha, as for 16-bit images.
+func EncodeImage(w io.Writer, img image.Image, opts EncodeOptions) error {
+	switch opts.Format {
+	case FormatPNG:
+		if opts.Metadata.empty() && opts.History == "" {
+			return png.Encode(w, img)
+		}
+		chunks := pngMetadataChunks(opts.Metadata, opts.History)
+		return png.Encode(&insertWriter{w: w, at: pngHeaderEnd, insert: chunks}, img)
+	case FormatTIFF, FormatBMP:
+		if !opts.Metadata.empty() || opts.History != "" {
+			return fmt.Errorf("%v output cannot carry metadata or a history note", opts.Format)
+		}
+		if opts.Format == FormatBMP {
+			return bmp.Encode(w, img)
+		}
+		if stored, ok := img.(*StoredImage); ok {
+			return encodeStoredTIFF(w, stored)
+		}
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	}
+
+	quality := opts.Quality
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("jpeg quality %d is not between 1 and 100", quality)
+	}
+	if opts.Metadata.empty() && opts.History == "" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+
+	segments, err := metadataSegments(opts.Metadata, opts.History)
+	if err != nil {
+		return err
+	}
+	// After the start marker
+	return jpeg.Encode(&insertWriter{w: w, at: 2, insert: segments}, img, &jpeg.Options{Quality: quality})
+}
+
+// insertWriter passes what is written to it on to w and inserts extra bytes once the first at
+// bytes have gone through, so that EncodeImage can add metadata after the header of a JPEG or
+// PNG while the encoder streams the pixels instead of holding the whole file.
+type insertWriter struct {
+	w      io.Writer
+	at     int    // Bytes left to pass on before the insertion
+	insert []byte // Bytes to insert, nil once written
+}
+
+func (iw *insertWriter) Write(p []byte) (int, error) {
+	if iw.insert == nil {
+		return iw.w.Write(p)
+	}
+	if len(p) < iw.at {
+		n, err := iw.w.Write(p)
+		iw.at -= n
+		return n, err
+	}
+	n, err := iw.w.Write(p[:iw.at])
+	if err != nil {
+		return n, err
+	}
+	if _, err := iw.w.Write(iw.insert); err != nil {
+		return n, err
+	}
+	iw.insert = nil
+	m, err := iw.w.Write(p[n:])
+	return n + m, err
+}
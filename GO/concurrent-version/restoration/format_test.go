@@ -0,0 +1,331 @@
+package restoration
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exifSegment builds a little- or big-endian EXIF APP1 segment whose first IFD holds only
+// the orientation tag.
+func exifSegment(orientation int, order binary.ByteOrder) []byte {
+	var buf bytes.Buffer
+	buf.Write(exifHeader)
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	entry := make([]byte, 2+4+2+12+4)
+	order.PutUint16(entry, 42)
+	order.PutUint32(entry[2:], 8) // Offset of the first IFD
+	order.PutUint16(entry[6:], 1) // One entry
+	order.PutUint16(entry[8:], exifOrientationTag)
+	order.PutUint16(entry[10:], 3) // SHORT
+	order.PutUint32(entry[12:], 1)
+	order.PutUint16(entry[16:], uint16(orientation))
+	buf.Write(entry)
+	return buf.Bytes()
+}
+
+func TestFormatFromPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    Format
+		wantErr bool
+	}{
+		{"photo.jpg", FormatJPEG, false},
+		{"photo.JPEG", FormatJPEG, false},
+		{"photo.png", FormatPNG, false},
+		{"scan.tif", FormatTIFF, false},
+		{"scan.tiff", FormatTIFF, false},
+		{"photo.bmp", FormatBMP, false},
+		{"restored", FormatJPEG, false},
+		{"photo.webp", FormatAuto, true},
+		{"photo.gif", FormatAuto, true},
+		{"photo.jxl", FormatAuto, true},
+		{"photo.auto", FormatAuto, true},
+	}
+	for _, tt := range tests {
+		got, err := FormatFromPath(tt.path)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("FormatFromPath(%q) = %v, %v; want %v, error %v", tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	img16 := randomImage(23, 17, true, 2)
+	img8 := image.NewNRGBA(img16.Bounds())
+	smooth := image.NewNRGBA(img16.Bounds()) // JPEG is only close on smooth content
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 23; x++ {
+			c := img16.NRGBA64At(x, y)
+			img8.SetNRGBA(x, y, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 0xff})
+			smooth.SetNRGBA(x, y, color.NRGBA{uint8(40 + 4*x), uint8(60 + 5*y), 128, 0xff})
+		}
+	}
+
+	tests := []struct {
+		format    Format
+		img       image.Image
+		tolerance int // Largest difference per 16-bit channel
+	}{
+		{FormatPNG, img16, 0},
+		{FormatTIFF, img16, 0},
+		{FormatBMP, img8, 0},
+		{FormatJPEG, smooth, 0x1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := DefaultEncodeOptions()
+			opts.Format = tt.format
+			if err := EncodeImage(&buf, tt.img, opts); err != nil {
+				t.Fatal(err)
+			}
+			got, meta, err := DecodeImageWithMetadata(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Format != tt.format {
+				t.Errorf("decoded format %v, want %v", meta.Format, tt.format)
+			}
+			if got.Bounds() != tt.img.Bounds() {
+				t.Fatalf("bounds %v, want %v", got.Bounds(), tt.img.Bounds())
+			}
+			for y := 0; y < 17; y++ {
+				for x := 0; x < 23; x++ {
+					g := color.NRGBA64Model.Convert(got.At(x, y)).(color.NRGBA64)
+					w := color.NRGBA64Model.Convert(tt.img.At(x, y)).(color.NRGBA64)
+					if w.A == 0 {
+						if g.A != 0 {
+							t.Fatalf("pixel (%d, %d): alpha %#x, want 0", x, y, g.A)
+						}
+						continue
+					}
+					for _, d := range []int{int(g.R) - int(w.R), int(g.G) - int(w.G), int(g.B) - int(w.B), int(g.A) - int(w.A)} {
+						if d < -tt.tolerance || d > tt.tolerance {
+							t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeStoredImage(t *testing.T) {
+	// 40 rows make three strips of 16 in TIFF output
+	img16 := randomImage(23, 40, true, 6)
+	img8 := image.NewNRGBA(img16.Bounds())
+	opaque := image.NewNRGBA(img16.Bounds()) // BMP keeps the alpha of in-memory 8-bit images only
+	for i := range img8.Pix {
+		img8.Pix[i] = img16.Pix[2*i]
+		opaque.Pix[i] = img16.Pix[2*i] | uint8(i%4/3*0xff)
+	}
+	tiffFile, err := os.Create(filepath.Join(t.TempDir(), "photo.tiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiffFile.Close()
+
+	for _, tt := range []struct {
+		name   string
+		img    image.Image
+		model  color.Model
+		format Format
+		file   *os.File // Seekable output instead of a buffer
+	}{
+		{"16-bit png", img16, color.NRGBA64Model, FormatPNG, nil},
+		{"8-bit png", img8, color.NRGBAModel, FormatPNG, nil},
+		{"16-bit tiff", img16, color.NRGBA64Model, FormatTIFF, nil},
+		{"8-bit tiff", img8, color.NRGBAModel, FormatTIFF, nil},
+		{"compressed tiff", img16, color.NRGBA64Model, FormatTIFF, tiffFile},
+		{"bmp", opaque, color.NRGBAModel, FormatBMP, nil},
+		{"jpeg", opaque, color.NRGBAModel, FormatJPEG, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultEncodeOptions()
+			opts.Format = tt.format
+			var want bytes.Buffer
+			if err := EncodeImage(&want, tt.img, opts); err != nil {
+				t.Fatal(err)
+			}
+			wantImg, err := DecodeImage(&want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			stored := storedCopy(t, tt.img, tt.model)
+			if tt.file != nil {
+				if err := EncodeImage(tt.file, stored, opts); err != nil {
+					t.Fatal(err)
+				}
+				tt.file.Seek(0, io.SeekStart)
+				io.Copy(&got, tt.file)
+				if compression := bytes.Index(got.Bytes(), []byte{0x03, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08}); compression < 0 {
+					t.Error("seekable TIFF output is not Deflate-compressed")
+				}
+			} else if err := EncodeImage(&got, stored, opts); err != nil {
+				t.Fatal(err)
+			}
+			gotImg, err := DecodeImage(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameImages(t, gotImg, wantImg)
+		})
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	icc := bytes.Repeat([]byte("profile data "), 6000) // Larger than one APP2 segment
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+	source := &Metadata{Orientation: 1}
+	source.add(markerAPP1, exifSegment(6, binary.BigEndian))
+	source.add(markerAPP1, append(append([]byte(nil), xmpHeader...), xmp...))
+	source.addICCProfile(icc)
+	source.add(markerCOM, []byte("scanned 1998"))
+	img := randomImage(8, 8, false, 3)
+
+	for _, format := range []Format{FormatJPEG, FormatPNG} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := DefaultEncodeOptions()
+			opts.Format = format
+			opts.Metadata = source
+			opts.History = "Restored 2026-01-01"
+			if err := EncodeImage(&buf, img, opts); err != nil {
+				t.Fatal(err)
+			}
+			_, meta, err := DecodeImageWithMetadata(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if meta.Orientation != 1 {
+				t.Errorf("orientation %d, want 1 for the upright result", meta.Orientation)
+			}
+			if !bytes.Equal(meta.iccData(), icc) {
+				t.Errorf("ICC profile of %d bytes, want %d", len(meta.iccData()), len(icc))
+			}
+			var gotXMP bool
+			var comments []string
+			for _, s := range meta.segments {
+				switch {
+				case s.marker == markerAPP1 && bytes.HasPrefix(s.data, xmpHeader):
+					gotXMP = bytes.Equal(s.data[len(xmpHeader):], xmp)
+				case s.marker == markerAPP1 && bytes.HasPrefix(s.data, exifHeader):
+					if o, _ := exifOrientation(s.data); o != 1 {
+						t.Errorf("EXIF orientation %d, want 1", o)
+					}
+				case s.marker == markerCOM:
+					comments = append(comments, string(s.data))
+				}
+			}
+			if !gotXMP {
+				t.Error("XMP packet lost")
+			}
+			if len(comments) != 2 || comments[0] != "scanned 1998" || comments[1] != opts.History {
+				t.Errorf("comments %q, want the source comment and the history note", comments)
+			}
+		})
+	}
+
+	for _, format := range []Format{FormatTIFF, FormatBMP} {
+		opts := DefaultEncodeOptions()
+		opts.Format = format
+		opts.Metadata = source
+		if err := EncodeImage(&bytes.Buffer{}, img, opts); err == nil {
+			t.Errorf("%v: metadata silently dropped", format)
+		}
+	}
+}
+
+func TestEncodeLargeXMP(t *testing.T) {
+	// A packet with a thumbnail or edit history, as PNG, TIFF and WebP files carry in one piece
+	body := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:description>` +
+		strings.Repeat("faded print, ", 15000) + `</dc:description></rdf:Description></rdf:RDF></x:xmpmeta>`
+	packet := []byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" + body + "\n<?xpacket end=\"w\"?>")
+	source := &Metadata{Orientation: 1}
+	source.add(markerAPP1, append(append([]byte(nil), xmpHeader...), packet...))
+	img := randomImage(8, 8, false, 3)
+
+	encode := func(meta *Metadata, format Format) *Metadata {
+		t.Helper()
+		var buf bytes.Buffer
+		opts := DefaultEncodeOptions()
+		opts.Format = format
+		opts.Metadata = meta
+		if err := EncodeImage(&buf, img, opts); err != nil {
+			t.Fatal(err)
+		}
+		_, decoded, err := DecodeImageWithMetadata(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+
+	// The JPEG holds a standard packet naming the extension and the whole packet split over
+	// extension segments
+	jpegMeta := encode(source, FormatJPEG)
+	var standard []byte
+	var extension [][]byte
+	for _, s := range jpegMeta.segments {
+		switch {
+		case bytes.HasPrefix(s.data, xmpHeader):
+			standard = s.data[len(xmpHeader):]
+		case bytes.HasPrefix(s.data, xmpExtensionHeader):
+			extension = append(extension, s.data[len(xmpExtensionHeader):])
+		}
+	}
+	guid := fmt.Sprintf("%X", md5.Sum([]byte(body)))
+	if !bytes.Contains(standard, []byte(`xmpNote:HasExtendedXMP="`+guid+`"`)) {
+		t.Fatalf("standard packet %q does not name the extension %s", standard, guid)
+	}
+	if len(extension) < 2 {
+		t.Fatalf("%d extension segments, want the packet split", len(extension))
+	}
+	joined := make([]byte, len(body))
+	for _, part := range extension {
+		size, offset := binary.BigEndian.Uint32(part[32:]), binary.BigEndian.Uint32(part[36:])
+		if string(part[:32]) != guid || int(size) != len(body) {
+			t.Fatalf("extension segment for %s of %d bytes, want %s of %d", part[:32], size, guid, len(body))
+		}
+		copy(joined[offset:], part[40:])
+	}
+	if string(joined) != body {
+		t.Error("extension segments do not join into the packet")
+	}
+
+	// Copying the JPEG keeps the extension, and PNG output carries the packet whole
+	if again := encode(jpegMeta, FormatJPEG); len(again.segments) != len(jpegMeta.segments) {
+		t.Errorf("%d segments after copying the JPEG, want %d", len(again.segments), len(jpegMeta.segments))
+	}
+	pngMeta := encode(source, FormatPNG)
+	if len(pngMeta.segments) != 1 || !bytes.Equal(pngMeta.segments[0].data, source.segments[0].data) {
+		t.Error("PNG output changed the XMP packet")
+	}
+
+	// EXIF has no extension mechanism and cannot be cut
+	exif := &Metadata{Orientation: 1}
+	exif.add(markerAPP1, append(exifSegment(1, binary.BigEndian), make([]byte, 70000)...))
+	opts := DefaultEncodeOptions()
+	opts.Format = FormatJPEG
+	opts.Metadata = exif
+	if err := EncodeImage(&bytes.Buffer{}, img, opts); err == nil {
+		t.Error("oversized EXIF segment silently written")
+	}
+}
@@ -0,0 +1,118 @@
+package restoration
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// TIFF tags of the metadata that is kept
+const (
+	tiffXMPTag = 700
+	tiffICCTag = 34675
+)
+
+// readTIFFMetadata collects the ICC profile and the XMP packet stored in the first IFD of a TIFF
+// file. The orientation tag is not read, as the TIFF decoder returns the stored pixels of
+// scanners, which write upright images. A damaged file gives the metadata read so far.
+func readTIFFMetadata(data []byte) *Metadata {
+	meta := &Metadata{Orientation: 1}
+	if len(data) < 8 {
+		return meta
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return meta
+	}
+
+	ifd := int(order.Uint32(data[4:]))
+	if ifd < 8 || ifd+2 > len(data) {
+		return meta
+	}
+	count := int(order.Uint16(data[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(data) {
+			break
+		}
+		tag, kind := order.Uint16(data[entry:]), order.Uint16(data[entry+2:])
+		if tag != tiffXMPTag && tag != tiffICCTag || kind != 1 && kind != 7 { // BYTE or UNDEFINED
+			continue
+		}
+
+		// Values of more than four bytes are stored at an offset
+		size := int(order.Uint32(data[entry+4:]))
+		value := entry + 8
+		if size > 4 {
+			value = int(order.Uint32(data[entry+8:]))
+		}
+		if size < 0 || value < 0 || value+size > len(data) {
+			continue
+		}
+		payload := append([]byte(nil), data[value:value+size]...)
+		if tag == tiffICCTag {
+			meta.addICCProfile(payload)
+		} else {
+			meta.add(markerAPP1, append(append([]byte(nil), xmpHeader...), payload...))
+		}
+	}
+	return meta
+}
+
+// readWebPMetadata collects the ICCP, EXIF and XMP chunks of an extended WebP file.
+func readWebPMetadata(data []byte) *Metadata {
+	meta := &Metadata{Orientation: 1}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return meta
+	}
+
+	for pos := 12; pos+8 <= len(data); {
+		kind := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			break
+		}
+		chunk := data[pos+8 : pos+8+size]
+		pos += 8 + size + size%2 // Chunks are padded to an even size
+
+		switch kind {
+		case "ICCP":
+			meta.addICCProfile(chunk)
+		case "EXIF":
+			// Some writers keep the JPEG identifier
+			meta.add(markerAPP1, append(append([]byte(nil), exifHeader...), bytes.TrimPrefix(chunk, exifHeader)...))
+		case "XMP ":
+			meta.add(markerAPP1, append(append([]byte(nil), xmpHeader...), chunk...))
+		}
+	}
+	return meta
+}
+
+// bmpProfileEmbedded is the colour space type of a BMP with a V5 header that embeds an ICC profile.
+const bmpProfileEmbedded = "DEBM" // 'MBED' stored little-endian
+
+// readBMPMetadata reads the ICC profile embedded in a BMP with a V5 header.
+func readBMPMetadata(data []byte) *Metadata {
+	meta := &Metadata{Orientation: 1}
+
+	// File header, then the 124-byte V5 info header whose colour space type is at offset 56
+	// and profile offset and size at 112
+	const info = 14
+	if len(data) < info+124 || string(data[:2]) != "BM" || binary.LittleEndian.Uint32(data[info:]) < 124 {
+		return meta
+	}
+	if string(data[info+56:info+60]) != bmpProfileEmbedded {
+		return meta
+	}
+	offset := info + int(binary.LittleEndian.Uint32(data[info+112:]))
+	size := int(binary.LittleEndian.Uint32(data[info+116:]))
+	if offset < info || size <= 0 || offset+size > len(data) {
+		return meta
+	}
+	meta.addICCProfile(append([]byte(nil), data[offset:offset+size]...))
+	return meta
+}
@@ -0,0 +1,78 @@
+package restoration
+
+import (
+	"sync"
+)
+
+// maxHistogramBins is the number of histogram bins of 16-bit data, one per level.
+const maxHistogramBins = 65536
+
+// histogramBins picks the number of bins of a histogram over n samples: one per 16-bit level
+// for large scans, fewer for small images and tiles so that the bins are not mostly empty.
+// The result is a power of two between 256 and 65536.
+func histogramBins(n int) int {
+	bins := 256
+	for bins < maxHistogramBins && 4*bins <= n {
+		bins *= 2
+	}
+	return bins
+}
+
+// binOf returns the bin of a [0, 1] sample in a histogram with the given number of bins.
+// Bin i holds the samples closest to i / (bins - 1), so a table indexed by bin can be read
+// back with lookup.
+func binOf(v float32, bins int) int {
+	return int(clamp01(v)*float32(bins-1) + 0.5)
+}
+
+// channelHistogram counts the samples of one channel of a working copy, reading rows in parallel.
+// Fully transparent pixels are not counted.
+func channelHistogram(src *floatImage, c, bins int, numWorkers int) []int {
+	hist := make([]int, bins)
+	var mu sync.Mutex
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		local := make([]int, bins)
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			if !src.transparent(i) {
+				local[binOf(src.Pix[i+c], bins)]++
+			}
+		}
+
+		// Merge the local histogram into the shared one
+		mu.Lock()
+		for i, count := range local {
+			hist[i] += count
+		}
+		mu.Unlock()
+	})
+	return hist
+}
+
+// rgbHistograms counts the samples of the R, G and B channels of a working copy.
+func rgbHistograms(src *floatImage, bins int, numWorkers int) [3][]int {
+	var hists [3][]int
+	for c := range hists {
+		hists[c] = channelHistogram(src, c, bins, numWorkers)
+	}
+	return hists
+}
+
+// addCounts adds the counts of a histogram to those of dst, allocating dst on first use.
+func addCounts(dst, hist []int) []int {
+	if dst == nil {
+		dst = make([]int, len(hist))
+	}
+	for i, count := range hist {
+		dst[i] += count
+	}
+	return dst
+}
+
+// histogramTotal returns the number of samples counted in a histogram.
+func histogramTotal(hist []int) int {
+	total := 0
+	for _, count := range hist {
+		total += count
+	}
+	return total
+}
@@ -0,0 +1,411 @@
+package restoration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"unicode/utf16"
+)
+
+// profileLUTSize is the number of entries of the tone curve tables of a colour profile,
+// one per 16-bit level so that deep shadows keep their precision.
+const profileLUTSize = 65536
+
+// srgbToXYZD50 converts linear sRGB to CIE XYZ adapted to D50 (Bradford), the connection
+// space of ICC profiles.
+var srgbToXYZD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// OutputProfile selects the colour profile of the restored image when the input had one.
+type OutputProfile int
+
+const (
+	OutputProfileSource OutputProfile = iota // Convert back to the profile of the input
+	OutputProfileSRGB                        // Convert to sRGB, for viewers without colour management
+)
+
+// ParseOutputProfile converts a command line name (source, srgb) into an OutputProfile.
+func ParseOutputProfile(name string) (OutputProfile, error) {
+	switch name {
+	case "source":
+		return OutputProfileSource, nil
+	case "srgb":
+		return OutputProfileSRGB, nil
+	}
+	return OutputProfileSource, fmt.Errorf("unknown output profile %q", name)
+}
+
+// ICCProfile is an RGB matrix/TRC colour profile, such as Adobe RGB, ProPhoto RGB or the sRGB
+// profiles embedded by scanners: three tone reproduction curves followed by a matrix to CIE XYZ.
+// Profiles built from lookup tables are not supported.
+type ICCProfile struct {
+	Description string // Name of the profile
+
+	matrix [3][3]float64            // Linear RGB to D50 XYZ; the columns are the colorants
+	curves [3]func(float64) float64 // Encoded to linear, per channel
+}
+
+// ParseICCProfile reads a matrix/TRC RGB profile from the bytes of an ICC file.
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("unsupported ICC profile: %q data with %q connection space", data[16:20], data[20:24])
+	}
+
+	// Tag table
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(data) {
+			return nil, errors.New("truncated ICC tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 8 || offset+size > len(data) {
+			return nil, errors.New("ICC tag outside the profile")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	profile := &ICCProfile{Description: profileDescription(tags["desc"])}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, err := parseXYZ(tags[name+"XYZ"])
+		if err != nil {
+			return nil, fmt.Errorf("%sXYZ: %w", name, err)
+		}
+		for i := range xyz {
+			profile.matrix[i][c] = xyz[i]
+		}
+		profile.curves[c], err = parseTRC(tags[name+"TRC"])
+		if err != nil {
+			return nil, fmt.Errorf("%sTRC: %w", name, err)
+		}
+	}
+	return profile, nil
+}
+
+// s15Fixed16 reads a signed 15.16 fixed point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseXYZ reads an XYZ tag.
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("missing or not an XYZ tag (only matrix/TRC profiles are supported)")
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// parseTRC reads a tone reproduction curve, either sampled (curv) or parametric (para).
+func parseTRC(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("missing tone curve (only matrix/TRC profiles are supported)")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, errors.New("truncated curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256 // u8Fixed8
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float32, n)
+		for i := range table {
+			table[i] = float32(binary.BigEndian.Uint16(tag[12+2*i:])) / 0xffff
+		}
+		return func(v float64) float64 { return float64(lookup(table, float32(v))) }, nil
+
+	case "para":
+		counts := []int{1, 3, 4, 5, 7}
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return nil, errors.New("unsupported parametric curve")
+		}
+		// Parameters g, a, b, c, d, e, f; unused ones describe the identity around the power law
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < counts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch kind {
+		case 1: // Y = (aX+b)^g for X >= -b/a, 0 below
+			d = -b / a
+		case 2: // Y = (aX+b)^g + c for X >= -b/a, c below
+			d, e, f = -b/a, c, c
+			c = 0
+		case 3: // Y = (aX+b)^g for X >= d, cX below
+		case 4: // Y = (aX+b)^g + e for X >= d, cX + f below
+		}
+		return func(v float64) float64 {
+			if v < d {
+				return c*v + f
+			}
+			return math.Pow(math.Max(0, a*v+b), g) + e
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported tone curve type %q", tag[:4])
+}
+
+// profileDescription reads the profile name from a v2 (desc) or v4 (mluc) description tag.
+func profileDescription(tag []byte) string {
+	switch {
+	case len(tag) >= 12 && string(tag[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			n = len(tag) - 12
+		}
+		return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+
+	case len(tag) >= 28 && string(tag[:4]) == "mluc":
+		// First record: language, country, length and offset of a UTF-16 string
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
+
+// iccSegmentSize is the largest part of an ICC profile an APP2 segment holds, after the
+// identifier and the chunk numbers.
+const iccSegmentSize = 0xffff - 2 - 14
+
+// ICCProfile returns the colour profile embedded in the source photo, or nil when there is none.
+func (m *Metadata) ICCProfile() (*ICCProfile, error) {
+	data := m.iccData()
+	if data == nil {
+		return nil, nil
+	}
+	return ParseICCProfile(data)
+}
+
+// iccData returns the embedded ICC profile reassembled from its APP2 segments, or nil.
+func (m *Metadata) iccData() []byte {
+	if m == nil {
+		return nil
+	}
+
+	// Profiles larger than a segment are split in chunks numbered from 1
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	for _, s := range m.segments {
+		if s.marker == markerAPP2 && bytes.HasPrefix(s.data, iccHeader) && len(s.data) >= len(iccHeader)+2 {
+			chunks = append(chunks, chunk{seq: s.data[len(iccHeader)], data: s.data[len(iccHeader)+2:]})
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+
+	var data []byte
+	for _, c := range chunks {
+		data = append(data, c.data...)
+	}
+	return data
+}
+
+// addICCProfile stores an ICC profile read from another format as numbered APP2 segments.
+func (m *Metadata) addICCProfile(data []byte) {
+	count := (len(data) + iccSegmentSize - 1) / iccSegmentSize
+	if count == 0 || count > 0xff {
+		return
+	}
+	for i := 0; i < count; i++ {
+		part := data[i*iccSegmentSize : min((i+1)*iccSegmentSize, len(data))]
+		segment := append(append([]byte(nil), iccHeader...), byte(i+1), byte(count))
+		m.add(markerAPP2, append(segment, part...))
+	}
+}
+
+// WithoutICCProfile returns a copy of the metadata without the ICC profile segments, for
+// images converted to sRGB.
+func (m *Metadata) WithoutICCProfile() *Metadata {
+	if m == nil {
+		return nil
+	}
+	stripped := &Metadata{Format: m.Format, Orientation: m.Orientation}
+	for _, s := range m.segments {
+		if s.marker != markerAPP2 {
+			stripped.segments = append(stripped.segments, s)
+		}
+	}
+	return stripped
+}
+
+// workingToXYZD50 converts the linear working space to CIE XYZ adapted to D50 (Bradford).
+var workingToXYZD50 = mulMatrix(bradfordD65ToD50, workingSpace.toXYZ)
+
+// bradfordD65ToD50 adapts CIE XYZ from a D65 to a D50 white.
+var bradfordD65ToD50 = [3][3]float64{
+	{1.0478112, 0.0228866, -0.0501270},
+	{0.0295424, 0.9904844, -0.0170491},
+	{-0.0092345, 0.0150436, 0.7521316},
+}
+
+// srgbProfile is the sRGB colour profile, for untagged images taken into the working space.
+var srgbProfile = &ICCProfile{
+	Description: "sRGB",
+	matrix:      srgbToXYZD50,
+	curves:      [3]func(float64) float64{srgbToLinear, srgbToLinear, srgbToLinear},
+}
+
+// ProfileToWorkingConcurrent converts an image encoded in a colour profile to the working space
+// of the pipeline: linear light with the Rec. 2020 primaries and D65 white, which hold sRGB and
+// Adobe RGB entirely. The tone curves of the profile are undone and the colours are taken through
+// CIE XYZ to the working primaries; colours beyond them, which only profiles with imaginary
+// primaries such as ProPhoto RGB can describe, are clipped channel by channel. The linear values
+// are stored with the sRGB curve, so that the stages tuned for encoded values see the tones of an
+// untagged photo; the colour stages remove the curve before applying the Rec. 2020 matrices.
+func ProfileToWorkingConcurrent(img image.Image, profile *ICCProfile, numWorkers int) *image.NRGBA64 {
+	var decode, encode [3][]float32
+	_, toSRGBCurve := srgbLUTs()
+	for c := range decode {
+		decode[c] = curveLUT(profile.curves[c])
+		encode[c] = toSRGBCurve
+	}
+	toWorking := mulMatrix(invertMatrix(workingToXYZD50), profile.matrix)
+	return convertPrimaries(toFloatImage(img, numWorkers), decode, toWorking, encode, numWorkers).toNRGBA64(numWorkers)
+}
+
+// ProfileFromWorkingConcurrent converts an image from the working space back to the profile of
+// the source, or to sRGB. Colours outside the gamut of the target are clipped.
+func ProfileFromWorkingConcurrent(img image.Image, profile *ICCProfile, target OutputProfile, numWorkers int) *image.NRGBA64 {
+	if target == OutputProfileSRGB {
+		profile = srgbProfile
+	}
+	var decode, encode [3][]float32
+	toLinear, _ := srgbLUTs()
+	for c := range encode {
+		decode[c] = toLinear
+		encode[c] = invertCurve(profile.curves[c])
+	}
+	fromWorking := mulMatrix(invertMatrix(profile.matrix), workingToXYZD50)
+	return convertPrimaries(toFloatImage(img, numWorkers), decode, fromWorking, encode, numWorkers).toNRGBA64(numWorkers)
+}
+
+// convertPrimaries decodes the R, G and B channels of a working copy to linear light through
+// per-channel tables, converts them with a matrix, clips them to [0, 1] and encodes them again.
+func convertPrimaries(src *floatImage, decode [3][]float32, m [3][3]float64, encode [3][]float32, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			var linear [3]float64
+			for c := range linear {
+				linear[c] = float64(lookup(decode[c], src.Pix[i+c]))
+			}
+			for c := 0; c < 3; c++ {
+				v := m[c][0]*linear[0] + m[c][1]*linear[1] + m[c][2]*linear[2]
+				dst.Pix[i+c] = lookup(encode[c], clamp01(float32(v)))
+			}
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst
+}
+
+// applyLUTs reads the R, G and B channels of a working copy through per-channel lookup tables.
+func applyLUTs(src *floatImage, luts [3][]float32, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = lookup(luts[c], src.Pix[i+c])
+			}
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst
+}
+
+// curveLUT samples a function on [0, 1] into a lookup table.
+func curveLUT(f func(float64) float64) []float32 {
+	lut := make([]float32, profileLUTSize)
+	for i := range lut {
+		lut[i] = float32(f(float64(i) / (profileLUTSize - 1)))
+	}
+	return lut
+}
+
+// invertCurve tabulates the inverse of a non-decreasing function on [0, 1]: every entry is found
+// by bisection in the sampled function and interpolated between samples.
+func invertCurve(f func(float64) float64) []float32 {
+	forward := curveLUT(f)
+	inverse := make([]float32, profileLUTSize)
+	for j := range inverse {
+		y := float32(j) / (profileLUTSize - 1)
+		i := sort.Search(len(forward), func(k int) bool { return forward[k] >= y })
+		switch {
+		case i == 0:
+			inverse[j] = 0
+		case i == len(forward):
+			inverse[j] = 1
+		default:
+			lo, hi := forward[i-1], forward[i]
+			frac := float32(0)
+			if hi > lo {
+				frac = (y - lo) / (hi - lo)
+			}
+			inverse[j] = (float32(i-1) + frac) / (profileLUTSize - 1)
+		}
+	}
+	return inverse
+}
+
+// mulMatrix returns the product a * b of two 3x3 matrices.
+func mulMatrix(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// invertMatrix returns the inverse of a 3x3 matrix, using cofactors.
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i], with the sign folded into the cyclic indices
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = m[a][c]*m[b][d] - m[a][d]*m[b][c]
+		}
+	}
+	det := m[0][0]*inv[0][0] + m[0][1]*inv[1][0] + m[0][2]*inv[2][0]
+	for i := range inv {
+		for j := range inv[i] {
+			inv[i][j] /= det
+		}
+	}
+	return inv
+}
@@ -0,0 +1,303 @@
+package restoration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// adobeRGBMatrix holds the D50 colorants of Adobe RGB (1998), as in its ICC profile.
+var adobeRGBMatrix = [3][3]float64{
+	{0.6097, 0.2053, 0.1492},
+	{0.3111, 0.6257, 0.0632},
+	{0.0195, 0.0609, 0.7446},
+}
+
+// iccProfileBytes builds a matrix/TRC ICC profile with the given colorants and a tone curve tag,
+// shared by the three channels.
+func iccProfileBytes(description string, matrix [3][3]float64, trc []byte) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+	}
+	desc := append([]byte("desc\x00\x00\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(description)+1))...)
+	desc = append(append(desc, description...), 0)
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{{"desc", desc}}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for i := 0; i < 3; i++ {
+			xyz = append(xyz, fixed(matrix[i][c])...)
+		}
+		tags = append(tags, tag{name + "XYZ", xyz}, tag{name + "TRC", trc})
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB XYZ ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var body []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		body = append(body, t.data...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	data := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+// gammaCurve builds a curv tag holding a single gamma.
+func gammaCurve(gamma float64) []byte {
+	return binary.BigEndian.AppendUint16([]byte("curv\x00\x00\x00\x00\x00\x00\x00\x01"), uint16(math.Round(gamma*256)))
+}
+
+func TestParseICCProfile(t *testing.T) {
+	data := iccProfileBytes("Adobe RGB (1998)", adobeRGBMatrix, gammaCurve(563.0/256))
+	profile, err := ParseICCProfile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Description != "Adobe RGB (1998)" {
+		t.Errorf("description %q", profile.Description)
+	}
+	for i := range adobeRGBMatrix {
+		for j := range adobeRGBMatrix[i] {
+			if d := profile.matrix[i][j] - adobeRGBMatrix[i][j]; math.Abs(d) > 1e-4 {
+				t.Errorf("matrix[%d][%d] = %v, want %v", i, j, profile.matrix[i][j], adobeRGBMatrix[i][j])
+			}
+		}
+	}
+	if got, want := profile.curves[1](0.5), math.Pow(0.5, 563.0/256); math.Abs(got-want) > 1e-9 {
+		t.Errorf("tone curve at 0.5 = %v, want %v", got, want)
+	}
+
+	for _, bad := range [][]byte{nil, data[:100], bytes.Replace(data, []byte("acsp"), []byte("xxxx"), 1)} {
+		if _, err := ParseICCProfile(bad); err == nil {
+			t.Errorf("%d bytes without a valid header parsed", len(bad))
+		}
+	}
+}
+
+func TestParseTRC(t *testing.T) {
+	param := func(kind uint16, params ...float64) []byte {
+		tag := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), kind)
+		tag = append(tag, 0, 0)
+		for _, p := range params {
+			tag = binary.BigEndian.AppendUint32(tag, uint32(int32(math.Round(p*65536))))
+		}
+		return tag
+	}
+	table := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03")
+	for _, v := range []uint16{0, 0x4000, 0xffff} {
+		table = binary.BigEndian.AppendUint16(table, v)
+	}
+
+	tests := []struct {
+		name string
+		tag  []byte
+		in   []float64
+		want []float64
+	}{
+		{"identity", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), []float64{0, 0.3, 1}, []float64{0, 0.3, 1}},
+		{"gamma", gammaCurve(2), []float64{0, 0.5, 1}, []float64{0, 0.25, 1}},
+		{"table", table, []float64{0, 0.25, 0.5, 1}, []float64{0, 0.125, 0x4000 / 65535.0, 1}},
+		{"sRGB", param(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045), []float64{0, 0.02, 0.5, 1}, []float64{0, srgbToLinear(0.02), srgbToLinear(0.5), 1}},
+	}
+	for _, tt := range tests {
+		curve, err := parseTRC(tt.tag)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, in := range tt.in {
+			if got := curve(in); math.Abs(got-tt.want[i]) > 1e-4 {
+				t.Errorf("%s: curve(%v) = %v, want %v", tt.name, in, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	adobe, err := ParseICCProfile(iccProfileBytes("Adobe RGB (1998)", adobeRGBMatrix, gammaCurve(563.0/256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := randomImage(32, 16, true, 5)
+
+	for _, profile := range []*ICCProfile{adobe, srgbProfile} {
+		working := ProfileToWorkingConcurrent(img, profile, 3)
+		back := ProfileFromWorkingConcurrent(working, profile, OutputProfileSource, 3)
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 32; x++ {
+				g, w := back.NRGBA64At(x, y), img.NRGBA64At(x, y)
+				if g.A != w.A {
+					t.Fatalf("%s: pixel (%d, %d) alpha %#x, want %#x", profile.Description, x, y, g.A, w.A)
+				}
+				// Compared in linear light, as the inverse of a gamma curve is steep near black
+				for c, v := range [][2]uint16{{g.R, w.R}, {g.G, w.G}, {g.B, w.B}} {
+					curve := profile.curves[c]
+					if d := curve(float64(v[0])/0xffff) - curve(float64(v[1])/0xffff); math.Abs(d) > 1e-4 {
+						t.Fatalf("%s: pixel (%d, %d) = %v, want %v", profile.Description, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWorkingSpaceColours(t *testing.T) {
+	adobe, err := ParseICCProfile(iccProfileBytes("Adobe RGB (1998)", adobeRGBMatrix, gammaCurve(563.0/256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The D65 white of the working space, from the D50 connection space
+	toD65 := invertMatrix(bradfordD65ToD50)
+
+	tests := []struct {
+		name    string
+		profile *ICCProfile
+		rgb     [3]float64
+	}{
+		{"sRGB gray", srgbProfile, [3]float64{0.5, 0.5, 0.5}},
+		{"sRGB red", srgbProfile, [3]float64{1, 0, 0}},
+		{"sRGB skin", srgbProfile, [3]float64{0.85, 0.65, 0.55}},
+		{"Adobe RGB green", adobe, [3]float64{0, 1, 0}},
+		{"Adobe RGB sky", adobe, [3]float64{0.35, 0.55, 0.85}},
+	}
+	for _, tt := range tests {
+		img := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+		img.SetNRGBA64(0, 0, color.NRGBA64{uint16(tt.rgb[0] * 0xffff), uint16(tt.rgb[1] * 0xffff), uint16(tt.rgb[2] * 0xffff), 0xffff})
+		c := ProfileToWorkingConcurrent(img, tt.profile, 1).NRGBA64At(0, 0)
+		l, a, b := workingSpace.toLab(float64(c.R)/0xffff, float64(c.G)/0xffff, float64(c.B)/0xffff)
+
+		// Expected L*a*b* straight from the colorants of the profile
+		var linear, d50, d65 [3]float64
+		for i := range linear {
+			linear[i] = tt.profile.curves[i](float64(uint16(tt.rgb[i]*0xffff)) / 0xffff)
+		}
+		for i := range d50 {
+			d50[i] = tt.profile.matrix[i][0]*linear[0] + tt.profile.matrix[i][1]*linear[1] + tt.profile.matrix[i][2]*linear[2]
+		}
+		for i := range d65 {
+			d65[i] = (toD65[i][0]*d50[0] + toD65[i][1]*d50[1] + toD65[i][2]*d50[2]) / workingSpace.white[i]
+		}
+		fx, fy, fz := labF(d65[0]), labF(d65[1]), labF(d65[2])
+		wantL, wantA, wantB := 116*fy-16, 500*(fx-fy), 200*(fy-fz)
+
+		if math.Abs(l-wantL) > 0.5 || math.Abs(a-wantA) > 0.5 || math.Abs(b-wantB) > 0.5 {
+			t.Errorf("%s: L*a*b* (%.1f, %.1f, %.1f), want (%.1f, %.1f, %.1f)", tt.name, l, a, b, wantL, wantA, wantB)
+		}
+		if tt.profile == srgbProfile {
+			// The working space agrees with the sRGB conversions of untagged photos
+			sl, sa, sb := RGBToLab(tt.rgb[0], tt.rgb[1], tt.rgb[2])
+			if math.Abs(l-sl) > 0.5 || math.Abs(a-sa) > 0.5 || math.Abs(b-sb) > 0.5 {
+				t.Errorf("%s: L*a*b* (%.1f, %.1f, %.1f), sRGB gives (%.1f, %.1f, %.1f)", tt.name, l, a, b, sl, sa, sb)
+			}
+		}
+	}
+}
+
+func TestYCbCrRoundTrip(t *testing.T) {
+	for _, space := range []*rgbSpace{srgbSpace, workingSpace} {
+		for _, rgb := range [][3]float64{{0, 0, 0}, {1, 1, 1}, {0.2, 0.7, 0.4}, {1, 0, 0.5}} {
+			y, cb, cr := space.toYCbCr(rgb[0], rgb[1], rgb[2])
+			if rgb[0] == rgb[1] && rgb[1] == rgb[2] && (math.Abs(cb) > 1e-9 || math.Abs(cr) > 1e-9 || math.Abs(y-rgb[0]) > 1e-9) {
+				t.Errorf("gray %v has chroma (%v, %v) or luma %v", rgb, cb, cr, y)
+			}
+			r, g, b := space.fromYCbCr(y, cb, cr)
+			if math.Abs(r-rgb[0]) > 1e-9 || math.Abs(g-rgb[1]) > 1e-9 || math.Abs(b-rgb[2]) > 1e-9 {
+				t.Errorf("YCbCr round trip of %v gives (%v, %v, %v)", rgb, r, g, b)
+			}
+		}
+	}
+}
+
+func TestReadEmbeddedProfile(t *testing.T) {
+	icc := iccProfileBytes("Scanner RGB", adobeRGBMatrix, gammaCurve(1.8))
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+
+	// Little-endian TIFF whose only IFD holds the ICC and XMP tags, stored at an offset
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	values := 8 + 2 + 2*12 + 4
+	for _, e := range []struct {
+		tag  uint16
+		data []byte
+	}{{tiffICCTag, icc}, {tiffXMPTag, xmp}} {
+		tiff = binary.LittleEndian.AppendUint16(tiff, e.tag)
+		tiff = binary.LittleEndian.AppendUint16(tiff, 7)
+		tiff = binary.LittleEndian.AppendUint32(tiff, uint32(len(e.data)))
+		tiff = binary.LittleEndian.AppendUint32(tiff, uint32(values))
+		values += len(e.data)
+	}
+	tiff = append(binary.LittleEndian.AppendUint32(tiff, 0), append(append([]byte(nil), icc...), xmp...)...)
+
+	// WebP with an odd-sized ICCP chunk, padded, followed by an XMP chunk
+	webp := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range []struct {
+		kind string
+		data []byte
+	}{{"ICCP", append(append([]byte(nil), icc...), 0x7f)}, {"XMP ", xmp}} {
+		webp = append(webp, c.kind...)
+		webp = binary.LittleEndian.AppendUint32(webp, uint32(len(c.data)))
+		webp = append(webp, c.data...)
+		if len(c.data)%2 == 1 {
+			webp = append(webp, 0)
+		}
+	}
+
+	// BMP file header and a V5 info header with the profile right after it
+	bmp := make([]byte, 14+124)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[14:], 124)
+	copy(bmp[14+56:], bmpProfileEmbedded)
+	binary.LittleEndian.PutUint32(bmp[14+112:], 124)
+	binary.LittleEndian.PutUint32(bmp[14+116:], uint32(len(icc)))
+	bmp = append(bmp, icc...)
+
+	tests := []struct {
+		name    string
+		read    func([]byte) *Metadata
+		data    []byte
+		wantICC []byte
+		wantXMP bool
+	}{
+		{"TIFF", readTIFFMetadata, tiff, icc, true},
+		{"WebP", readWebPMetadata, webp, append(append([]byte(nil), icc...), 0x7f), true},
+		{"BMP", readBMPMetadata, bmp, icc, false},
+		{"truncated TIFF", readTIFFMetadata, tiff[:40], nil, false},
+		{"not a BMP", readBMPMetadata, append([]byte("XX"), bmp[2:]...), nil, false},
+	}
+	for _, tt := range tests {
+		meta := tt.read(tt.data)
+		if !bytes.Equal(meta.iccData(), tt.wantICC) {
+			t.Errorf("%s: ICC profile of %d bytes, want %d", tt.name, len(meta.iccData()), len(tt.wantICC))
+		}
+		var gotXMP bool
+		for _, s := range meta.segments {
+			if s.marker == markerAPP1 && bytes.Equal(s.data, append(append([]byte(nil), xmpHeader...), xmp...)) {
+				gotXMP = true
+			}
+		}
+		if gotXMP != tt.wantXMP {
+			t.Errorf("%s: XMP read %v, want %v", tt.name, gotXMP, tt.wantXMP)
+		}
+		if tt.wantICC != nil {
+			if profile, err := meta.ICCProfile(); err != nil || profile.Description != "Scanner RGB" {
+				t.Errorf("%s: profile %v, %v", tt.name, profile, err)
+			}
+		}
+	}
+}
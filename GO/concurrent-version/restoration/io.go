@@ -2,31 +2,53 @@ package restoration
 
 import (
     "image"
-    "image/jpeg"
+    "io"
     "os"
 )
 
 // LoadImage loads an image from the specified file path.
 // It opens the file, decodes the image, and returns an image.Image object.
+// JPEG, PNG, TIFF, BMP and WebP files are recognised from their contents, and JPEG photos
+// are turned upright according to their EXIF orientation.
 func LoadImage(imagePath string) (image.Image, error) {
-    file, err := os.Open(imagePath)
-    if err != nil {
-        return nil, err // Return error if file cannot be opened
-    }
-    defer file.Close()  // Ensure the file is closed after function execution
+    img, _, err := LoadImageWithMetadata(imagePath)
+    return img, err
+}
 
-    img, _, err := image.Decode(file)   // Decode the image from file
+// DecodeImage decodes an image from a stream, such as an upload held in memory.
+// The format and orientation are handled as in LoadImage.
+func DecodeImage(r io.Reader) (image.Image, error) {
+    img, _, err := DecodeImageWithMetadata(r)
     return img, err
 }
 
-// SaveImage saves an image to the specified file path in JPEG format.
-// It creates a new file, encodes the image into JPEG format, and writes it to disk.
+// SaveImage saves an image to the specified file path, in the format matching its extension
+// (.jpg, .png, .tif/.tiff or .bmp; JPEG when there is none), without metadata.
+// Other extensions are an error.
 func SaveImage(img image.Image, outputPath string) error {
+    return SaveImageWithOptions(img, outputPath, DefaultEncodeOptions())
+}
+
+// SaveImageWithOptions saves an image to the specified file path with explicit encoding options.
+// With FormatAuto the format is taken from the file extension.
+func SaveImageWithOptions(img image.Image, outputPath string, opts EncodeOptions) error {
+    if opts.Format == FormatAuto {
+        format, err := FormatFromPath(outputPath)
+        if err != nil {
+            return err
+        }
+        opts.Format = format
+    }
+
     file, err := os.Create(outputPath)
     if err != nil {
         return err  // Return error if file cannot be created
     }
     defer file.Close()  // Ensure the file is closed after function execution
 
-    return jpeg.Encode(file, img, nil)  // Encode and save the image in JPEG format
+    err = EncodeImage(file, img, opts)  // Encode and save the image in the selected format
+    if err != nil {
+        return err
+    }
+    return file.Close()
 }
@@ -0,0 +1,229 @@
+package restoration
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"os"
+	"sort"
+)
+
+// lutSize is the number of entries of the tone lookup tables; samples between entries are interpolated.
+const lutSize = 1024
+
+// CurvePoint is a control point of a tone curve, on the 0-255 scale.
+type CurvePoint struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// ToneCurve maps input tones to output tones through a monotone cubic spline passing through its
+// control points. Tones outside the first and last points keep the value of the nearest point.
+// A curve with fewer than two points is the identity.
+type ToneCurve []CurvePoint
+
+// Curves holds the tone curves of a levels recipe.
+type Curves struct {
+	Master ToneCurve `json:"master"` // Applied to R, G and B after the channel curves
+	Red    ToneCurve `json:"red"`
+	Green  ToneCurve `json:"green"`
+	Blue   ToneCurve `json:"blue"`
+}
+
+// LevelsOptions configures the levels and curves stage. The zero value of every field is a no-op,
+// so a recipe only needs to list what it changes.
+type LevelsOptions struct {
+	Auto  bool       `json:"auto"`  // Detect the black and white point of every channel from its histogram
+	Clip  float64    `json:"clip"`  // Fraction of pixels clipped at each end by the automatic detection
+	Black [3]float64 `json:"black"` // Manual R, G, B black points on the 0-255 scale, used when Auto is off
+	White [3]float64 `json:"white"` // Manual R, G, B white points (0 means 255), used when Auto is off
+	Gamma [3]float64 `json:"gamma"` // R, G, B gamma applied after the levels (0 means 1, above 1 brightens midtones)
+
+	Curves Curves `json:"curves"` // Tone curves applied last
+}
+
+// DefaultLevelsOptions returns automatic levels clipping 0.5% of the pixels at each end.
+func DefaultLevelsOptions() LevelsOptions {
+	return LevelsOptions{
+		Auto: true,
+		Clip: 0.005,
+	}
+}
+
+// LoadLevelsRecipe reads levels, gamma and curve settings from a JSON recipe such as
+//
+//	{"auto": true, "clip": 0.01, "gamma": [1.1, 1, 0.9],
+//	 "curves": {"master": [{"in": 0, "out": 0}, {"in": 96, "out": 80}, {"in": 255, "out": 255}]}}
+//
+// Fields missing from the recipe keep their zero value.
+func LoadLevelsRecipe(path string) (LevelsOptions, error) {
+	var opts LevelsOptions
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return opts, err
+	}
+	err = json.Unmarshal(data, &opts)
+	return opts, err
+}
+
+// AutoLevels finds the black and white point of every channel, on the 0-255 scale, ignoring the
+// darkest and brightest clip fraction of the pixels so that dust and specular spots do not count.
+func AutoLevels(img image.Image, clip float64, numWorkers int) (black, white [3]float64) {
+	return autoLevels(toFloatImage(img, numWorkers), clip, numWorkers)
+}
+
+// LevelsConcurrent restores faded dye layers: every channel is stretched between its own black
+// and white point, then gamma and the tone curves are applied. All adjustments of a channel are
+// combined into a single lookup table, applied to the image rows in parallel.
+func LevelsConcurrent(img image.Image, opts LevelsOptions, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return levels(src, opts, numWorkers).toNRGBA64(numWorkers)
+}
+
+// levels applies the levels and curves stage to a working copy.
+func levels(src *floatImage, opts LevelsOptions, numWorkers int) *floatImage {
+	black, white := opts.Black, opts.White
+	if opts.Auto {
+		black, white = autoLevels(src, opts.Clip, numWorkers)
+	}
+	return applyLUTs(src, levelsLUTs(opts, black, white), numWorkers)
+}
+
+// levelsLUTs combines the black and white points, gamma and tone curves of every channel into
+// a lookup table.
+func levelsLUTs(opts LevelsOptions, black, white [3]float64) [3][]float32 {
+	channelCurves := [3]ToneCurve{opts.Curves.Red, opts.Curves.Green, opts.Curves.Blue}
+
+	var luts [3][]float32
+	for c := range luts {
+		w := white[c]
+		if w == 0 {
+			w = 255
+		}
+		gamma := opts.Gamma[c]
+		if gamma == 0 {
+			gamma = 1
+		}
+		channel, master := channelCurves[c].spline(), opts.Curves.Master.spline()
+
+		luts[c] = make([]float32, lutSize)
+		for i := range luts[c] {
+			v := float64(i) / (lutSize - 1)
+			v = math.Max(0, math.Min(1, (255*v-black[c])/math.Max(w-black[c], 1)))
+			v = math.Pow(v, 1/gamma)
+			v = master(channel(v))
+			luts[c][i] = float32(v)
+		}
+	}
+	return luts
+}
+
+// lookup reads a [0, 1] sample through a lookup table, interpolating between entries.
+func lookup(lut []float32, v float32) float32 {
+	pos := clamp01(v) * float32(len(lut)-1)
+	i := int(pos)
+	if i >= len(lut)-1 {
+		return lut[len(lut)-1]
+	}
+	frac := pos - float32(i)
+	return lut[i]*(1-frac) + lut[i+1]*frac
+}
+
+// autoLevels finds per-channel black and white points of a working copy from its histograms.
+// The points are found on up to 65536 levels, so 16-bit scans are not rounded to 8 bits.
+func autoLevels(src *floatImage, clip float64, numWorkers int) (black, white [3]float64) {
+	bins := histogramBins(src.Width * src.Height)
+	return levelsFromHistograms(rgbHistograms(src, bins, numWorkers), clip)
+}
+
+// levelsFromHistograms finds the black and white point of every channel, on the 0-255 scale,
+// from its histogram, ignoring the clip fraction of the samples at each end.
+func levelsFromHistograms(hists [3][]int, clip float64) (black, white [3]float64) {
+	for c, hist := range hists {
+		bins := len(hist)
+		scale := 255 / float64(bins-1)
+		skip := int(clip * float64(histogramTotal(hist)))
+
+		black[c], white[c] = 0, 255
+		for v, count := 0, 0; v < bins; v++ {
+			count += hist[v]
+			if count > skip {
+				black[c] = float64(v) * scale
+				break
+			}
+		}
+		for v, count := bins-1, 0; v >= 0; v-- {
+			count += hist[v]
+			if count > skip {
+				white[c] = float64(v) * scale
+				break
+			}
+		}
+	}
+	return black, white
+}
+
+// spline returns the curve as a function on [0, 1], using monotone cubic (Fritsch-Carlson)
+// interpolation so the curve never overshoots between control points.
+func (t ToneCurve) spline() func(float64) float64 {
+	if len(t) < 2 {
+		return func(v float64) float64 { return v }
+	}
+
+	points := append(ToneCurve(nil), t...)
+	sort.Slice(points, func(i, j int) bool { return points[i].In < points[j].In })
+	n := len(points)
+	xs, ys := make([]float64, n), make([]float64, n)
+	for i, p := range points {
+		xs[i], ys[i] = p.In/255, p.Out/255
+	}
+
+	// Secant slopes, then tangents limited so that every segment stays monotone
+	secants := make([]float64, n-1)
+	for i := range secants {
+		if dx := xs[i+1] - xs[i]; dx > 0 {
+			secants[i] = (ys[i+1] - ys[i]) / dx
+		}
+	}
+	tangents := make([]float64, n)
+	tangents[0], tangents[n-1] = secants[0], secants[n-2]
+	for i := 1; i < n-1; i++ {
+		if secants[i-1]*secants[i] > 0 {
+			tangents[i] = (secants[i-1] + secants[i]) / 2
+		}
+	}
+	for i, s := range secants {
+		if s == 0 {
+			tangents[i], tangents[i+1] = 0, 0
+			continue
+		}
+		a, b := tangents[i]/s, tangents[i+1]/s
+		if h := a*a + b*b; h > 9 {
+			scale := 3 / math.Sqrt(h)
+			tangents[i], tangents[i+1] = scale*a*s, scale*b*s
+		}
+	}
+
+	return func(v float64) float64 {
+		if v <= xs[0] {
+			return ys[0]
+		}
+		if v >= xs[n-1] {
+			return ys[n-1]
+		}
+		i := sort.SearchFloat64s(xs, v) - 1
+		if i < 0 {
+			i = 0
+		}
+		dx := xs[i+1] - xs[i]
+		if dx == 0 {
+			return ys[i+1]
+		}
+
+		// Cubic Hermite basis
+		t := (v - xs[i]) / dx
+		t2, t3 := t*t, t*t*t
+		return (2*t3-3*t2+1)*ys[i] + (t3-2*t2+t)*dx*tangents[i] +
+			(-2*t3+3*t2)*ys[i+1] + (t3-t2)*dx*tangents[i+1]
+	}
+}
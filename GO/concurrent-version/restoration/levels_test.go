@@ -0,0 +1,182 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadLevelsRecipe(t *testing.T) {
+	tests := []struct {
+		name    string
+		recipe  string
+		want    LevelsOptions
+		wantErr bool
+	}{
+		{
+			name: "documented example",
+			recipe: `{"auto": true, "clip": 0.01, "gamma": [1.1, 1, 0.9],
+				"curves": {"master": [{"in": 0, "out": 0}, {"in": 96, "out": 80}, {"in": 255, "out": 255}]}}`,
+			want: LevelsOptions{
+				Auto:  true,
+				Clip:  0.01,
+				Gamma: [3]float64{1.1, 1, 0.9},
+				Curves: Curves{Master: ToneCurve{
+					{In: 0, Out: 0}, {In: 96, Out: 80}, {In: 255, Out: 255},
+				}},
+			},
+		},
+		{
+			name:   "manual points",
+			recipe: `{"black": [12, 8, 20], "white": [240, 250, 0]}`,
+			want:   LevelsOptions{Black: [3]float64{12, 8, 20}, White: [3]float64{240, 250, 0}},
+		},
+		{name: "empty recipe", recipe: `{}`, want: LevelsOptions{}},
+		{name: "malformed JSON", recipe: `{"auto": true,`, wantErr: true},
+		{name: "wrong type", recipe: `{"gamma": "bright"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recipe.json")
+			if err := os.WriteFile(path, []byte(tt.recipe), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadLevelsRecipe(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadLevelsRecipe accepted %s as %+v", tt.recipe, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadLevelsRecipe = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadLevelsRecipe(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadLevelsRecipe accepted a missing file")
+	}
+}
+
+func TestAutoLevelsIgnoresDust(t *testing.T) {
+	// A faded print: every channel spans its own range, plus black and white dust specks on
+	// fewer than 0.5% of the pixels
+	const width, height = 128, 64
+	lows, highs := [3]float64{0.2, 0.1, 0.3}, [3]float64{0.8, 0.9, 0.6}
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c [3]uint16
+			for i := range c {
+				c[i] = uint16((lows[i] + (highs[i]-lows[i])*float64(x)/(width-1)) * 0xffff)
+			}
+			img.SetNRGBA64(x, y, color.NRGBA64{c[0], c[1], c[2], 0xffff})
+		}
+	}
+	for i := 0; i < 15; i++ {
+		img.SetNRGBA64(3+i*7, 10, color.NRGBA64{0, 0, 0, 0xffff})
+		img.SetNRGBA64(5+i*7, 40, color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+	}
+
+	black, white := AutoLevels(img, 0.005, 3)
+	for c := range black {
+		if math.Abs(black[c]-255*lows[c]) > 1 || math.Abs(white[c]-255*highs[c]) > 1 {
+			t.Errorf("channel %d: levels %.1f-%.1f, want %.1f-%.1f", c, black[c], white[c], 255*lows[c], 255*highs[c])
+		}
+	}
+
+	// Without clipping the dust sets the points
+	black, white = AutoLevels(img, 0, 3)
+	if black != [3]float64{} || white != [3]float64{255, 255, 255} {
+		t.Errorf("unclipped levels %v-%v, want the dust at 0 and 255", black, white)
+	}
+
+	// The levels stretch every channel over the full range
+	got := LevelsConcurrent(img, DefaultLevelsOptions(), 3)
+	first, last := got.NRGBA64At(0, 0), got.NRGBA64At(width-1, 0)
+	for c, v := range []uint16{first.R, first.G, first.B, last.R, last.G, last.B} {
+		want := uint16(0)
+		if c >= 3 {
+			want = 0xffff
+		}
+		if d := int(v) - int(want); d < -0x200 || d > 0x200 {
+			t.Errorf("stretched edge sample %d is %#x, want %#x", c, v, want)
+		}
+	}
+}
+
+func TestLevelsGamma(t *testing.T) {
+	luts := levelsLUTs(LevelsOptions{Gamma: [3]float64{2, 0, 0.5}}, [3]float64{}, [3]float64{})
+	for c, want := range []float64{0.5, 0.25, 0.0625} {
+		if got := lookup(luts[c], 0.25); math.Abs(float64(got)-want) > 1e-3 {
+			t.Errorf("channel %d maps 0.25 to %.4f, want %.4f", c, got, want)
+		}
+	}
+}
+
+func TestToneCurveDoesNotOvershoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve ToneCurve
+	}{
+		{"S curve", ToneCurve{{In: 0, Out: 0}, {In: 64, Out: 40}, {In: 192, Out: 215}, {In: 255, Out: 255}}},
+		{"steep step", ToneCurve{{In: 0, Out: 0}, {In: 100, Out: 5}, {In: 110, Out: 250}, {In: 255, Out: 255}}},
+		{"plateau", ToneCurve{{In: 0, Out: 0}, {In: 64, Out: 128}, {In: 192, Out: 128}, {In: 255, Out: 255}}},
+		{"unsorted", ToneCurve{{In: 255, Out: 230}, {In: 30, Out: 20}, {In: 128, Out: 160}}},
+		{"falling", ToneCurve{{In: 0, Out: 255}, {In: 50, Out: 250}, {In: 60, Out: 20}, {In: 255, Out: 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curve := tt.curve.spline()
+			points := append(ToneCurve(nil), tt.curve...)
+			sort.Slice(points, func(i, j int) bool { return points[i].In < points[j].In })
+
+			// The curve passes through its points and stays between the outputs of the two points
+			// around every input, so it is monotone wherever its points are
+			for _, p := range points {
+				if got := curve(p.In / 255); math.Abs(got-p.Out/255) > 1e-9 {
+					t.Errorf("curve(%v) = %v, want %v", p.In, 255*got, p.Out)
+				}
+			}
+			for i := 0; i < len(points)-1; i++ {
+				p0, p1 := points[i], points[i+1]
+				lo, hi := math.Min(p0.Out, p1.Out)/255, math.Max(p0.Out, p1.Out)/255
+				prev := p0.Out / 255
+				for s := 1; s <= 100; s++ {
+					in := (p0.In + (p1.In-p0.In)*float64(s)/100) / 255
+					got := curve(in)
+					if got < lo-1e-9 || got > hi+1e-9 {
+						t.Fatalf("curve(%.1f) = %.2f overshoots %v-%v", 255*in, 255*got, p0.Out, p1.Out)
+					}
+					if (p1.Out >= p0.Out && got < prev-1e-9) || (p1.Out <= p0.Out && got > prev+1e-9) {
+						t.Fatalf("curve turns back at %.1f between %v and %v", 255*in, p0, p1)
+					}
+					prev = got
+				}
+			}
+
+			// Outside the points the curve keeps the nearest value
+			if got := curve(0); math.Abs(got-points[0].Out/255) > 1e-9 {
+				t.Errorf("curve(0) = %v, want %v", 255*got, points[0].Out)
+			}
+			if got := curve(1); math.Abs(got-points[len(points)-1].Out/255) > 1e-9 {
+				t.Errorf("curve(255) = %v, want %v", 255*got, points[len(points)-1].Out)
+			}
+		})
+	}
+
+	for _, curve := range []ToneCurve{nil, {{In: 30, Out: 200}}} {
+		if got := curve.spline()(0.3); got != 0.3 {
+			t.Errorf("curve with %d points maps 0.3 to %v, want the identity", len(curve), got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package restoration
+
+import (
+	"image"
+	"sync"
+)
+
+// Lookup tables of the sRGB transfer curve, built on first use
+var (
+	srgbLUTOnce                      sync.Once
+	srgbToLinearLUT, linearToSRGBLUT []float32
+)
+
+// srgbLUTs returns the tables converting sRGB-encoded samples to linear light and back.
+func srgbLUTs() (toLinear, toSRGB []float32) {
+	srgbLUTOnce.Do(func() {
+		srgbToLinearLUT = curveLUT(srgbToLinear)
+		linearToSRGBLUT = curveLUT(linearToSRGB)
+	})
+	return srgbToLinearLUT, linearToSRGBLUT
+}
+
+// SRGBToLinearConcurrent decodes the sRGB transfer curve, giving samples proportional to light.
+// Averages of linear samples match how light mixes, so blurring and blending them does not
+// darken edges and fine detail as it does on gamma-encoded values. Alpha is left unchanged.
+func SRGBToLinearConcurrent(img image.Image, numWorkers int) *image.NRGBA64 {
+	return linearize(toFloatImage(img, numWorkers), numWorkers).toNRGBA64(numWorkers)
+}
+
+// LinearToSRGBConcurrent encodes linear samples with the sRGB transfer curve, undoing
+// SRGBToLinearConcurrent.
+func LinearToSRGBConcurrent(img image.Image, numWorkers int) *image.NRGBA64 {
+	return delinearize(toFloatImage(img, numWorkers), numWorkers).toNRGBA64(numWorkers)
+}
+
+// linearize converts the R, G and B channels of a working copy to linear light.
+func linearize(src *floatImage, numWorkers int) *floatImage {
+	toLinear, _ := srgbLUTs()
+	return applyLUTs(src, [3][]float32{toLinear, toLinear, toLinear}, numWorkers)
+}
+
+// delinearize encodes the R, G and B channels of a linear working copy with the sRGB curve.
+func delinearize(src *floatImage, numWorkers int) *floatImage {
+	_, toSRGB := srgbLUTs()
+	return applyLUTs(src, [3][]float32{toSRGB, toSRGB, toSRGB}, numWorkers)
+}
+
+// inLinearLight runs a filtering stage on the linear-light version of an image when
+// opts.LinearLight is set, and on the image as it is otherwise.
+func inLinearLight(img image.Image, opts Options, stage func(image.Image) *image.NRGBA64) *image.NRGBA64 {
+	if !opts.LinearLight {
+		return stage(img)
+	}
+	linear := SRGBToLinearConcurrent(img, opts.NumWorkers)
+	return LinearToSRGBConcurrent(stage(linear), opts.NumWorkers)
+}
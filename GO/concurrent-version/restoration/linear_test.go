@@ -0,0 +1,75 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestSRGBCurve(t *testing.T) {
+	tests := []struct {
+		encoded, linear float64
+	}{
+		{0, 0},
+		{0.04045, 0.0031308}, // End of the linear segment
+		{0.2, 0.0331048},
+		{0.5, 0.2140411},
+		{0.8, 0.6038273},
+		{1, 1},
+	}
+	for _, tt := range tests {
+		if got := srgbToLinear(tt.encoded); math.Abs(got-tt.linear) > 1e-6 {
+			t.Errorf("srgbToLinear(%v) = %v, want %v", tt.encoded, got, tt.linear)
+		}
+		if got := linearToSRGB(tt.linear); math.Abs(got-tt.encoded) > 1e-5 {
+			t.Errorf("linearToSRGB(%v) = %v, want %v", tt.linear, got, tt.encoded)
+		}
+	}
+	for i := 0; i <= 1000; i++ {
+		v := float64(i) / 1000
+		if got := linearToSRGB(srgbToLinear(v)); math.Abs(got-v) > 1e-9 {
+			t.Fatalf("round trip of %v gives %v", v, got)
+		}
+	}
+}
+
+func TestLinearRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		img       *image.NRGBA64
+		tolerance int // Largest difference per 16-bit channel
+	}{
+		// Linear samples stored in 16 bits are coarse near black, where the curve is steepest
+		{"16-bit", randomImage(64, 32, true, 7), 16},
+		{"8-bit levels", func() *image.NRGBA64 {
+			img := image.NewNRGBA64(image.Rect(0, 0, 256, 1))
+			for x := 0; x < 256; x++ {
+				v := uint16(x) * 0x101
+				img.SetNRGBA64(x, 0, color.NRGBA64{v, v, v, uint16(255-x) * 0x101})
+			}
+			return img
+		}(), 0x80}, // Every 8-bit level comes back
+	}
+	for _, tt := range tests {
+		linear := SRGBToLinearConcurrent(tt.img, 3)
+		back := LinearToSRGBConcurrent(linear, 3)
+		b := tt.img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				g, w, l := back.NRGBA64At(x, y), tt.img.NRGBA64At(x, y), linear.NRGBA64At(x, y)
+				if g.A != w.A || l.A != w.A {
+					t.Fatalf("%s: pixel (%d, %d) alpha %#x and %#x, want %#x", tt.name, x, y, l.A, g.A, w.A)
+				}
+				if l.R > w.R || l.G > w.G || l.B > w.B {
+					t.Fatalf("%s: pixel (%d, %d) linear %v brighter than encoded %v", tt.name, x, y, l, w)
+				}
+				for _, d := range []int{int(g.R) - int(w.R), int(g.G) - int(w.G), int(g.B) - int(w.B)} {
+					if d < -tt.tolerance || d > tt.tolerance {
+						t.Fatalf("%s: pixel (%d, %d) = %v, want %v", tt.name, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+}
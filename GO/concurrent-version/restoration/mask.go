@@ -10,63 +10,37 @@ import (
 )
 
 // CreateMaskByChunks generates a binary mask of the image using parallel processing.
-// It divides the image into chunks and applies a threshold to classify pixels as part of the mask.
-// The result is saved as a JPEG image for debugging.
-func CreateMaskByChunks(img image.Image, outputPath string, numWorkers int) ([][]float64, error) {
+// It divides the image into bands of rows, so that no two workers write the same word of the
+// bit-packed mask, and applies a threshold to classify pixels as part of the mask.
+// The result is saved as a JPEG image for debugging, unless outputPath is empty.
+func CreateMaskByChunks(img image.Image, outputPath string, numWorkers int) (*BitMask, error) {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
 	// Create the mask
-	mask := make([][]float64, height)
-	for i := range mask {
-		mask[i] = make([]float64, width)
-	}
-	// Define chunk sizes for parallel processing
-	chunkWidth := int(math.Ceil(float64(width) / math.Sqrt(float64(numWorkers))))
-	chunkHeight := int(math.Ceil(float64(height) / math.Sqrt(float64(numWorkers))))
-	overlap := 2	// Overlap to prevent boundary artifacts
+	mask := NewBitMask(width, height)
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				sum := uint32(c.R) + uint32(c.G) + uint32(c.B) // Full 16-bit precision, 427 on the 8-bit scale
 
-	var wg sync.WaitGroup
-	processChunk := func(xStart, xEnd, yStart, yEnd int) {
-		defer wg.Done()
-		for y := yStart; y < yEnd && y < height; y++ {
-			for x := xStart; x < xEnd && x < width; x++ {
-				r, g, b, _ := img.At(x, y).RGBA()
-				r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
-				sum := uint32(r8) + uint32(g8) + uint32(b8)
-				
-				// Apply threshold to determine mask value
-				if sum > 427 { 
-					mask[y][x] = 1.0
-				} else {
-					mask[y][x] = 0.0
+				// Apply threshold to determine mask value; transparent pixels are never damage
+				if c.A > 0 && sum > 427*0x101 {
+					mask.Set(x, y, 1.0)
 				}
 			}
 		}
-	}
-
-	// Launch workers to process image chunks in parallel
-	for yStart := 0; yStart < height; yStart += chunkHeight - overlap {
-		yEnd := yStart + chunkHeight
-		if yEnd > height {
-			yEnd = height
-		}
-		for xStart := 0; xStart < width; xStart += chunkWidth - overlap {
-			xEnd := xStart + chunkWidth
-			if xEnd > width {
-				xEnd = width
-			}
-			wg.Add(1)
-			go processChunk(xStart, xEnd, yStart, yEnd)
-		}
-	}
-	wg.Wait()
+	})
 
 	// Save the mask as a grayscale image for debugging
-	maskImg := image.NewRGBA(bounds)
+	if outputPath == "" {
+		return mask, nil
+	}
+	maskImg := image.NewRGBA(image.Rect(0, 0, width, height))
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			if mask[y][x] == 1.0 {
+			if mask.At(x, y) == 1.0 {
 				maskImg.Set(x, y, color.White)
 			} else {
 				maskImg.Set(x, y, color.Black)
@@ -88,15 +62,12 @@ func CreateMaskByChunks(img image.Image, outputPath string, numWorkers int) ([][
 
 // FeatherMaskConcurrent smooths the edges of a binary mask using an exponential decay function.
 // The function runs in parallel, ensuring efficient feathering.
-func FeatherMaskConcurrent(mask [][]float64, radius int, edgeMask [][]float64, numWorkers int) [][]float64 {
-	height := len(mask)
-	width := len(mask[0])
+func FeatherMaskConcurrent(mask Mask, radius int, edgeMask Mask, numWorkers int) *FloatMask {
+	width, height := mask.Size()
+	mask = denseMask(mask) // The window below looks up every neighbour
 
 	// Output mask with feathering applied
-	featheredMask := make([][]float64, height)
-	for i := range featheredMask {
-		featheredMask[i] = make([]float64, width)
-	}
+	featheredMask := NewFloatMask(width, height)
 
 	var wg sync.WaitGroup
 	rowsPerWorker := height / numWorkers
@@ -106,19 +77,21 @@ func FeatherMaskConcurrent(mask [][]float64, radius int, edgeMask [][]float64, n
 		defer wg.Done()
 		for y := startRow; y < endRow; y++ {
 			for x := 0; x < width; x++ {
-				if mask[y][x] == 1 {
-					featheredMask[y][x] = 1.0 // Fully masked
+				if mask.At(x, y) == 1 {
+					featheredMask.Set(x, y, 1.0) // Fully masked
 				} else {
+					feathered := 0.0
 					for dy := -radius; dy <= radius; dy++ {
 						for dx := -radius; dx <= radius; dx++ {
 							nx, ny := x+dx, y+dy
-							if nx >= 0 && nx < width && ny >= 0 && ny < height && mask[ny][nx] == 1 {
+							if nx >= 0 && nx < width && ny >= 0 && ny < height && mask.At(nx, ny) == 1 {
 								distance := float64(dx*dx + dy*dy)
-								weight := math.Exp(-distance / float64(radius*radius)) * (1.0 - edgeMask[ny][nx])
-								featheredMask[y][x] = math.Max(featheredMask[y][x], weight)
+								weight := math.Exp(-distance / float64(radius*radius)) * (1.0 - edgeMask.At(nx, ny))
+								feathered = math.Max(feathered, weight)
 							}
 						}
 					}
+					featheredMask.Set(x, y, feathered)
 				}
 			}
 		}
@@ -0,0 +1,301 @@
+package restoration
+
+import (
+	"sort"
+)
+
+// Mask is a per-pixel map over an image: a scratch mask, where 1 marks damage, or a weight map
+// such as an edge map or a feathered mask, with values in [0, 1]. The implementations trade
+// precision for memory: a bit-packed BitMask takes 1 bit per pixel, a RunLengthMask only stores
+// the damaged runs of a mostly clean photo, a ByteMask keeps weights in 1/255 steps and a
+// FloatMask keeps them as float32.
+//
+// Set may be called concurrently for different rows, never for the same row.
+type Mask interface {
+	Size() (width, height int)
+	At(x, y int) float64 // Value at (x, y), which must be inside the mask
+	Set(x, y int, v float64)
+}
+
+// BitMask is a binary mask packed 64 pixels to a word. Every row starts on a new word, so rows
+// can be written concurrently. Set stores 1 for values of at least 0.5 and 0 otherwise.
+type BitMask struct {
+	width, height int
+	stride        int // Words per row
+	words         []uint64
+}
+
+// NewBitMask allocates an empty binary mask.
+func NewBitMask(width, height int) *BitMask {
+	stride := (width + 63) / 64
+	return &BitMask{width: width, height: height, stride: stride, words: make([]uint64, stride*height)}
+}
+
+// Size returns the width and height of the mask.
+func (m *BitMask) Size() (width, height int) { return m.width, m.height }
+
+// At returns 1 for set pixels and 0 for the others.
+func (m *BitMask) At(x, y int) float64 {
+	return float64(m.words[y*m.stride+x>>6] >> (x & 63) & 1)
+}
+
+// Set sets or clears a pixel.
+func (m *BitMask) Set(x, y int, v float64) {
+	i, bit := y*m.stride+x>>6, uint64(1)<<(x&63)
+	if v >= 0.5 {
+		m.words[i] |= bit
+	} else {
+		m.words[i] &^= bit
+	}
+}
+
+// ByteMask is a weight map with 8 bits per pixel, in steps of 1/255. Weights strictly between
+// 0 and 1 are kept off the first and last step, so a ByteMask answers comparisons against 0 and 1
+// (damaged at all, fully damaged) like the float map it was quantised from.
+type ByteMask struct {
+	width, height int
+	Pix           []uint8
+}
+
+// NewByteMask allocates a weight map of zeros with 8 bits per pixel.
+func NewByteMask(width, height int) *ByteMask {
+	return &ByteMask{width: width, height: height, Pix: make([]uint8, width*height)}
+}
+
+// Size returns the width and height of the mask.
+func (m *ByteMask) Size() (width, height int) { return m.width, m.height }
+
+// At returns the weight at (x, y).
+func (m *ByteMask) At(x, y int) float64 { return float64(m.Pix[y*m.width+x]) / 0xff }
+
+// Set stores a weight, clamped to [0, 1] and rounded to the nearest step. Weights in (0, 1/510)
+// are stored as 1/255 and weights in (1-1/510, 1) as 254/255 rather than rounded to 0 or 1.
+func (m *ByteMask) Set(x, y int, v float64) {
+	q := uint8(clamp01(float32(v))*0xff + 0.5)
+	switch {
+	case q == 0 && v > 0:
+		q = 1
+	case q == 0xff && v < 1:
+		q = 0xfe
+	}
+	m.Pix[y*m.width+x] = q
+}
+
+// FloatMask is a weight map with one float32 per pixel, half the size of float64 maps and
+// precise enough for edge strengths and feathering weights. Values are not clamped.
+type FloatMask struct {
+	width, height int
+	Pix           []float32
+}
+
+// NewFloatMask allocates a float32 weight map of zeros.
+func NewFloatMask(width, height int) *FloatMask {
+	return &FloatMask{width: width, height: height, Pix: make([]float32, width*height)}
+}
+
+// Size returns the width and height of the mask.
+func (m *FloatMask) Size() (width, height int) { return m.width, m.height }
+
+// At returns the weight at (x, y).
+func (m *FloatMask) At(x, y int) float64 { return float64(m.Pix[y*m.width+x]) }
+
+// Set stores a weight.
+func (m *FloatMask) Set(x, y int, v float64) { m.Pix[y*m.width+x] = float32(v) }
+
+// plane returns the map as a single-channel plane sharing its samples.
+func (m *FloatMask) plane() plane {
+	return plane{data: m.Pix, width: m.width, height: m.height, step: 1}
+}
+
+// rows returns a view of the rows [startY, endY) of the map, sharing its samples.
+func (m *FloatMask) rows(startY, endY int) *FloatMask {
+	return &FloatMask{width: m.width, height: endY - startY, Pix: m.Pix[startY*m.width : endY*m.width]}
+}
+
+// maskRun is a run of set pixels [start, end) on one row of a RunLengthMask.
+type maskRun struct {
+	start, end int32
+}
+
+// RunLengthMask is a binary mask stored as the sorted runs of set pixels of every row. A photo
+// with a few scratches needs a handful of runs per row instead of a bit per pixel. Lookups
+// search the runs of the row, so At costs O(log runs): stages that read the neighbourhood of
+// every pixel take a BitMask copy first (see denseMask). Set stores 1 for values of at least 0.5.
+type RunLengthMask struct {
+	width, height int
+	rows          [][]maskRun
+}
+
+// NewRunLengthMask allocates an empty run-length mask.
+func NewRunLengthMask(width, height int) *RunLengthMask {
+	return &RunLengthMask{width: width, height: height, rows: make([][]maskRun, height)}
+}
+
+// Size returns the width and height of the mask.
+func (m *RunLengthMask) Size() (width, height int) { return m.width, m.height }
+
+// find returns the index of the first run of row y ending after x.
+func (m *RunLengthMask) find(x, y int) int {
+	runs := m.rows[y]
+	return sort.Search(len(runs), func(i int) bool { return int(runs[i].end) > x })
+}
+
+// At returns 1 for set pixels and 0 for the others.
+func (m *RunLengthMask) At(x, y int) float64 {
+	runs := m.rows[y]
+	if i := m.find(x, y); i < len(runs) && int(runs[i].start) <= x {
+		return 1
+	}
+	return 0
+}
+
+// Set sets or clears a pixel, merging and splitting runs as needed.
+func (m *RunLengthMask) Set(x, y int, v float64) {
+	runs := m.rows[y]
+	i := m.find(x, y)
+	inside := i < len(runs) && int(runs[i].start) <= x
+	px := int32(x)
+
+	if v >= 0.5 {
+		if inside {
+			return
+		}
+		joinsLeft := i > 0 && runs[i-1].end == px
+		joinsRight := i < len(runs) && runs[i].start == px+1
+		switch {
+		case joinsLeft && joinsRight:
+			runs[i-1].end = runs[i].end
+			runs = append(runs[:i], runs[i+1:]...)
+		case joinsLeft:
+			runs[i-1].end++
+		case joinsRight:
+			runs[i].start--
+		default:
+			runs = append(runs, maskRun{})
+			copy(runs[i+1:], runs[i:])
+			runs[i] = maskRun{px, px + 1}
+		}
+	} else {
+		if !inside {
+			return
+		}
+		r := runs[i]
+		switch {
+		case r.start == px && r.end == px+1:
+			runs = append(runs[:i], runs[i+1:]...)
+		case r.start == px:
+			runs[i].start++
+		case r.end == px+1:
+			runs[i].end--
+		default:
+			// Split the run around the cleared pixel
+			runs = append(runs, maskRun{})
+			copy(runs[i+2:], runs[i+1:])
+			runs[i].end = px
+			runs[i+1] = maskRun{px + 1, r.end}
+		}
+	}
+	m.rows[y] = runs
+}
+
+// toBitMask unpacks the runs into a bit-packed mask.
+func (m *RunLengthMask) toBitMask() *BitMask {
+	out := NewBitMask(m.width, m.height)
+	for y, runs := range m.rows {
+		row := out.words[y*out.stride : (y+1)*out.stride]
+		for _, r := range runs {
+			for x := int(r.start); x < int(r.end); x++ {
+				row[x>>6] |= 1 << (x & 63)
+			}
+		}
+	}
+	return out
+}
+
+// denseMask returns a BitMask copy of a run-length mask, for stages that look a mask up at
+// every pixel and its neighbourhood, and any other mask unchanged.
+func denseMask(mask Mask) Mask {
+	if m, ok := mask.(*RunLengthMask); ok {
+		return m.toBitMask()
+	}
+	return mask
+}
+
+// SparseMask returns a run-length copy of a binary mask when that takes less memory than a
+// bit-packed one, as for mostly clean photos, and the mask itself otherwise.
+func SparseMask(mask Mask) Mask {
+	width, height := mask.Size()
+	runs := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if mask.At(x, y) >= 1 && (x == 0 || mask.At(x-1, y) < 1) {
+				runs++
+			}
+		}
+	}
+	// A run takes 8 bytes and a row slice header 24, against a bit per pixel
+	if 8*runs+24*height >= height*((width+63)/64)*8 {
+		return mask
+	}
+
+	sparse := NewRunLengthMask(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if mask.At(x, y) >= 1 {
+				if x > 0 && mask.At(x-1, y) >= 1 {
+					sparse.rows[y][len(sparse.rows[y])-1].end++
+				} else {
+					sparse.rows[y] = append(sparse.rows[y], maskRun{int32(x), int32(x + 1)})
+				}
+			}
+		}
+	}
+	return sparse
+}
+
+// cloneMask returns a copy of a mask with the same representation.
+func cloneMask(mask Mask) Mask {
+	switch m := mask.(type) {
+	case *BitMask:
+		c := *m
+		c.words = append([]uint64(nil), m.words...)
+		return &c
+	case *ByteMask:
+		c := *m
+		c.Pix = append([]uint8(nil), m.Pix...)
+		return &c
+	case *FloatMask:
+		c := *m
+		c.Pix = append([]float32(nil), m.Pix...)
+		return &c
+	case *RunLengthMask:
+		c := NewRunLengthMask(m.width, m.height)
+		for y, runs := range m.rows {
+			c.rows[y] = append([]maskRun(nil), runs...)
+		}
+		return c
+	}
+
+	width, height := mask.Size()
+	c := NewFloatMask(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c.Set(x, y, mask.At(x, y))
+		}
+	}
+	return c
+}
+
+// toByteMask quantises a weight map to 8 bits per pixel, keeping which weights are 0, 1 or in between.
+func toByteMask(mask Mask, numWorkers int) *ByteMask {
+	width, height := mask.Size()
+	out := NewByteMask(width, height)
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				out.Set(x, y, mask.At(x, y))
+			}
+		}
+	})
+	return out
+}
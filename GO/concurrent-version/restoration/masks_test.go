@@ -0,0 +1,230 @@
+package restoration
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMaskSetAt(t *testing.T) {
+	masks := map[string]func(width, height int) Mask{
+		"bit":        func(width, height int) Mask { return NewBitMask(width, height) },
+		"byte":       func(width, height int) Mask { return NewByteMask(width, height) },
+		"float":      func(width, height int) Mask { return NewFloatMask(width, height) },
+		"run-length": func(width, height int) Mask { return NewRunLengthMask(width, height) },
+	}
+	tests := []struct {
+		name string
+		x, y int
+		v    float64
+	}{
+		{"origin", 0, 0, 1},
+		{"last column of the first word", 63, 1, 1},
+		{"first column of the second word", 64, 1, 1},
+		{"bottom right corner", 69, 4, 1},
+		{"cleared", 10, 2, 0},
+	}
+	for name, newMask := range masks {
+		t.Run(name, func(t *testing.T) {
+			mask := newMask(70, 5)
+			if width, height := mask.Size(); width != 70 || height != 5 {
+				t.Fatalf("size is %dx%d, want 70x5", width, height)
+			}
+			for _, tt := range tests {
+				mask.Set(tt.x, tt.y, tt.v)
+			}
+			for _, tt := range tests {
+				if got := mask.At(tt.x, tt.y); got != tt.v {
+					t.Errorf("%s: At(%d, %d) = %v, want %v", tt.name, tt.x, tt.y, got, tt.v)
+				}
+			}
+
+			// Nothing else was set
+			set := 0
+			for y := 0; y < 5; y++ {
+				for x := 0; x < 70; x++ {
+					if mask.At(x, y) != 0 {
+						set++
+					}
+				}
+			}
+			if set != 4 {
+				t.Errorf("%d pixels set, want 4", set)
+			}
+
+			// Clearing a set pixel
+			mask.Set(64, 1, 0)
+			if got := mask.At(64, 1); got != 0 {
+				t.Errorf("At(64, 1) = %v after clearing, want 0", got)
+			}
+			if got := mask.At(63, 1); got != 1 {
+				t.Errorf("At(63, 1) = %v after clearing its neighbour, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRunLengthMaskRuns(t *testing.T) {
+	tests := []struct {
+		name string
+		set  []int // Pixels set in order
+		clr  []int // Pixels cleared afterwards
+		want []maskRun
+	}{
+		{"single pixel", []int{5}, nil, []maskRun{{5, 6}}},
+		{"set twice", []int{5, 5}, nil, []maskRun{{5, 6}}},
+		{"extend right", []int{5, 6}, nil, []maskRun{{5, 7}}},
+		{"extend left", []int{6, 5}, nil, []maskRun{{5, 7}}},
+		{"separate runs stay sorted", []int{9, 2}, nil, []maskRun{{2, 3}, {9, 10}}},
+		{"merge two runs", []int{4, 6, 5}, nil, []maskRun{{4, 7}}},
+		{"merge into longer runs", []int{1, 2, 3, 5, 6, 7, 4}, nil, []maskRun{{1, 8}}},
+		{"clear unset pixel", []int{5}, []int{6}, []maskRun{{5, 6}}},
+		{"clear single pixel run", []int{5}, []int{5}, []maskRun{}},
+		{"clear run start", []int{5, 6, 7}, []int{5}, []maskRun{{6, 8}}},
+		{"clear run end", []int{5, 6, 7}, []int{7}, []maskRun{{5, 7}}},
+		{"split run", []int{3, 4, 5, 6, 7}, []int{5}, []maskRun{{3, 5}, {6, 8}}},
+		{"split next to another run", []int{0, 1, 2, 3, 8}, []int{1}, []maskRun{{0, 1}, {2, 4}, {8, 9}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mask := NewRunLengthMask(10, 1)
+			for _, x := range tt.set {
+				mask.Set(x, 0, 1)
+			}
+			for _, x := range tt.clr {
+				mask.Set(x, 0, 0)
+			}
+			got := mask.rows[0]
+			if got == nil {
+				got = []maskRun{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("runs are %v, want %v", got, tt.want)
+			}
+
+			// At and the bit-packed copy agree with the runs
+			bits := mask.toBitMask()
+			for x := 0; x < 10; x++ {
+				want := 0.0
+				for _, r := range tt.want {
+					if int(r.start) <= x && x < int(r.end) {
+						want = 1
+					}
+				}
+				if got := mask.At(x, 0); got != want {
+					t.Errorf("At(%d, 0) = %v, want %v", x, got, want)
+				}
+				if got := bits.At(x, 0); got != want {
+					t.Errorf("toBitMask: At(%d, 0) = %v, want %v", x, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSparseMaskMatchesDense(t *testing.T) {
+	dense := scratchMask(1000, 120)
+	sparse := SparseMask(dense)
+	if _, ok := sparse.(*RunLengthMask); !ok {
+		t.Fatalf("SparseMask returned %T for a mostly clean mask, want *RunLengthMask", sparse)
+	}
+	back := denseMask(sparse)
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 1000; x++ {
+			if sparse.At(x, y) != dense.At(x, y) || back.At(x, y) != dense.At(x, y) {
+				t.Fatalf("pixel (%d, %d): run-length %v, unpacked %v, want %v", x, y, sparse.At(x, y), back.At(x, y), dense.At(x, y))
+			}
+		}
+	}
+}
+
+func TestByteMaskCutOffs(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want uint8
+	}{
+		{-0.5, 0},
+		{0, 0},
+		{1e-6, 1},
+		{0.5 / 255, 1},
+		{0.5, 128},
+		{1 - 1e-6, 0xfe},
+		{1, 0xff},
+		{1.5, 0xff},
+	}
+	for _, tt := range tests {
+		mask := NewByteMask(1, 1)
+		mask.Set(0, 0, tt.v)
+		if mask.Pix[0] != tt.want {
+			t.Errorf("Set(%v) stored %d, want %d", tt.v, mask.Pix[0], tt.want)
+		}
+	}
+}
+
+// Compact weights must mark the same pixels as damaged (> 0) and fully damaged (>= 1) as the
+// float map, since inpainting and its neighbour selection compare against those thresholds.
+func TestCompactWeightsKeepThresholds(t *testing.T) {
+	weights := FeatherMaskConcurrent(scratchMask(64, 48), 6, NewFloatMask(64, 48), 2)
+	weights.Set(0, 0, 1e-5)
+	weights.Set(1, 0, 1-1e-5)
+	compact := toByteMask(weights, 3)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			v, c := weights.At(x, y), compact.At(x, y)
+			if (v > 0) != (c > 0) || (v >= 1) != (c >= 1) {
+				t.Fatalf("pixel (%d, %d): weight %v quantised to %v crosses a threshold", x, y, v, c)
+			}
+			if math.Abs(v-c) > 1.0/255 {
+				t.Fatalf("pixel (%d, %d): weight %v quantised to %v", x, y, v, c)
+			}
+		}
+	}
+}
+
+// scratchMask returns a bit mask with a few thin scratches, like the damage of a typical print.
+func scratchMask(width, height int) *BitMask {
+	mask := NewBitMask(width, height)
+	for y := 0; y < height; y++ {
+		mask.Set(width/3, y, 1)                  // Vertical scratch
+		mask.Set((y*width/height+5)%width, y, 1) // Diagonal scratch
+		mask.Set((y*width/height+6)%width, y, 1) // Two pixels wide
+		if y%17 < 3 {
+			for x := width / 2; x < width/2+width/8; x++ {
+				mask.Set(x, y, 1) // Horizontal tears
+			}
+		}
+	}
+	return mask
+}
+
+// BenchmarkMaskMemory builds the mask of a scratched 4000x3000 scan in every representation,
+// and in the float64 rows the pipeline used before; the allocated bytes per operation are the
+// memory each one takes.
+func BenchmarkMaskMemory(b *testing.B) {
+	const width, height = 4000, 3000
+	scratches := scratchMask(width, height)
+	masks := []struct {
+		name    string
+		newMask func() any
+	}{
+		{"float64 rows", func() any {
+			rows := make([][]float64, height)
+			for y := range rows {
+				rows[y] = make([]float64, width)
+			}
+			return rows
+		}},
+		{"float", func() any { return NewFloatMask(width, height) }},
+		{"byte", func() any { return NewByteMask(width, height) }},
+		{"bit", func() any { return NewBitMask(width, height) }},
+		{"run-length", func() any { return SparseMask(scratches) }},
+	}
+	for _, m := range masks {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.newMask()
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package restoration
+
+import (
+	"image"
+	"sort"
+)
+
+// histogramMedianRadius is the radius from which the median filter switches from sorting
+// each window to a sliding histogram, whose cost does not grow with the window area.
+// Sorting only wins for 3x3 windows (see BenchmarkMedianFilter).
+const histogramMedianRadius = 2
+
+// MedianFilterConcurrent replaces each pixel by the per-channel median of its (2*radius+1)^2 window.
+// Pixels outside the image are read with the border mode and fully transparent pixels are
+// left out of the windows. Small windows are sorted directly; larger ones use a sliding
+// 16-bit histogram per channel.
+func MedianFilterConcurrent(img image.Image, radius int, border BorderMode, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return medianFilter(src, radius, border, numWorkers).toNRGBA64(numWorkers)
+}
+
+// AdaptiveMedianFilterConcurrent removes salt-and-pepper noise with an adaptive median filter.
+// The window grows up to maxRadius until its median is not an impulse; only pixels detected as
+// impulses are replaced, so fine detail elsewhere is left untouched.
+func AdaptiveMedianFilterConcurrent(img image.Image, maxRadius int, border BorderMode, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	return adaptiveMedian(src, maxRadius, border, numWorkers).toNRGBA64(numWorkers)
+}
+
+// medianFilter applies the median filter to a working copy.
+func medianFilter(src *floatImage, radius int, border BorderMode, numWorkers int) *floatImage {
+	if radius >= histogramMedianRadius {
+		return histogramMedian(src, radius, border, numWorkers)
+	}
+
+	dst := newFloatImage(src.Rect)
+	width, height := src.Width, src.Height
+	alpha := src.channel(3)
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		window := make([]float32, 0, (2*radius+1)*(2*radius+1))
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				o := src.offset(x, y)
+				for c := 0; c < 3; c++ {
+					channel := src.channel(c)
+					window = window[:0]
+					for ky := -radius; ky <= radius; ky++ {
+						for kx := -radius; kx <= radius; kx++ {
+							if alpha.sample(x+kx, y+ky, border, 0) > 0 {
+								window = append(window, channel.sample(x+kx, y+ky, border, 0))
+							}
+						}
+					}
+					dst.Pix[o+c] = src.Pix[o+c]
+					if len(window) > 0 {
+						dst.Pix[o+c] = medianOf(window)
+					}
+				}
+				dst.Pix[o+3] = src.Pix[o+3]
+			}
+		}
+	})
+	return dst
+}
+
+// histogramMedian is the median filter for large radii (Huang's algorithm).
+// Each worker keeps one histogram per channel that slides over its rows in a serpentine:
+// left to right on one row, down one row, right to left on the next. Every step only adds
+// one column or row of the window and removes another, so the window is built once per worker.
+// The histograms have one bin per 16-bit level, with a coarse 256-bin histogram on top so the
+// median is found in two short scans.
+func histogramMedian(src *floatImage, radius int, border BorderMode, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	width, height := src.Width, src.Height
+
+	channels := [4]plane{src.channel(0), src.channel(1), src.channel(2), src.channel(3)}
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		var coarse [3][256]int32
+		var fine [3][]int32
+		for c := range fine {
+			fine[c] = make([]int32, maxHistogramBins)
+		}
+		visible := 0 // Pixels counted in the window
+		add := func(x, y, delta int) {
+			if channels[3].sample(x, y, border, 0) <= 0 {
+				return
+			}
+			visible += delta
+			for c := 0; c < 3; c++ {
+				v := to16(channels[c].sample(x, y, border, 0))
+				coarse[c][v>>8] += int32(delta)
+				fine[c][v] += int32(delta)
+			}
+		}
+		median := func(x, y int) {
+			o := src.offset(x, y)
+			half := int32(visible/2 + 1)
+			for c := 0; c < 3; c++ {
+				if visible == 0 {
+					dst.Pix[o+c] = src.Pix[o+c]
+					continue
+				}
+
+				// Find the coarse bin holding the median, then the level within it
+				count, high := int32(0), 0
+				for ; high < 255 && count+coarse[c][high] < half; high++ {
+					count += coarse[c][high]
+				}
+				v := high << 8
+				for ; v < high<<8|0xff && count+fine[c][v] < half; v++ {
+					count += fine[c][v]
+				}
+				dst.Pix[o+c] = float32(v) / 0xffff
+			}
+			dst.Pix[o+3] = src.Pix[o+3]
+		}
+
+		// Build the window of the first pixel of the band
+		for ky := -radius; ky <= radius; ky++ {
+			for kx := -radius; kx <= radius; kx++ {
+				add(kx, startY+ky, 1)
+			}
+		}
+
+		x, dir := 0, 1
+		for y := startY; y < endY; y++ {
+			if y > startY {
+				// Slide the window one row down
+				for kx := -radius; kx <= radius; kx++ {
+					add(x+kx, y-radius-1, -1)
+					add(x+kx, y+radius, 1)
+				}
+			}
+			for {
+				median(x, y)
+				next := x + dir
+				if next < 0 || next >= width {
+					break
+				}
+				// Slide the window one column along the row
+				for ky := -radius; ky <= radius; ky++ {
+					add(x-dir*radius, y+ky, -1)
+					add(next+dir*radius, y+ky, 1)
+				}
+				x = next
+			}
+			dir = -dir
+		}
+	})
+	return dst
+}
+
+// adaptiveMedian applies the adaptive median filter to a working copy, channel by channel.
+func adaptiveMedian(src *floatImage, maxRadius int, border BorderMode, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	width, height := src.Width, src.Height
+	alpha := src.channel(3)
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		window := make([]float32, 0, (2*maxRadius+1)*(2*maxRadius+1))
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				o := src.offset(x, y)
+				for c := 0; c < 3; c++ {
+					channel := src.channel(c)
+					value := src.Pix[o+c]
+					dst.Pix[o+c] = value
+					for r := 1; r <= maxRadius; r++ {
+						window = window[:0]
+						for ky := -r; ky <= r; ky++ {
+							for kx := -r; kx <= r; kx++ {
+								if alpha.sample(x+kx, y+ky, border, 0) > 0 {
+									window = append(window, channel.sample(x+kx, y+ky, border, 0))
+								}
+							}
+						}
+						if len(window) == 0 {
+							continue // No visible pixel yet: grow the window
+						}
+						med := medianOf(window)
+						lo, hi := window[0], window[len(window)-1]
+						if lo < med && med < hi {
+							// The median is reliable: replace the pixel only if it is an impulse
+							if value <= lo || value >= hi {
+								dst.Pix[o+c] = med
+							}
+							break
+						}
+						if r == maxRadius {
+							dst.Pix[o+c] = med
+						}
+					}
+				}
+				dst.Pix[o+3] = src.Pix[o+3]
+			}
+		}
+	})
+	return dst
+}
+
+// medianOf sorts the window in place and returns its median.
+func medianOf(window []float32) float32 {
+	sort.Slice(window, func(i, j int) bool { return window[i] < window[j] })
+	return window[len(window)/2]
+}
+
+// RepairDustConcurrent fills isolated dust specks in a binary scratch mask with a median.
+// Connected regions of the mask with at most maxArea pixels are replaced by the per-channel
+// median of the unmasked, visible pixels within radius. It returns the repaired image and a copy of
+// the mask with the repaired specks cleared, so later inpainting only handles real scratches.
+func RepairDustConcurrent(img image.Image, mask Mask, maxArea, radius int, numWorkers int) (*image.NRGBA64, Mask) {
+	src := toFloatImage(img, numWorkers)
+	width, height := src.Width, src.Height
+
+	// Copy the mask and find which pixels belong to small specks
+	remaining := cloneMask(mask)
+	speck := findSpecks(mask, maxArea)
+
+	dst := newFloatImage(src.Rect)
+	copy(dst.Pix, src.Pix)
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		window := make([]float32, 0, (2*radius+1)*(2*radius+1))
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				if speck.At(x, y) == 0 {
+					continue
+				}
+				o := src.offset(x, y)
+				for c := 0; c < 3; c++ {
+					window = window[:0]
+					for ky := -radius; ky <= radius; ky++ {
+						for kx := -radius; kx <= radius; kx++ {
+							nx, ny := x+kx, y+ky
+							if nx >= 0 && nx < width && ny >= 0 && ny < height && mask.At(nx, ny) < 1.0 && !src.transparent(src.offset(nx, ny)) {
+								window = append(window, src.Pix[src.offset(nx, ny)+c])
+							}
+						}
+					}
+					if len(window) > 0 {
+						dst.Pix[o+c] = medianOf(window)
+					}
+				}
+				remaining.Set(x, y, 0.0)
+			}
+		}
+	})
+
+	return dst.toNRGBA64(numWorkers), remaining
+}
+
+// findSpecks labels the 8-connected regions of a binary mask and marks those
+// with at most maxArea pixels.
+func findSpecks(mask Mask, maxArea int) *BitMask {
+	width, height := mask.Size()
+	visited := NewBitMask(width, height)
+	speck := NewBitMask(width, height)
+
+	var region, stack []image.Point
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if visited.At(x, y) == 1 || mask.At(x, y) < 1.0 {
+				continue
+			}
+
+			// Flood fill the region starting at (x, y)
+			region = region[:0]
+			stack = append(stack[:0], image.Pt(x, y))
+			visited.Set(x, y, 1)
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				region = append(region, p)
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := p.X+dx, p.Y+dy
+						if nx >= 0 && nx < width && ny >= 0 && ny < height && visited.At(nx, ny) == 0 && mask.At(nx, ny) >= 1.0 {
+							visited.Set(nx, ny, 1)
+							stack = append(stack, image.Pt(nx, ny))
+						}
+					}
+				}
+			}
+
+			if len(region) <= maxArea {
+				for _, p := range region {
+					speck.Set(p.X, p.Y, 1)
+				}
+			}
+		}
+	}
+	return speck
+}
@@ -0,0 +1,132 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// randomImage returns a 16-bit image of random colours, with some fully transparent pixels
+// when transparent is set.
+func randomImage(width, height int, transparent bool, seed int64) *image.NRGBA64 {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA64{uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), 0xffff}
+			if transparent && rng.Intn(5) == 0 {
+				c.A = 0
+			}
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestHistogramMedianMatchesSort(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		radius        int
+		transparent   bool
+		workers       int
+	}{
+		{"radius 1", 17, 13, 1, false, 1},
+		{"radius 2 with transparency", 17, 13, 2, true, 3},
+		{"radius 3", 23, 19, 3, false, 4},
+		{"radius 5 with transparency", 23, 19, 5, true, 2},
+		{"window wider than image", 5, 9, 6, false, 3},
+		{"more workers than rows", 11, 3, 3, true, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := toFloatImage(randomImage(tt.width, tt.height, tt.transparent, 1), 1)
+			got := histogramMedian(src, tt.radius, BorderDefault, tt.workers)
+
+			// Reference: sort every window
+			alpha := src.channel(3)
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					o := src.offset(x, y)
+					for c := 0; c < 3; c++ {
+						var window []float32
+						for ky := -tt.radius; ky <= tt.radius; ky++ {
+							for kx := -tt.radius; kx <= tt.radius; kx++ {
+								if alpha.sample(x+kx, y+ky, BorderDefault, 0) > 0 {
+									window = append(window, src.channel(c).sample(x+kx, y+ky, BorderDefault, 0))
+								}
+							}
+						}
+						want := src.Pix[o+c]
+						if len(window) > 0 {
+							want = medianOf(window)
+						}
+						if got.Pix[o+c] != want {
+							t.Fatalf("pixel (%d, %d) channel %d: got %v, want %v", x, y, c, got.Pix[o+c], want)
+						}
+					}
+					if got.Pix[o+3] != src.Pix[o+3] {
+						t.Fatalf("pixel (%d, %d): alpha changed", x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveMedian(t *testing.T) {
+	const size = 15
+	tests := []struct {
+		name      string
+		impulse   float32 // Value of the noisy pixel at the centre
+		maxRadius int
+		want      float32
+	}{
+		{"salt", 1, 3, 0.5},
+		{"pepper", 0, 3, 0.5},
+		{"detail kept", 0.505, 3, 0.505},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Gradient background, so the window is not flat and its median is reliable
+			src := newFloatImage(image.Rect(0, 0, size, size))
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					o := src.offset(x, y)
+					v := 0.5 + float32(x-size/2)*0.01
+					src.Pix[o], src.Pix[o+1], src.Pix[o+2], src.Pix[o+3] = v, v, v, 1
+				}
+			}
+			o := src.offset(size/2, size/2)
+			src.Pix[o], src.Pix[o+1], src.Pix[o+2] = tt.impulse, tt.impulse, tt.impulse
+
+			got := adaptiveMedian(src, tt.maxRadius, BorderDefault, 2)
+			for c := 0; c < 3; c++ {
+				if d := got.Pix[o+c] - tt.want; d < -1e-6 || d > 1e-6 {
+					t.Errorf("channel %d: got %v, want %v", c, got.Pix[o+c], tt.want)
+				}
+			}
+			// Pixels that are not impulses are left untouched
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					if i := src.offset(x, y); i != o && got.Pix[i] != src.Pix[i] {
+						t.Fatalf("pixel (%d, %d) changed from %v to %v", x, y, src.Pix[i], got.Pix[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMedianFilter(b *testing.B) {
+	src := toFloatImage(randomImage(256, 256, false, 1), 1)
+	for _, radius := range []int{1, 2, 3, 5, 8} {
+		b.Run(fmt.Sprintf("radius %d", radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				medianFilter(src, radius, BorderDefault, 4)
+			}
+		})
+	}
+}
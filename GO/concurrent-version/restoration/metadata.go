@@ -0,0 +1,335 @@
+package restoration
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+)
+
+// JPEG markers of the segments carried over from the source photo
+const (
+	markerSOI  = 0xd8
+	markerSOS  = 0xda
+	markerEOI  = 0xd9
+	markerAPP1 = 0xe1 // EXIF and XMP
+	markerAPP2 = 0xe2 // ICC profile
+	markerCOM  = 0xfe // Comment
+)
+
+// Identifiers at the start of the APP segments that are kept
+var (
+	exifHeader         = []byte("Exif\x00\x00")
+	xmpHeader          = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtensionHeader = []byte("http://ns.adobe.com/xmp/extension/\x00") // ExtendedXMP, the part of a packet too large for one segment
+	iccHeader          = []byte("ICC_PROFILE\x00")
+)
+
+// maxSegmentData is the largest payload of a JPEG marker segment, whose length field counts
+// itself.
+const maxSegmentData = 0xffff - 2
+
+// exifOrientationTag is the EXIF tag holding the orientation of the stored pixels.
+const exifOrientationTag = 0x0112
+
+// Metadata holds what LoadImageWithMetadata keeps from a file besides the pixels: its format,
+// the EXIF orientation and the raw EXIF, XMP, ICC profile and comments, so that they can be
+// written back into the restored JPEG or PNG. They are read from JPEG segments, the eXIf, iCCP,
+// iTXt and tEXt chunks of PNG files, the ICC and XMP tags of TIFF files, the ICCP, EXIF and XMP
+// chunks of WebP files and the profile of BMP files, and kept in the form of JPEG segments.
+type Metadata struct {
+	Format      Format // Format of the source file (FormatAuto for WebP, which cannot be written)
+	Orientation int    // EXIF orientation of the source (1 is upright); the loaded image is already rotated
+
+	segments []jpegSegment
+}
+
+// jpegSegment is a marker segment of a JPEG file, without its length.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// LoadImageWithMetadata loads an image like LoadImage and also returns its metadata.
+// The image is rotated and flipped upright according to its EXIF orientation.
+func LoadImageWithMetadata(imagePath string) (image.Image, *Metadata, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeBytes(data)
+}
+
+// DecodeImageWithMetadata decodes an image from a stream like DecodeImage and also returns its
+// metadata. The image is rotated and flipped upright according to its EXIF orientation.
+func DecodeImageWithMetadata(r io.Reader) (image.Image, *Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeBytes(data)
+}
+
+// decodeBytes decodes an encoded image held in memory and applies its EXIF orientation.
+func decodeBytes(data []byte) (image.Image, *Metadata, error) {
+	img, name, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta *Metadata
+	switch name {
+	case "jpeg":
+		meta = readMetadata(data)
+	case "png":
+		meta = readPNGMetadata(data)
+	case "tiff":
+		meta = readTIFFMetadata(data)
+	case "webp":
+		meta = readWebPMetadata(data)
+	case "bmp":
+		meta = readBMPMetadata(data)
+	default:
+		meta = &Metadata{Orientation: 1}
+	}
+	meta.Format, _ = ParseFormat(name)
+	return orient(img, meta.Orientation), meta, nil
+}
+
+// readMetadata collects the EXIF, XMP, ICC and comment segments in the header of a JPEG file.
+// Data that is not a JPEG, or a damaged header, gives the metadata read so far.
+func readMetadata(data []byte) *Metadata {
+	meta := &Metadata{Orientation: 1}
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return meta
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			pos++ // Fill byte
+			continue
+		case marker == markerSOS || marker == markerEOI:
+			return meta
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			pos += 2 // Markers without a segment
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if keepSegment(marker, segment) {
+			meta.add(marker, segment)
+		}
+		pos += 2 + length
+	}
+	return meta
+}
+
+// add appends a segment to the metadata, taking the orientation from EXIF segments.
+func (m *Metadata) add(marker byte, data []byte) {
+	m.segments = append(m.segments, jpegSegment{marker: marker, data: data})
+	if marker == markerAPP1 && bytes.HasPrefix(data, exifHeader) {
+		if orientation, _ := exifOrientation(data); orientation >= 1 && orientation <= 8 {
+			m.Orientation = orientation
+		}
+	}
+}
+
+// empty reports whether there is no metadata to write.
+func (m *Metadata) empty() bool {
+	return m == nil || len(m.segments) == 0
+}
+
+// keepSegment reports whether a header segment is copied into the restored JPEG.
+func keepSegment(marker byte, data []byte) bool {
+	switch marker {
+	case markerAPP1:
+		return bytes.HasPrefix(data, exifHeader) || bytes.HasPrefix(data, xmpHeader) ||
+			bytes.HasPrefix(data, xmpExtensionHeader)
+	case markerAPP2:
+		return bytes.HasPrefix(data, iccHeader)
+	case markerCOM:
+		return true
+	}
+	return false
+}
+
+// exifOrientation finds the orientation tag in the first IFD of an EXIF segment. It returns the
+// orientation and the offset of its value in the segment, or 0 and -1 when there is none.
+func exifOrientation(segment []byte) (orientation, offset int) {
+	tiff := segment[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0, -1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, -1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, -1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		// Tag, type (3 is SHORT), count and value
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:])), len(exifHeader) + entry + 8
+		}
+	}
+	return 0, -1
+}
+
+// orient turns an image upright according to its EXIF orientation (1 to 8).
+// Upright images are returned as they are.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rect := image.Rect(0, 0, width, height)
+	if orientation >= 5 {
+		rect = image.Rect(0, 0, height, width) // Rotated by a quarter turn
+	}
+	var dst draw.Image = image.NewNRGBA(rect)
+	if is16Bit(img) {
+		dst = image.NewNRGBA64(rect)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Mirrored along the main diagonal
+				dx, dy = y, x
+			case 6: // Stored rotated 90° counter-clockwise
+				dx, dy = height-1-y, x
+			case 7: // Mirrored along the anti-diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // Stored rotated 90° clockwise
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// metadataSegments builds the metadata segments and an optional history comment that
+// EncodeImage inserts right after the start marker of a JPEG. The EXIF orientation is reset to
+// 1, as the pixels are upright. XMP packets too large for one segment, as PNG, TIFF and WebP
+// files can hold, are written as ExtendedXMP; any other segment that does not fit is an error.
+func metadataSegments(meta *Metadata, history string) ([]byte, error) {
+	var header bytes.Buffer
+	if meta != nil {
+		for _, s := range meta.segments {
+			data := s.data
+			switch {
+			case s.marker == markerAPP1 && bytes.HasPrefix(data, exifHeader):
+				data = uprightExif(data)
+			case s.marker == markerAPP1 && bytes.HasPrefix(data, xmpHeader) && len(data) > maxSegmentData:
+				writeExtendedXMP(&header, data[len(xmpHeader):])
+				continue
+			}
+			if err := writeSegment(&header, s.marker, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if history != "" {
+		if err := writeSegment(&header, markerCOM, []byte(history)); err != nil {
+			return nil, err
+		}
+	}
+	return header.Bytes(), nil
+}
+
+// uprightExif returns a copy of an EXIF segment with its orientation reset to 1, or the segment
+// itself when it has no orientation.
+func uprightExif(data []byte) []byte {
+	_, offset := exifOrientation(data)
+	if offset < 0 {
+		return data
+	}
+	data = append([]byte(nil), data...)
+	order := binary.ByteOrder(binary.BigEndian)
+	if data[len(exifHeader)] == 'I' {
+		order = binary.LittleEndian
+	}
+	order.PutUint16(data[offset:], 1)
+	return data
+}
+
+// writeSegment writes a marker segment. Data that does not fit in a segment is an error.
+func writeSegment(buf *bytes.Buffer, marker byte, data []byte) error {
+	if len(data) > maxSegmentData {
+		return fmt.Errorf("%d bytes of metadata (marker %#x) do not fit in a JPEG segment of at most %d", len(data), marker, maxSegmentData)
+	}
+	buf.Write([]byte{0xff, marker})
+	binary.Write(buf, binary.BigEndian, uint16(len(data)+2))
+	buf.Write(data)
+	return nil
+}
+
+// writeExtendedXMP writes an XMP packet too large for one segment as ExtendedXMP (XMP
+// specification part 3): a small standard packet that only names the extension by the MD5 digest
+// of its content, followed by the whole packet, without its wrapper, cut into extension segments
+// that each give the digest, the full length and their offset.
+func writeExtendedXMP(buf *bytes.Buffer, packet []byte) {
+	// Strip the <?xpacket begin=...?> and <?xpacket end=...?> processing instructions
+	extended := bytes.TrimSpace(packet)
+	if bytes.HasPrefix(extended, []byte("<?xpacket begin=")) {
+		if end := bytes.Index(extended, []byte("?>")); end >= 0 {
+			extended = extended[end+2:]
+		}
+	}
+	if end := bytes.LastIndex(extended, []byte("<?xpacket end=")); end >= 0 {
+		extended = extended[:end]
+	}
+	extended = bytes.TrimSpace(extended)
+	guid := fmt.Sprintf("%X", md5.Sum(extended))
+
+	standard := fmt.Sprintf("%s<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>"+
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description rdf:about="" xmlns:xmpNote="http://ns.adobe.com/xmp/note/" xmpNote:HasExtendedXMP="%s"/>`+
+		`</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`, xmpHeader, guid)
+	writeSegment(buf, markerAPP1, []byte(standard))
+
+	// Identifier, digest, full length and offset, then the part of the packet
+	prefix := len(xmpExtensionHeader) + len(guid) + 8
+	for offset := 0; offset < len(extended); offset += maxSegmentData - prefix {
+		part := extended[offset:min(offset+maxSegmentData-prefix, len(extended))]
+		segment := append(append([]byte(nil), xmpExtensionHeader...), guid...)
+		segment = binary.BigEndian.AppendUint32(segment, uint32(len(extended)))
+		segment = binary.BigEndian.AppendUint32(segment, uint32(offset))
+		writeSegment(buf, markerAPP1, append(segment, part...))
+	}
+}
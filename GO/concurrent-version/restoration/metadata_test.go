@@ -0,0 +1,82 @@
+package restoration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	// Stored pixels:
+	//	a b c
+	//	d e f
+	stored := image.NewNRGBA64(image.Rect(0, 0, 3, 2))
+	for i, label := range "abcdef" {
+		stored.SetNRGBA64(i%3, i/3, color.NRGBA64{R: uint16(label), A: 0xffff})
+	}
+
+	tests := []struct {
+		orientation int
+		want        []string // Rows of the upright image
+	}{
+		{0, []string{"abc", "def"}}, // Missing tag
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+	}
+	for _, tt := range tests {
+		got := orient(stored, tt.orientation)
+		if _, ok := got.(*image.NRGBA64); !ok {
+			t.Errorf("orientation %d: result is %T, want 16-bit *image.NRGBA64", tt.orientation, got)
+		}
+		if got.Bounds() != image.Rect(0, 0, len(tt.want[0]), len(tt.want)) {
+			t.Fatalf("orientation %d: bounds %v", tt.orientation, got.Bounds())
+		}
+		for y, row := range tt.want {
+			for x, label := range row {
+				if r, _, _, _ := got.At(x, y).RGBA(); r != uint32(label) {
+					t.Errorf("orientation %d: pixel (%d, %d) is %q, want %q", tt.orientation, x, y, rune(r), label)
+				}
+			}
+		}
+	}
+}
+
+func TestReadOrientation(t *testing.T) {
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 6, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			// Insert the EXIF segment after the start marker
+			var header bytes.Buffer
+			writeSegment(&header, markerAPP1, exifSegment(orientation, order))
+			data := append(append(append([]byte(nil), plain.Bytes()[:2]...), header.Bytes()...), plain.Bytes()[2:]...)
+
+			img, meta, err := DecodeImageWithMetadata(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Orientation != orientation {
+				t.Errorf("%v orientation %d: read %d", order, orientation, meta.Orientation)
+			}
+			want := image.Rect(0, 0, 6, 4)
+			if orientation >= 5 {
+				want = image.Rect(0, 0, 4, 6)
+			}
+			if img.Bounds() != want {
+				t.Errorf("%v orientation %d: bounds %v, want %v", order, orientation, img.Bounds(), want)
+			}
+		}
+	}
+}
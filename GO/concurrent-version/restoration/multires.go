@@ -0,0 +1,96 @@
+package restoration
+
+import (
+	"image"
+)
+
+// InpaintCoarseToFine removes the damage marked in mask on a Gaussian pyramid of opts.PyramidLevels levels.
+// The coarsest level is repaired first with the usual edge detection, feathering and inpainting
+// stages. Every finer level then starts from the upsampled result of the level below: damaged
+// pixels are pre-filled with it, so large holes get a plausible colour, and the same stages refine
+// the hole borders with the detail available at that resolution. The feather radius is scaled
+// down with the level so it covers the same area of the photo.
+func InpaintCoarseToFine(img image.Image, mask Mask, opts Options) *image.NRGBA64 {
+	opts = opts.withBorder()
+	numWorkers := opts.NumWorkers
+	src := toFloatImage(img, numWorkers)
+	if opts.LinearLight {
+		src = linearize(src, numWorkers) // Downsample and upsample in linear light
+	}
+	pyramid := buildPyramid(src, opts.PyramidLevels, opts.Border, numWorkers)
+
+	// Max-pool the mask so thin scratches stay visible at coarse levels
+	masks := []Mask{denseMask(mask)}
+	for len(masks) < len(pyramid) {
+		masks = append(masks, downsampleMask(masks[len(masks)-1]))
+	}
+
+	var restored *image.NRGBA64
+	for level := len(pyramid) - 1; level >= 0; level-- {
+		current := pyramid[level]
+		if restored != nil {
+			// Propagate the coarser result into the damaged pixels of this level
+			coarse := toFloatImage(restored, numWorkers)
+			if opts.LinearLight {
+				coarse = linearize(coarse, numWorkers)
+			}
+			guess := resizeFloatImage(coarse, current.Rect, numWorkers)
+			current = fillMasked(current, guess, masks[level], numWorkers)
+		}
+
+		// repairDamage works on encoded values and blends in linear light itself
+		if opts.LinearLight {
+			current = delinearize(current, numWorkers)
+		}
+		featherRadius := max(1, opts.FeatherRadius>>level)
+		restored = repairDamage(current.toNRGBA64(numWorkers), masks[level], featherRadius, opts)
+	}
+	return restored
+}
+
+// downsampleMask halves a binary mask, marking a coarse pixel as damaged if any of its
+// 2x2 source pixels is.
+func downsampleMask(mask Mask) *BitMask {
+	srcWidth, srcHeight := mask.Size()
+	width, height := (srcWidth+1)/2, (srcHeight+1)/2
+	out := NewBitMask(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					sy, sx := 2*y+dy, 2*x+dx
+					if sy < srcHeight && sx < srcWidth && mask.At(sx, sy) > out.At(x, y) {
+						out.Set(x, y, mask.At(sx, sy))
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// fillMasked returns a copy of src where the colour of every damaged pixel (mask 1) is taken from guess.
+func fillMasked(src, guess *floatImage, mask Mask, numWorkers int) *floatImage {
+	dst := newFloatImage(src.Rect)
+	copy(dst.Pix, src.Pix)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < src.Width; x++ {
+				if mask.At(x, y) >= 1.0 {
+					o := src.offset(x, y)
+					copy(dst.Pix[o:o+3], guess.Pix[o:o+3])
+				}
+			}
+		}
+	})
+	return dst
+}
+
+// resizeFloatImage resamples a working copy to the size of bounds with bilinear interpolation.
+func resizeFloatImage(src *floatImage, bounds image.Rectangle, numWorkers int) *floatImage {
+	dst := newFloatImage(bounds)
+	for c := 0; c < 4; c++ {
+		resizePlane(dst.channel(c), src.channel(c), numWorkers)
+	}
+	return dst
+}
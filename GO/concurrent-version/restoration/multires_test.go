@@ -0,0 +1,103 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// holePhoto returns a smooth colour ramp and a copy with a square hole painted white, together
+// with the mask of the hole.
+func holePhoto(size, hole int) (clean, damaged *image.NRGBA64, mask *BitMask) {
+	clean = image.NewNRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			clean.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(0x2000 + 0x8000*x/size),
+				G: uint16(0x6000 + 0x4000*y/size),
+				B: 0x4000,
+				A: 0xffff,
+			})
+		}
+	}
+	damaged = image.NewNRGBA64(clean.Rect)
+	copy(damaged.Pix, clean.Pix)
+	mask = NewBitMask(size, size)
+	start := (size - hole) / 2
+	for y := start; y < start+hole; y++ {
+		for x := start; x < start+hole; x++ {
+			damaged.SetNRGBA64(x, y, color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+			mask.Set(x, y, 1)
+		}
+	}
+	return clean, damaged, mask
+}
+
+// holeError returns the mean absolute difference from the clean photo inside the hole, on the 0-1 scale.
+func holeError(got image.Image, clean *image.NRGBA64, mask *BitMask) float64 {
+	var sum, n float64
+	width, height := mask.Size()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if mask.At(x, y) == 0 {
+				continue
+			}
+			g := color.NRGBA64Model.Convert(got.At(x, y)).(color.NRGBA64)
+			w := clean.NRGBA64At(x, y)
+			sum += math.Abs(float64(g.R)-float64(w.R)) + math.Abs(float64(g.G)-float64(w.G)) + math.Abs(float64(g.B)-float64(w.B))
+			n += 3
+		}
+	}
+	return sum / n / 0xffff
+}
+
+// A hole much wider than the inpainting radius keeps its damaged colour in the middle at a
+// single scale; coarse to fine fills it from the coarse levels, where it is small.
+func TestCoarseToFineFillsLargeHoles(t *testing.T) {
+	clean, damaged, mask := holePhoto(96, 32)
+	opts := testOptions()
+	opts.PyramidLevels = 4
+
+	single := repairDamage(damaged, mask, opts.FeatherRadius, opts)
+	coarse := InpaintCoarseToFine(damaged, mask, opts)
+	singleErr, coarseErr := holeError(single, clean, mask), holeError(coarse, clean, mask)
+	if coarseErr > singleErr/4 {
+		t.Errorf("mean error in the hole %.4f coarse to fine, want under a quarter of %.4f at a single scale", coarseErr, singleErr)
+	}
+	if coarseErr > 0.05 {
+		t.Errorf("mean error in the hole %.4f coarse to fine, want a fill close to the ramp", coarseErr)
+	}
+
+	// Pixels outside the hole are only touched by the final smoothing, which keeps a ramp
+	for _, p := range []image.Point{{2, 2}, {90, 10}, {10, 90}} {
+		g := coarse.NRGBA64At(p.X, p.Y)
+		w := clean.NRGBA64At(p.X, p.Y)
+		if math.Abs(float64(g.R)-float64(w.R)) > 0x200 {
+			t.Errorf("clean pixel %v changed from %v to %v", p, w, g)
+		}
+	}
+}
+
+func TestDownsampleMaskKeepsThinScratches(t *testing.T) {
+	mask := NewBitMask(9, 5)
+	for y := 0; y < 5; y++ {
+		mask.Set(3, y, 1) // One-pixel-wide vertical scratch
+	}
+	mask.Set(8, 4, 1) // Speck in the last, odd-sized corner
+	coarse := downsampleMask(mask)
+	if width, height := coarse.Size(); width != 5 || height != 3 {
+		t.Fatalf("coarse mask is %dx%d, want 5x3", width, height)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			want := 0.0
+			if x == 1 || x == 4 && y == 2 {
+				want = 1
+			}
+			if got := coarse.At(x, y); got != want {
+				t.Errorf("coarse pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// StructureTensor holds the dominant local orientation of an image, obtained by smoothing
+// the outer product of the gradient with a Gaussian.
+type StructureTensor struct {
+	Orientation *FloatMask // Isophote (edge) direction in radians, in [-pi/2, pi/2]
+	Coherence   *FloatMask // How strongly oriented the neighbourhood is, from 0 (flat or noisy) to 1 (single edge)
+}
+
+// StructureTensorConcurrent computes the smoothed structure tensor of an image from the gradients
+// of the edge operator, grayscale conversion and border mode of opts (the Laplacian of Gaussian
+// has no gradient and falls back to Sobel).
+// Pixels where mask is 1 (damaged) do not contribute: the tensor is averaged only over
+// valid pixels, so the orientation inside a scratch is interpolated from its surroundings
+// instead of following the scratch itself. Fully transparent pixels are not valid either.
+// mask may be nil.
+func StructureTensorConcurrent(img image.Image, mask Mask, sigma float64, opts EdgeOptions, numWorkers int) StructureTensor {
+	src := toFloatImage(img, numWorkers)
+	width, height := src.Width, src.Height
+	gx, gy := gradients(grayPlane(src, opts.Gray, numWorkers), opts.Operator, opts.Border, numWorkers)
+	if mask != nil {
+		mask = denseMask(mask)
+	}
+
+	// Tensor components weighted by pixel validity
+	jxx, jxy, jyy := newPlane(width, height), newPlane(width, height), newPlane(width, height)
+	valid := newPlane(width, height)
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				w := float32(1)
+				if mask != nil {
+					w = float32(1 - math.Min(mask.At(x, y), 1))
+				}
+				if src.transparent(src.offset(x, y)) {
+					w = 0
+				}
+				dx, dy := gx.at(x, y), gy.at(x, y)
+				jxx.set(x, y, w*dx*dx)
+				jxy.set(x, y, w*dx*dy)
+				jyy.set(x, y, w*dy*dy)
+				valid.set(x, y, w)
+			}
+		}
+	})
+
+	// Smooth every component (normalised convolution)
+	jxx = gaussianBlurPlane(jxx, sigma, opts.Border, numWorkers)
+	jxy = gaussianBlurPlane(jxy, sigma, opts.Border, numWorkers)
+	jyy = gaussianBlurPlane(jyy, sigma, opts.Border, numWorkers)
+	valid = gaussianBlurPlane(valid, sigma, opts.Border, numWorkers)
+
+	tensor := StructureTensor{
+		Orientation: NewFloatMask(width, height),
+		Coherence:   NewFloatMask(width, height),
+	}
+
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				w := float64(valid.at(x, y))
+				if w < 1e-6 {
+					continue // No valid pixel nearby: no preferred orientation
+				}
+				a := float64(jxx.at(x, y)) / w
+				b := float64(jxy.at(x, y)) / w
+				c := float64(jyy.at(x, y)) / w
+
+				// Dominant gradient angle; isophotes are perpendicular to it
+				gradientAngle := 0.5 * math.Atan2(2*b, a-c)
+				isophote := gradientAngle + math.Pi/2
+				if isophote > math.Pi/2 {
+					isophote -= math.Pi
+				}
+				tensor.Orientation.Set(x, y, isophote)
+
+				// Coherence from the eigenvalue difference
+				trace := a + c
+				if trace > 1e-12 {
+					diff := math.Sqrt((a-c)*(a-c) + 4*b*b)
+					tensor.Coherence.Set(x, y, (diff/trace)*(diff/trace))
+				}
+			}
+		}
+	})
+	return tensor
+}
+
+// GetBlendedColorAlongIsophotes computes a blended color like GetBlendedColorWithEdges, but
+// prefers neighbours lying along the local isophote direction, so lines crossing a damaged
+// area are continued instead of being averaged away. The preference grows with the coherence
+// of the structure tensor; in flat areas the weighting falls back to plain distance.
+func GetBlendedColorAlongIsophotes(img image.Image, mask Mask, edges Mask, tensor StructureTensor, x, y int) color.Color {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	maxRadius := 5
+
+	theta := tensor.Orientation.At(x, y)
+	coherence := tensor.Coherence.At(x, y)
+	cosT, sinT := math.Cos(theta), math.Sin(theta)
+
+	var sum blendSum
+	for dy := -maxRadius; dy <= maxRadius; dy++ {
+		for dx := -maxRadius; dx <= maxRadius; dx++ {
+			nx, ny := x+dx, y+dy
+			if nx < 0 || nx >= width || ny < 0 || ny >= height || mask.At(nx, ny) >= 1.0 {
+				continue
+			}
+			distance := math.Sqrt(float64(dx*dx + dy*dy))
+
+			// Alignment of the offset with the isophote, sharpened so only close angles count
+			alignment := 1.0
+			if distance > 0 {
+				alignment = (float64(dx)*cosT + float64(dy)*sinT) / distance
+				alignment *= alignment
+				alignment *= alignment
+			}
+			directional := (1 - coherence) + coherence*alignment
+
+			// Edge pixels along the isophote are the line being continued, so they are not penalised
+			edgeWeight := 1.0 - edges.At(nx, ny)*(1-alignment)
+
+			// As in GetBlendedColorWithEdges, a partially masked pixel mostly keeps its own colour
+			weight := directional * edgeWeight / (distance + 1e-6)
+			sum.add(img.At(bounds.Min.X+nx, bounds.Min.Y+ny), weight)
+		}
+	}
+
+	// Avoid division by zero
+	blended, ok := sum.color(alphaAt(img, bounds.Min.X+x, bounds.Min.Y+y))
+	if !ok {
+		return img.At(bounds.Min.X+x, bounds.Min.Y+y)
+	}
+	return blended
+}
+
+// InpaintAlongIsophotesByChunks inpaints the masked pixels with GetBlendedColorAlongIsophotes,
+// processing tiles in parallel, and applies the same final smoothing as InpaintByChunks.
+func InpaintAlongIsophotesByChunks(img image.Image, mask Mask, edges Mask, tensor StructureTensor, border BorderMode, numWorkers int) *image.NRGBA64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	output := image.NewNRGBA64(bounds)
+
+	parallelTiles(width, height, 64, numWorkers, func(xStart, xEnd, yStart, yEnd int) {
+		for y := yStart; y < yEnd; y++ {
+			for x := xStart; x < xEnd; x++ {
+				px, py := bounds.Min.X+x, bounds.Min.Y+y
+				if mask.At(x, y) > 0 {
+					output.Set(px, py, GetBlendedColorAlongIsophotes(img, mask, edges, tensor, x, y))
+				} else {
+					output.Set(px, py, img.At(px, py))
+				}
+			}
+		}
+	})
+
+	return SmoothImageConcurrent(output, border, numWorkers) // Apply final smoothing step
+}
@@ -0,0 +1,79 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// linePhoto returns a gray image with a dark line through it; dx, dy is the direction of the line.
+func linePhoto(size, dx, dy int) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, size, size))
+	c := size / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			// Distance from the line through the centre
+			d := math.Abs(float64((x-c)*dy-(y-c)*dx)) / math.Hypot(float64(dx), float64(dy))
+			v := uint16(0xc000)
+			if d < 1.5 {
+				v = 0x2000
+			}
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+		}
+	}
+	return img
+}
+
+func TestStructureTensorFollowsLine(t *testing.T) {
+	const size = 41
+	tests := []struct {
+		name   string
+		dx, dy int
+		want   float64 // Isophote angle
+	}{
+		{"horizontal", 1, 0, 0},
+		{"vertical", 0, 1, math.Pi / 2},
+		{"diagonal", 1, 1, math.Pi / 4},
+		{"anti-diagonal", 1, -1, -math.Pi / 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := linePhoto(size, tt.dx, tt.dy)
+
+			// Damage a stretch of the line: its orientation comes from the rest of the line
+			mask := NewBitMask(size, size)
+			c := size / 2
+			for y := c - 3; y <= c+3; y++ {
+				for x := c - 3; x <= c+3; x++ {
+					mask.Set(x, y, 1)
+				}
+			}
+
+			for _, op := range []EdgeOperator{OperatorSobel, OperatorScharr} {
+				opts := DefaultEdgeOptions()
+				opts.Operator = op
+				tensor := StructureTensorConcurrent(img, mask, 3, opts, 3)
+
+				// Angles are defined modulo pi
+				diff := math.Abs(tensor.Orientation.At(c, c) - tt.want)
+				diff = math.Min(diff, math.Pi-diff)
+				if diff > 0.05 {
+					t.Errorf("operator %v: orientation %.3f at the centre, want %.3f", op, tensor.Orientation.At(c, c), tt.want)
+				}
+				if coherence := tensor.Coherence.At(c, c); coherence < 0.9 {
+					t.Errorf("operator %v: coherence %.3f at the centre, want a single orientation", op, coherence)
+				}
+			}
+		})
+	}
+
+	// A flat image has no orientation
+	flat := image.NewNRGBA64(image.Rect(0, 0, 16, 16))
+	tensor := StructureTensorConcurrent(flat, nil, 3, DefaultEdgeOptions(), 2)
+	for i, v := range tensor.Coherence.Pix {
+		if v != 0 {
+			t.Fatalf("flat image: coherence %v at pixel %d, want 0", v, i)
+		}
+	}
+}
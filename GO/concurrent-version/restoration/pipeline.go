@@ -0,0 +1,386 @@
+package restoration
+
+import (
+	"errors"
+	"image"
+	"strings"
+	"time"
+)
+
+// NoiseFilter selects the median-based filter run before mask creation.
+type NoiseFilter int
+
+const (
+	NoiseFilterNone           NoiseFilter = iota // No median filtering
+	NoiseFilterMedian                            // Plain median filter
+	NoiseFilterAdaptiveMedian                    // Adaptive median filter, only replaces impulses
+)
+
+// SharpenMode selects the sharpener used in the final smoothing step.
+type SharpenMode int
+
+const (
+	SharpenKernel  SharpenMode = iota // Fixed 3x3 sharpening kernel
+	SharpenUnsharp                    // Luminance unsharp mask with radius, amount and threshold
+)
+
+// EdgeSource selects the edge detector whose map guides feathering and inpainting.
+type EdgeSource int
+
+const (
+	EdgeSourceGradient   EdgeSource = iota // Normalised gradient magnitude with a cut-off (Options.EdgeOptions)
+	EdgeSourceCanny                        // Thin Canny edges with hysteresis
+	EdgeSourceMultiScale                   // Gradient responses combined across a Gaussian pyramid
+)
+
+// ColorCorrection selects the contrast and colour correction applied after inpainting.
+type ColorCorrection int
+
+const (
+	ColorCorrectionHistEqual ColorCorrection = iota // Global histogram equalisation of each channel
+	ColorCorrectionCLAHE                            // Contrast limited adaptive histogram equalisation
+	ColorCorrectionNone                             // No contrast correction
+)
+
+// Options selects the optional stages of the restoration pipeline and their settings.
+type Options struct {
+	NumWorkers    int    // Number of goroutines used by every stage
+	MaskPath      string // Where the debug scratch mask is written (empty to skip it)
+	FeatherRadius int    // Radius used to feather the scratch mask
+	PyramidLevels int    // Pyramid levels for coarse-to-fine inpainting (0 or 1 inpaints at full resolution only)
+	LinearLight   bool   // Run inpainting and the final blur in linear light instead of on gamma-encoded values
+
+	Border BorderMode // How filters read pixels outside the image, unless their own options choose (BorderDefault clamps)
+
+	CompactWeights bool // Store the edge and feathered weight maps with 8 bits per pixel instead of float32
+
+	Profile       *ICCProfile   // Colour profile of the input (nil for sRGB), see ProfileToWorkingConcurrent
+	OutputProfile OutputProfile // Profile the result is converted to when Profile is set
+
+	PreserveToning bool // Detect monochrome and sepia prints, process them as luminance and re-apply their toning
+
+	Denoise bool           // Run non-local means denoising before mask creation
+	NLMeans NLMeansOptions // Settings for the denoising stage
+
+	NoiseFilter  NoiseFilter // Median filter run before denoising, for salt-and-pepper dust
+	MedianRadius int         // Radius (maximum radius for the adaptive filter) of the median filter
+
+	DustMaxArea int // Mask regions up to this many pixels are repaired with a median instead of inpainting (0 disables)
+	DustRadius  int // Radius of the neighbourhood used to repair dust specks
+
+	Edges       EdgeSource   // Edge detector used to guide feathering and inpainting
+	EdgeOptions EdgeOptions  // Operator, grayscale conversion and cut-off of the gradient edge source
+	Canny       CannyOptions // Settings for the Canny edge detector
+	EdgeLevels  int          // Pyramid levels used by the multi-scale edge source
+
+	FollowIsophotes bool    // Inpaint along the local isophote direction to reconnect lines across scratches
+	TensorSigma     float64 // Smoothing of the structure tensor used to find isophotes
+
+	AdjustLevels  bool          // Run the per-channel levels and curves stage for faded dye layers
+	LevelsOptions LevelsOptions // Black and white points, gamma and tone curves of that stage
+
+	WhiteBalance WhiteBalanceOptions // Colour cast removal run before contrast correction
+
+	ColorCorrection ColorCorrection // Contrast and colour correction step
+	CLAHE           CLAHEOptions    // Tile grid and clip limit of adaptive equalisation
+	EqualizeSpace   ColorSpace      // Colour space whose lightness is equalised (RGB equalises every channel)
+
+	Transfer  TransferMethod // Colour transfer from Reference, run after contrast correction
+	Reference image.Image    // Reference photo whose colours are transferred, e.g. another print of the album; taken as sRGB
+
+	Sharpen SharpenMode        // Sharpener applied after the final blur
+	Unsharp UnsharpMaskOptions // Settings for the unsharp mask sharpener
+}
+
+// DefaultOptions returns the settings used by the command line tool and the server.
+func DefaultOptions(numWorkers int) Options {
+	return Options{
+		NumWorkers:    numWorkers,
+		FeatherRadius: 5,
+		NLMeans:       DefaultNLMeansOptions(),
+		MedianRadius:  2,
+		DustRadius:    3,
+		EdgeOptions:   DefaultEdgeOptions(),
+		Canny:         DefaultCannyOptions(),
+		EdgeLevels:    3,
+		TensorSigma:   3,
+		LevelsOptions: DefaultLevelsOptions(),
+		WhiteBalance:  DefaultWhiteBalanceOptions(),
+		CLAHE:         DefaultCLAHEOptions(),
+		Unsharp:       DefaultUnsharpMaskOptions(),
+	}
+}
+
+// Result is the restored image together with what the pipeline measured on the way.
+type Result struct {
+	Image  image.Image    // Restored image
+	Cast   ColorCast      // Colour cast removed by white balancing (NeutralCast when disabled)
+	Toning ToningAnalysis // Detected toning (ToningColor when detection is disabled)
+}
+
+// Restore runs the full restoration pipeline on an image:
+// optional median filtering and denoising, scratch mask creation, dust speck repair,
+// edge detection, feathering, inpainting, levels and curves, white balance, colour correction,
+// colour transfer and final smoothing. With PreserveToning, monochrome and sepia prints run through the
+// pipeline as gray luminance and get their original toning back at the end, so the colour
+// stages cannot introduce false colour noise.
+// Alpha is carried through every stage and fully transparent pixels are left out of the mask,
+// the statistics and the inpainting; 8-bit inputs with transparency come back as *image.NRGBA.
+// Inputs with a colour profile are processed in the linear Rec. 2020 working space, every colour
+// conversion using its primaries, and converted back at the end.
+func Restore(img image.Image, opts Options) (*Result, error) {
+	numWorkers := opts.NumWorkers
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	opts = opts.withBorder()
+	input := img
+	result := &Result{Cast: NeutralCast}
+	rgb := rgbSpaceOf(opts)
+
+	// Move tagged scans into the working space
+	if opts.Profile != nil {
+		img = ProfileToWorkingConcurrent(img, opts.Profile, numWorkers)
+	}
+
+	// Strip the toning of monochrome and sepia prints
+	if opts.PreserveToning {
+		result.Toning = detectToning(img, rgb, numWorkers)
+		if result.Toning.Kind != ToningColor {
+			img = desaturate(img, rgb, numWorkers)
+		}
+	}
+
+	// Remove dust and film grain first so they are not mistaken for scratches
+	img = filterNoise(img, opts)
+
+	// Create the mask in chunks
+	damage, err := CreateMaskByChunks(img, opts.MaskPath, numWorkers)
+	if err != nil {
+		return nil, err
+	}
+	var mask Mask = damage
+
+	// Isolated dust specks are repaired with a median, the rest is left to the inpainter
+	if opts.DustMaxArea > 0 {
+		img, mask = RepairDustConcurrent(img, mask, opts.DustMaxArea, opts.DustRadius, numWorkers)
+	}
+	mask = SparseMask(mask) // Mostly clean photos only keep the runs of damaged pixels
+
+	// Remove the scratches, coarse to fine on a pyramid or at full resolution
+	var restoredImg *image.NRGBA64
+	if opts.PyramidLevels > 1 {
+		restoredImg = InpaintCoarseToFine(img, mask, opts)
+	} else {
+		restoredImg = repairDamage(img, mask, opts.FeatherRadius, opts)
+	}
+
+	// Stretch every faded dye layer between its own black and white point
+	if opts.AdjustLevels {
+		restoredImg = LevelsConcurrent(restoredImg, opts.LevelsOptions, numWorkers)
+	}
+
+	// Remove the colour cast of faded prints
+	if opts.WhiteBalance.Method != WhiteBalanceNone {
+		restoredImg, result.Cast = WhiteBalanceConcurrent(restoredImg, opts.WhiteBalance, numWorkers)
+	}
+
+	// Apply color correction (histogram equalization)
+	var colorCorrectedImg *image.NRGBA64
+	switch {
+	case opts.ColorCorrection == ColorCorrectionNone:
+		colorCorrectedImg = restoredImg
+	case opts.ColorCorrection == ColorCorrectionCLAHE:
+		colorCorrectedImg = claheLightness(restoredImg, opts.CLAHE, opts.EqualizeSpace, rgb, numWorkers)
+	case opts.EqualizeSpace != ColorSpaceRGB:
+		colorCorrectedImg = histEqualLightness(restoredImg, opts.EqualizeSpace, rgb, numWorkers)
+	default:
+		colorCorrectedImg = HistEqualConcurrent(restoredImg, numWorkers)
+	}
+
+	// Match the colours of the reference photo
+	switch opts.Transfer {
+	case TransferReinhard:
+		colorCorrectedImg = colorTransfer(colorCorrectedImg, workingReference(opts), rgb, numWorkers)
+	case TransferHistogram:
+		colorCorrectedImg = HistogramMatchConcurrent(colorCorrectedImg, workingReference(opts), numWorkers)
+	}
+
+	// Post-process for sharpening and smoothing
+	result.Image = finalSmoothing(colorCorrectedImg, opts)
+
+	// Give monochrome and sepia prints their toning back
+	if result.Toning.Kind != ToningColor {
+		result.Image = applyToning(result.Image, result.Toning, rgb, numWorkers)
+	}
+
+	if opts.Profile != nil {
+		result.Image = ProfileFromWorkingConcurrent(result.Image, opts.Profile, opts.OutputProfile, numWorkers)
+	}
+
+	// Keep 8-bit transparent inputs 8-bit, as NRGBA like the PNGs they come from
+	if hasAlpha(input) && !is16Bit(input) {
+		result.Image = toFloatImage(result.Image, numWorkers).toNRGBA(numWorkers)
+	}
+	return result, nil
+}
+
+// checkOptions rejects options the pipeline cannot run with.
+func checkOptions(opts Options) error {
+	if opts.Transfer != TransferNone && opts.Reference == nil {
+		return errors.New("colour transfer needs a reference image")
+	}
+	if opts.Denoise {
+		if err := opts.NLMeans.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withBorder gives the stage options whose border mode is BorderDefault the border mode of the pipeline.
+func (o Options) withBorder() Options {
+	o.NLMeans.Border = o.NLMeans.Border.or(o.Border)
+	o.EdgeOptions.Border = o.EdgeOptions.Border.or(o.Border)
+	o.Canny.Border = o.Canny.Border.or(o.Border)
+	o.Unsharp.Border = o.Unsharp.Border.or(o.Border)
+	return o
+}
+
+// rgbSpaceOf returns the space the stages of Restore work in for the given options.
+func rgbSpaceOf(opts Options) *rgbSpace {
+	if opts.Profile != nil {
+		return workingSpace
+	}
+	return srgbSpace
+}
+
+// workingReference returns the reference photo of the colour transfer in the space the pipeline
+// works in. The reference is taken to be sRGB.
+func workingReference(opts Options) image.Image {
+	if opts.Profile == nil {
+		return opts.Reference
+	}
+	return ProfileToWorkingConcurrent(opts.Reference, srgbProfile, opts.NumWorkers)
+}
+
+// filterNoise runs the optional median filter, for salt-and-pepper dust, and the
+// non-local means denoiser, for film grain.
+func filterNoise(img image.Image, opts Options) image.Image {
+	numWorkers := opts.NumWorkers
+	switch opts.NoiseFilter {
+	case NoiseFilterMedian:
+		img = MedianFilterConcurrent(img, opts.MedianRadius, opts.Border, numWorkers)
+	case NoiseFilterAdaptiveMedian:
+		img = AdaptiveMedianFilterConcurrent(img, opts.MedianRadius, opts.Border, numWorkers)
+	}
+	if opts.Denoise {
+		img = NLMeansDenoiseConcurrent(img, opts.NLMeans, numWorkers)
+	}
+	return img
+}
+
+// finalSmoothing applies the final blur and the selected sharpener.
+func finalSmoothing(img image.Image, opts Options) *image.NRGBA64 {
+	numWorkers := opts.NumWorkers
+	if opts.Sharpen == SharpenUnsharp {
+		blurredImage := inLinearLight(img, opts, func(src image.Image) *image.NRGBA64 {
+			return GaussianBlurConcurrent(src, 3, 0.5, opts.Border, numWorkers)
+		})
+		sharpened := unsharpMask(toFloatImage(blurredImage, numWorkers), opts.Unsharp, rgbSpaceOf(opts), numWorkers)
+		return sharpened.toNRGBA64(numWorkers) // Threshold tuned for encoded values
+	}
+	return inLinearLight(img, opts, func(src image.Image) *image.NRGBA64 {
+		return ApplySmoothing(src, opts.Border, numWorkers)
+	})
+}
+
+// repairDamage runs edge detection, mask feathering and inpainting on one image.
+// Edges are found on the encoded image; with opts.LinearLight the colours are blended in linear light.
+func repairDamage(img image.Image, mask Mask, featherRadius int, opts Options) *image.NRGBA64 {
+	numWorkers := opts.NumWorkers
+	mask = denseMask(mask) // Feathering and the structure tensor read the mask at every pixel
+
+	// Edge mask for blending
+	var edgeMask Mask
+	switch opts.Edges {
+	case EdgeSourceCanny:
+		edgeMask = CannyEdgeDetectionConcurrent(img, opts.Canny, numWorkers)
+	case EdgeSourceMultiScale:
+		edgeMask = compactWeights(MultiScaleEdgeDetection(img, opts.EdgeLevels, opts.EdgeOptions, numWorkers), opts)
+	default:
+		edgeMask = compactWeights(EdgeDetectionWithOptions(img, opts.EdgeOptions, numWorkers), opts)
+	}
+
+	// Feather the mask
+	featheredMask := compactWeights(FeatherMaskConcurrent(mask, featherRadius, edgeMask, numWorkers), opts)
+
+	// Apply scratch removal in chunks
+	if opts.FollowIsophotes {
+		tensor := StructureTensorConcurrent(img, mask, opts.TensorSigma, opts.EdgeOptions, numWorkers)
+		return inLinearLight(img, opts, func(src image.Image) *image.NRGBA64 {
+			return InpaintAlongIsophotesByChunks(src, featheredMask, edgeMask, tensor, opts.Border, numWorkers)
+		})
+	}
+	return inLinearLight(img, opts, func(src image.Image) *image.NRGBA64 {
+		return InpaintByChunks(src, featheredMask, edgeMask, opts.Border, numWorkers)
+	})
+}
+
+// compactWeights quantises a weight map to 8 bits per pixel when opts.CompactWeights is set.
+func compactWeights(weights *FloatMask, opts Options) Mask {
+	if !opts.CompactWeights {
+		return weights
+	}
+	return toByteMask(weights, opts.NumWorkers)
+}
+
+// HistoryNote describes the restoration applied with opts, for the comment that
+// EncodeOptions.History adds to the restored JPEG.
+func HistoryNote(opts Options, result *Result, when time.Time) string {
+	var stages []string
+	if result.Toning.Kind != ToningColor {
+		stages = append(stages, "preserved "+result.Toning.Kind.String()+" toning")
+	}
+	switch opts.NoiseFilter {
+	case NoiseFilterMedian:
+		stages = append(stages, "median filter")
+	case NoiseFilterAdaptiveMedian:
+		stages = append(stages, "adaptive median filter")
+	}
+	if opts.Denoise {
+		stages = append(stages, "non-local means denoising")
+	}
+	if opts.DustMaxArea > 0 {
+		stages = append(stages, "dust repair")
+	}
+	inpainting := "scratch inpainting"
+	if opts.FollowIsophotes {
+		inpainting += " along isophotes"
+	}
+	if opts.LinearLight {
+		inpainting += " in linear light"
+	}
+	stages = append(stages, inpainting)
+	if opts.AdjustLevels {
+		stages = append(stages, "levels")
+	}
+	if opts.WhiteBalance.Method != WhiteBalanceNone {
+		stages = append(stages, "white balance ("+result.Cast.String()+")")
+	}
+	switch opts.ColorCorrection {
+	case ColorCorrectionCLAHE:
+		stages = append(stages, "CLAHE")
+	case ColorCorrectionHistEqual:
+		stages = append(stages, "histogram equalisation")
+	}
+	if opts.Transfer != TransferNone {
+		stages = append(stages, "colour transfer")
+	}
+	if opts.Sharpen == SharpenUnsharp {
+		stages = append(stages, "unsharp mask")
+	} else {
+		stages = append(stages, "sharpening")
+	}
+	return "Restored " + when.Format("2006-01-02 15:04:05") + ": " + strings.Join(stages, ", ")
+}
@@ -0,0 +1,171 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// scratchedPhoto returns a dark 16-bit test photo with smooth gradients and a few bright
+// scratches, which the mask stage marks as damage.
+func scratchedPhoto(width, height int) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(0x2000 + 0x3000*x/width),
+				G: uint16(0x1800 + 0x3000*y/height),
+				B: uint16(0x2800 + 0x1000*(x+y)/(width+height)),
+				A: 0xffff,
+			})
+		}
+	}
+	white := color.NRGBA64{0xffff, 0xfff0, 0xffe0, 0xffff}
+	for i := 0; i < height; i++ {
+		img.SetNRGBA64(width/3+i/4, i, white) // Slanted scratch
+	}
+	for x := 0; x < width; x++ {
+		img.SetNRGBA64(x, height/2, white) // Horizontal scratch
+	}
+	img.SetNRGBA64(width-5, 3, white) // Dust speck
+	return img
+}
+
+// testOptions returns the default options, run on three workers.
+func testOptions() Options {
+	return DefaultOptions(3)
+}
+
+// sameImages reports the first pixel where two images differ, comparing local coordinates.
+func sameImages(t *testing.T, got, want image.Image) {
+	t.Helper()
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Dx() != wb.Dx() || gb.Dy() != wb.Dy() {
+		t.Fatalf("size %v, want %v", gb.Size(), wb.Size())
+	}
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			g := color.NRGBA64Model.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			w := color.NRGBA64Model.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			if g != w {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestRestoreSubImage(t *testing.T) {
+	photo := scratchedPhoto(64, 48)
+	rect := image.Rect(11, 7, 53, 41)
+
+	// The same pixels copied into an image starting at (0, 0)
+	crop := image.NewNRGBA64(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(crop, crop.Bounds(), photo, rect.Min, draw.Src)
+
+	for _, isophotes := range []bool{false, true} {
+		opts := testOptions()
+		opts.FollowIsophotes = isophotes
+		want, err := Restore(crop, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Restore(photo.SubImage(rect), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Image.Bounds() != rect {
+			t.Fatalf("isophotes %v: bounds %v, want %v", isophotes, got.Image.Bounds(), rect)
+		}
+		sameImages(t, got.Image, want.Image)
+	}
+}
+
+func TestRestoreKeepsDepthAndAlpha(t *testing.T) {
+	photo := scratchedPhoto(40, 30)
+	withAlpha := func(img draw.Image) draw.Image {
+		draw.Draw(img, img.Bounds(), photo, image.Point{}, draw.Src)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 40; x++ {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				c.A = 0
+				if y >= 4 {
+					c.A = 0x8000
+				}
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		check func(t *testing.T, out image.Image)
+	}{
+		{"8-bit opaque", func() image.Image {
+			img := image.NewRGBA(photo.Bounds())
+			draw.Draw(img, img.Bounds(), photo, image.Point{}, draw.Src)
+			return img
+		}(), func(t *testing.T, out image.Image) {
+			if _, ok := out.(*image.NRGBA64); !ok {
+				t.Errorf("result is %T, want *image.NRGBA64", out)
+			}
+		}},
+		{"16-bit with alpha", withAlpha(image.NewNRGBA64(photo.Bounds())), func(t *testing.T, out image.Image) {
+			if _, ok := out.(*image.NRGBA64); !ok {
+				t.Errorf("result is %T, want *image.NRGBA64", out)
+			}
+		}},
+		{"8-bit with alpha", withAlpha(image.NewNRGBA(photo.Bounds())), func(t *testing.T, out image.Image) {
+			if _, ok := out.(*image.NRGBA); !ok {
+				t.Errorf("result is %T, want *image.NRGBA", out)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Restore(tt.img, testOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, result.Image)
+
+			// Alpha comes through unchanged
+			for y := 0; y < 30; y++ {
+				for x := 0; x < 40; x++ {
+					_, _, _, a := tt.img.At(x, y).RGBA()
+					_, _, _, b := result.Image.At(x, y).RGBA()
+					if a != b {
+						t.Fatalf("pixel (%d, %d): alpha %#x, want %#x", x, y, b, a)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreKeeps16BitPrecision(t *testing.T) {
+	// A shallow gradient spans only a few 8-bit levels but many 16-bit ones
+	img := image.NewNRGBA64(image.Rect(0, 0, 256, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 256; x++ {
+			v := uint16(0x4000 + 2*x)
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+		}
+	}
+	opts := testOptions()
+	opts.ColorCorrection = ColorCorrectionNone
+	result, err := Restore(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	levels := map[uint16]bool{}
+	for x := 0; x < 256; x++ {
+		levels[result.Image.(*image.NRGBA64).NRGBA64At(x, 4).R] = true
+	}
+	if len(levels) < 64 {
+		t.Errorf("%d distinct levels on the gradient, want at least 64", len(levels))
+	}
+}
@@ -0,0 +1,156 @@
+package restoration
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// Keywords of the PNG text chunks that carry metadata
+const (
+	pngXMPKeyword     = "XML:com.adobe.xmp"
+	pngCommentKeyword = "Comment"
+)
+
+// readPNGMetadata collects the EXIF (eXIf), ICC profile (iCCP), XMP and comment (iTXt and tEXt)
+// chunks of a PNG file as the matching JPEG segments. A damaged file gives the metadata read so far.
+func readPNGMetadata(data []byte) *Metadata {
+	meta := &Metadata{Orientation: 1}
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return meta
+	}
+
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		kind := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		switch kind {
+		case "eXIf":
+			meta.add(markerAPP1, append(append([]byte(nil), exifHeader...), chunk...))
+		case "iCCP":
+			// Profile name, compression method and the zlib stream
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) {
+				continue
+			}
+			if profile, err := inflate(chunk[name+2:]); err == nil {
+				meta.addICCProfile(profile)
+			}
+		case "iTXt", "tEXt":
+			keyword, text, ok := pngText(kind, chunk)
+			switch {
+			case !ok:
+			case keyword == pngXMPKeyword:
+				meta.add(markerAPP1, append(append([]byte(nil), xmpHeader...), text...))
+			case keyword == pngCommentKeyword:
+				meta.add(markerCOM, text)
+			}
+		case "IEND":
+			return meta
+		}
+	}
+	return meta
+}
+
+// pngText reads the keyword and the text of an iTXt or tEXt chunk.
+func pngText(kind string, chunk []byte) (keyword string, text []byte, ok bool) {
+	name := bytes.IndexByte(chunk, 0)
+	if name < 0 {
+		return "", nil, false
+	}
+	keyword, rest := string(chunk[:name]), chunk[name+1:]
+	if kind == "tEXt" {
+		return keyword, rest, true
+	}
+
+	// Compression flag and method, then the language tag and the translated keyword
+	if len(rest) < 2 {
+		return "", nil, false
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	for i := 0; i < 2; i++ {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return "", nil, false
+		}
+		rest = rest[end+1:]
+	}
+	if !compressed {
+		return keyword, rest, true
+	}
+	text, err := inflate(rest)
+	return keyword, text, err == nil
+}
+
+// pngHeaderEnd is the length of the signature and the header chunk, whose data is 13 bytes
+// long, at the start of a PNG file.
+const pngHeaderEnd = len(pngSignature) + 12 + 13
+
+// pngMetadataChunks builds the chunks holding the metadata and an optional history note that
+// EncodeImage inserts right after the header chunk of a PNG: the ICC profile as iCCP, EXIF as
+// eXIf, XMP and comments as iTXt. The EXIF orientation is reset to 1, as the pixels are upright.
+func pngMetadataChunks(meta *Metadata, history string) []byte {
+	var chunks bytes.Buffer
+	if profile := meta.iccData(); profile != nil {
+		var data bytes.Buffer
+		data.WriteString("ICC profile\x00\x00") // Name and zlib compression
+		zw := zlib.NewWriter(&data)
+		zw.Write(profile)
+		zw.Close()
+		writePNGChunk(&chunks, "iCCP", data.Bytes())
+	}
+	if meta != nil {
+		for _, s := range meta.segments {
+			switch {
+			case s.marker == markerAPP1 && bytes.HasPrefix(s.data, exifHeader):
+				writePNGChunk(&chunks, "eXIf", uprightExif(s.data)[len(exifHeader):])
+			case s.marker == markerAPP1 && bytes.HasPrefix(s.data, xmpHeader):
+				writePNGChunk(&chunks, "iTXt", pngITXt(pngXMPKeyword, s.data[len(xmpHeader):]))
+			case s.marker == markerCOM:
+				writePNGChunk(&chunks, "iTXt", pngITXt(pngCommentKeyword, s.data))
+			}
+		}
+	}
+	if history != "" {
+		writePNGChunk(&chunks, "iTXt", pngITXt(pngCommentKeyword, []byte(history)))
+	}
+	return chunks.Bytes()
+}
+
+// pngITXt builds the data of an uncompressed iTXt chunk without language tag.
+func pngITXt(keyword string, text []byte) []byte {
+	data := append([]byte(keyword), 0, 0, 0, 0, 0) // Compression flag and method, empty language and translation
+	return append(data, text...)
+}
+
+// writePNGChunk writes a chunk with its length and checksum.
+func writePNGChunk(buf *bytes.Buffer, kind string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	buf.WriteString(kind)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// inflate decompresses a zlib stream.
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,331 @@
+package restoration
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"os"
+)
+
+// PNG colour types decoded by LoadImageToDisk
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// errPNGInMemory is returned by loadPNGToDisk for files it leaves to the in-memory decoder.
+var errPNGInMemory = errors.New("png needs decoding in memory")
+
+// LoadImageToDisk loads an image like LoadImageWithMetadata, but decodes non-interlaced 8 and
+// 16-bit gray or RGB PNG files band by band into a StoredImage, so that a scan larger than
+// memory can be restored by RestoreTiledToDisk. Other formats, and PNG files with a palette, a
+// transparent colour, interlacing or an EXIF orientation to apply, are decoded in memory.
+// A returned StoredImage must be closed to remove its temporary file.
+func LoadImageToDisk(imagePath string) (image.Image, *Metadata, error) {
+	img, meta, err := loadPNGToDisk(imagePath)
+	if err == errPNGInMemory {
+		return LoadImageWithMetadata(imagePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, meta, nil
+}
+
+// loadPNGToDisk decodes a PNG file row by row into a StoredImage, keeping its other chunks for
+// readPNGMetadata. It returns errPNGInMemory for files it does not decode.
+func loadPNGToDisk(imagePath string) (img *StoredImage, meta *Metadata, err error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	// Every chunk but the image data, for the metadata
+	var chunks bytes.Buffer
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || string(signature) != pngSignature {
+		return nil, nil, errPNGInMemory
+	}
+	chunks.Write(signature)
+
+	// Header and ancillary chunks up to the image data
+	var header []byte
+	var next [8]byte
+	for {
+		if _, err := io.ReadFull(r, next[:]); err != nil {
+			return nil, nil, fmt.Errorf("png: %w", noEOF(err))
+		}
+		kind := string(next[4:])
+		if kind == "IDAT" {
+			break
+		}
+		chunk, err := readPNGChunk(r, next[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		switch kind {
+		case "IHDR":
+			header = chunk[8 : len(chunk)-4]
+		case "PLTE", "tRNS", "IEND":
+			return nil, nil, errPNGInMemory
+		}
+		chunks.Write(chunk)
+	}
+	if len(header) != 13 {
+		return nil, nil, errPNGInMemory
+	}
+	width, height := int(binary.BigEndian.Uint32(header[0:])), int(binary.BigEndian.Uint32(header[4:]))
+	depth, colorType, interlace := int(header[8]), header[9], header[12]
+	channels := map[byte]int{pngGray: 1, pngRGB: 3, pngGrayAlpha: 2, pngRGBA: 4}[colorType]
+	if depth != 8 && depth != 16 || channels == 0 || interlace != 0 || header[10] != 0 || header[11] != 0 ||
+		width <= 0 || height <= 0 || width > 1<<24 || height > 1<<24 {
+		return nil, nil, errPNGInMemory
+	}
+
+	model := color.Model(color.NRGBA64Model)
+	if depth == 8 {
+		model = color.NRGBAModel
+	}
+	stored, err := newStoredImage(width, height, model)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			stored.Close()
+		}
+	}()
+
+	idat := &idatReader{r: r, left: binary.BigEndian.Uint32(next[:]), crc: crc32.NewIEEE()}
+	idat.crc.Write(next[4:])
+	if err := decodePNGRows(idat, stored, depth/8, channels, colorType); err != nil {
+		return nil, nil, fmt.Errorf("png: %w", err)
+	}
+
+	// Chunks after the image data, up to the end
+	if _, err := io.Copy(io.Discard, idat); err != nil {
+		return nil, nil, fmt.Errorf("png: %w", err)
+	}
+	copy(next[:], idat.next)
+	for {
+		chunk, err := readPNGChunk(r, next[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		chunks.Write(chunk)
+		if string(next[4:]) == "IEND" {
+			break
+		}
+		if _, err := io.ReadFull(r, next[:]); err != nil {
+			return nil, nil, fmt.Errorf("png: %w", noEOF(err))
+		}
+	}
+
+	meta = readPNGMetadata(chunks.Bytes())
+	meta.Format = FormatPNG
+	if meta.Orientation != 1 {
+		return nil, nil, errPNGInMemory
+	}
+	return stored, meta, nil
+}
+
+// readPNGChunk reads the data and checksum of a chunk whose length and type have been read into
+// header, and returns the whole chunk.
+func readPNGChunk(r io.Reader, header []byte) ([]byte, error) {
+	length := binary.BigEndian.Uint32(header)
+	if length > 1<<30 {
+		return nil, fmt.Errorf("png: %q chunk of %d bytes", header[4:], length)
+	}
+	chunk := make([]byte, 12+length)
+	copy(chunk, header)
+	if _, err := io.ReadFull(r, chunk[8:]); err != nil {
+		return nil, fmt.Errorf("png: %w", noEOF(err))
+	}
+	if crc32.ChecksumIEEE(chunk[4:8+length]) != binary.BigEndian.Uint32(chunk[8+length:]) {
+		return nil, fmt.Errorf("png: bad checksum in %q chunk", header[4:])
+	}
+	return chunk, nil
+}
+
+// decodePNGRows inflates and unfilters the rows of a non-interlaced PNG and stores them as
+// NRGBA or NRGBA64 pixels, one band at a time.
+func decodePNGRows(idat io.Reader, img *StoredImage, sample, channels int, colorType byte) error {
+	zr, err := zlib.NewReader(idat)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	width, height := img.store.width, img.store.height
+	bpp := sample * channels
+	cr := make([]byte, 1+width*bpp) // Filter type and the current row
+	pr := make([]byte, 1+width*bpp) // Previous row, zero above the first
+	for top := 0; top < height; top += img.rows {
+		n := min(img.rows, height-top)
+		var band image.Image
+		var pix []byte
+		var stride int
+		if sample == 2 {
+			b := image.NewNRGBA64(image.Rect(0, 0, width, n))
+			band, pix, stride = b, b.Pix, b.Stride
+		} else {
+			b := image.NewNRGBA(image.Rect(0, 0, width, n))
+			band, pix, stride = b, b.Pix, b.Stride
+		}
+
+		for y := 0; y < n; y++ {
+			if _, err := io.ReadFull(zr, cr); err != nil {
+				return noEOF(err)
+			}
+			if err := unfilterPNGRow(cr[0], cr[1:], pr[1:], bpp); err != nil {
+				return err
+			}
+			pngRowToNRGBA(pix[y*stride:], cr[1:], width, sample, colorType)
+			cr, pr = pr, cr
+		}
+		if err := img.writeBand(band, top); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unfilterPNGRow undoes the filter of a row in place, given the unfiltered previous row and the
+// bytes per pixel.
+func unfilterPNGRow(filter byte, cur, prev []byte, bpp int) error {
+	switch filter {
+	case 0: // None
+	case 1: // Sub
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2: // Up
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3: // Average
+		for i := range cur {
+			var left int
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += uint8((left + int(prev[i])) / 2)
+		}
+	case 4: // Paeth
+		for i := range cur {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cur[i-bpp]), int(prev[i-bpp])
+			}
+			b := int(prev[i])
+			p := a + b - c
+			pa, pb, pc := absInt(p-a), absInt(p-b), absInt(p-c)
+			switch {
+			case pa <= pb && pa <= pc:
+				cur[i] += uint8(a)
+			case pb <= pc:
+				cur[i] += uint8(b)
+			default:
+				cur[i] += uint8(c)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown filter type %d", filter)
+	}
+	return nil
+}
+
+// absInt returns the absolute value of an integer.
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// pngRowToNRGBA expands a row of gray, gray and alpha, RGB or RGBA samples of the given size
+// into non-premultiplied RGBA pixels of the same size. PNG samples are big-endian, like those of
+// image.NRGBA64.
+func pngRowToNRGBA(dst, row []byte, width, sample int, colorType byte) {
+	for x := 0; x < width; x++ {
+		d := dst[x*4*sample : (x+1)*4*sample]
+		switch colorType {
+		case pngGray, pngGrayAlpha:
+			channels := 1 + int(colorType/pngGrayAlpha)
+			s := row[x*channels*sample:]
+			copy(d[0:], s[:sample])
+			copy(d[sample:], s[:sample])
+			copy(d[2*sample:], s[:sample])
+			if colorType == pngGrayAlpha {
+				copy(d[3*sample:], s[sample:2*sample])
+				continue
+			}
+		case pngRGB:
+			copy(d, row[x*3*sample:(x+1)*3*sample])
+		case pngRGBA:
+			copy(d, row[x*4*sample:(x+1)*4*sample])
+			continue
+		}
+		for i := 3 * sample; i < 4*sample; i++ {
+			d[i] = 0xff // Opaque
+		}
+	}
+}
+
+// idatReader reads the data of consecutive IDAT chunks as one stream, checking their checksums.
+// It stops at the first other chunk, whose length and type it keeps in next.
+type idatReader struct {
+	r    io.Reader
+	left uint32      // Bytes left in the current chunk
+	crc  hash.Hash32 // Checksum of the current chunk so far
+	next []byte      // Header of the chunk after the image data, once reached
+}
+
+func (d *idatReader) Read(p []byte) (int, error) {
+	for d.left == 0 {
+		if d.next != nil {
+			return 0, io.EOF
+		}
+		var footer [12]byte // Checksum of this chunk and header of the next
+		if _, err := io.ReadFull(d.r, footer[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		if binary.BigEndian.Uint32(footer[:4]) != d.crc.Sum32() {
+			return 0, errors.New("bad checksum in IDAT chunk")
+		}
+		if string(footer[8:]) != "IDAT" {
+			d.next = footer[4:]
+			return 0, io.EOF
+		}
+		d.left = binary.BigEndian.Uint32(footer[4:])
+		d.crc.Reset()
+		d.crc.Write(footer[8:])
+	}
+	if uint32(len(p)) > d.left {
+		p = p[:d.left]
+	}
+	n, err := d.r.Read(p)
+	d.crc.Write(p[:n])
+	d.left -= uint32(n)
+	return n, noEOF(err)
+}
+
+// noEOF reports the end of a file in the middle of a PNG as an unexpected one.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package restoration
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rawPNG builds a PNG file by hand from unfiltered rows, cycling through the five filter types
+// and splitting the image data over IDAT chunks of at most 50 bytes. Extra chunks are written
+// after the image data.
+func rawPNG(width, height, depth int, colorType byte, rows [][]byte, extra map[string][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	header := binary.BigEndian.AppendUint32(nil, uint32(width))
+	header = binary.BigEndian.AppendUint32(header, uint32(height))
+	header = append(header, byte(depth), colorType, 0, 0, 0)
+	writePNGChunk(&buf, "IHDR", header)
+
+	bpp := depth / 8 * map[byte]int{pngGray: 1, pngRGB: 3, pngGrayAlpha: 2, pngRGBA: 4}[colorType]
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	prev := make([]byte, len(rows[0]))
+	for y, row := range rows {
+		filter := byte(y % 5)
+		filtered := make([]byte, len(row))
+		for i := range row {
+			var a, b, c int
+			if i >= bpp {
+				a, c = int(row[i-bpp]), int(prev[i-bpp])
+			}
+			b = int(prev[i])
+			predictor := 0
+			switch filter {
+			case 1:
+				predictor = a
+			case 2:
+				predictor = b
+			case 3:
+				predictor = (a + b) / 2
+			case 4:
+				p := a + b - c
+				switch pa, pb, pc := absInt(p-a), absInt(p-b), absInt(p-c); {
+				case pa <= pb && pa <= pc:
+					predictor = a
+				case pb <= pc:
+					predictor = b
+				default:
+					predictor = c
+				}
+			}
+			filtered[i] = row[i] - byte(predictor)
+		}
+		zw.Write(append([]byte{filter}, filtered...))
+		prev = row
+	}
+	zw.Close()
+	for idat := data.Bytes(); len(idat) > 0; {
+		n := min(50, len(idat))
+		writePNGChunk(&buf, "IDAT", idat[:n])
+		idat = idat[n:]
+	}
+	for kind, chunk := range extra {
+		writePNGChunk(&buf, kind, chunk)
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+// writeTemp writes data to a file in a temporary directory and returns its path.
+func writeTemp(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadImageToDisk(t *testing.T) {
+	const width, height = 37, 45 // More rows than a cached band of 16
+	source := randomImage(width, height, true, 4)
+	rows := func(depth int, colorType byte) [][]byte {
+		var rows [][]byte
+		for y := 0; y < height; y++ {
+			var row []byte
+			for x := 0; x < width; x++ {
+				c := source.NRGBA64At(x, y)
+				samples := []uint16{c.R, c.G, c.B, c.A}
+				switch colorType {
+				case pngGray:
+					samples = samples[:1]
+				case pngGrayAlpha:
+					samples = []uint16{c.G, c.A}
+				case pngRGB:
+					samples = samples[:3]
+				}
+				for _, v := range samples {
+					if depth == 16 {
+						row = append(row, byte(v>>8), byte(v))
+					} else {
+						row = append(row, byte(v>>8))
+					}
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	for _, depth := range []int{8, 16} {
+		for _, colorType := range []byte{pngGray, pngRGB, pngGrayAlpha, pngRGBA} {
+			comment := []byte("Comment\x00after the image data")
+			data := rawPNG(width, height, depth, colorType, rows(depth, colorType), map[string][]byte{"tEXt": comment})
+			path := writeTemp(t, "photo.png", data)
+
+			want, _, err := LoadImageWithMetadata(path)
+			if err != nil {
+				t.Fatalf("%d-bit type %d: %v", depth, colorType, err)
+			}
+			got, meta, err := LoadImageToDisk(path)
+			if err != nil {
+				t.Fatalf("%d-bit type %d: %v", depth, colorType, err)
+			}
+			stored, ok := got.(*StoredImage)
+			if !ok {
+				t.Fatalf("%d-bit type %d: loaded a %T, want a *StoredImage", depth, colorType, got)
+			}
+			defer stored.Close()
+
+			closeImages(t, stored, want, 0)
+			if is16Bit(stored) != (depth == 16) {
+				t.Errorf("%d-bit type %d: 16-bit %v", depth, colorType, is16Bit(stored))
+			}
+			if meta.Format != FormatPNG || len(meta.segments) != 1 || string(meta.segments[0].data) != "after the image data" {
+				t.Errorf("%d-bit type %d: metadata %+v, want the PNG comment", depth, colorType, meta)
+			}
+		}
+	}
+
+	// Files left to the in-memory decoder
+	palette := image.NewPaletted(image.Rect(0, 0, 5, 3), color.Palette{color.Black, color.White})
+	palette.SetColorIndex(2, 1, 1)
+	var paletted bytes.Buffer
+	if err := png.Encode(&paletted, palette); err != nil {
+		t.Fatal(err)
+	}
+	var jpeg bytes.Buffer
+	opts := DefaultEncodeOptions()
+	if err := EncodeImage(&jpeg, source, opts); err != nil {
+		t.Fatal(err)
+	}
+	rotated := rawPNG(width, height, 8, pngRGB, rows(8, pngRGB), map[string][]byte{
+		"eXIf": exifSegment(6, binary.LittleEndian)[len(exifHeader):],
+	})
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"palette", paletted.Bytes()},
+		{"jpeg", jpeg.Bytes()},
+		{"rotated", rotated},
+	} {
+		path := writeTemp(t, "photo", tt.data)
+		want, wantMeta, err := LoadImageWithMetadata(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, meta, err := LoadImageToDisk(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, ok := got.(*StoredImage); ok {
+			t.Errorf("%s: decoded to disk", tt.name)
+		}
+		sameImages(t, got, want)
+		if meta.Format != wantMeta.Format || meta.Orientation != wantMeta.Orientation {
+			t.Errorf("%s: format %v orientation %d, want %v and %d", tt.name, meta.Format, meta.Orientation, wantMeta.Format, wantMeta.Orientation)
+		}
+	}
+
+	// Damaged files
+	good := rawPNG(width, height, 16, pngRGBA, rows(16, pngRGBA), nil)
+	idat := bytes.Index(good, []byte("IDAT"))
+	badCRC := append([]byte(nil), good...)
+	badCRC[idat+4+50] ^= 1 // Checksum of the first IDAT chunk
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated", good[:len(good)/2], "unexpected EOF"},
+		{"bad checksum", badCRC, "checksum"},
+		{"missing end", good[:len(good)-12], "unexpected EOF"},
+	} {
+		if _, _, err := LoadImageToDisk(writeTemp(t, "photo.png", tt.data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if err := unfilterPNGRow(5, make([]byte, 4), make([]byte, 4), 1); err == nil {
+		t.Error("filter type 5 was accepted")
+	}
+}
@@ -7,12 +7,56 @@ import (
 	"sync"
 )
 
+// blendSum accumulates the neighbours of an inpainted pixel. Colours are weighted by their alpha,
+// so translucent neighbours count less and fully transparent ones not at all.
+type blendSum struct {
+	r, g, b, a  float64
+	weight      float64
+	translucent bool
+}
+
+// add accumulates a neighbour with the given weight.
+func (s *blendSum) add(c color.Color, weight float64) {
+	r, g, b, a := c.RGBA() // Premultiplied
+	if a == 0 {
+		return
+	}
+	s.r += float64(r) * weight
+	s.g += float64(g) * weight
+	s.b += float64(b) * weight
+	s.a += float64(a) * weight
+	s.weight += weight
+	s.translucent = s.translucent || a < 0xffff
+}
+
+// color returns the blended colour with the given alpha, or ok false when no neighbour counted.
+func (s *blendSum) color(alpha uint16) (c color.Color, ok bool) {
+	if s.weight == 0 {
+		return nil, false
+	}
+	r, g, b := s.r/s.weight, s.g/s.weight, s.b/s.weight
+	if s.translucent {
+		// Undo the premultiplication by the mean alpha of the neighbours
+		scale := float64(0xffff) * s.weight / s.a
+		r, g, b = math.Min(r*scale, 0xffff), math.Min(g*scale, 0xffff), math.Min(b*scale, 0xffff)
+	}
+	return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: alpha}, true
+}
+
+// alphaAt returns the 16-bit alpha of a pixel.
+func alphaAt(img image.Image, x, y int) uint16 {
+	_, _, _, a := img.At(x, y).RGBA()
+	return uint16(a)
+}
+
 // GetBlendedColorWithEdges computes a blended color by averaging nearby pixels weighted by distance and edge strength.
-func GetBlendedColorWithEdges(img image.Image, mask [][]float64, edges [][]float64, x, y int) color.Color {
+// Transparent neighbours are ignored and the pixel keeps its own alpha. x and y are local
+// coordinates, like those of the masks: (0, 0) is the top-left corner of img.Bounds().
+func GetBlendedColorWithEdges(img image.Image, mask Mask, edges Mask, x, y int) color.Color {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
-	var sumR, sumG, sumB, weightSum float64
+	var sum blendSum
 	maxRadius := 5
 	adjustedRadius := maxRadius
 	// Adjust radius for boundary conditions
@@ -31,39 +75,28 @@ func GetBlendedColorWithEdges(img image.Image, mask [][]float64, edges [][]float
 	for dy := -adjustedRadius; dy <= adjustedRadius; dy++ {
 		for dx := -adjustedRadius; dx <= adjustedRadius; dx++ {
 			nx, ny := x+dx, y+dy
-			if nx >= 0 && nx < width && ny >= 0 && ny < height && mask[ny][nx] < 1.0 {
-				c := img.At(nx, ny)
-				r, g, b, _ := c.RGBA()
-				edgeWeight := 1.0 - edges[ny][nx]
+			if nx >= 0 && nx < width && ny >= 0 && ny < height && mask.At(nx, ny) < 1.0 {
+				edgeWeight := 1.0 - edges.At(nx, ny)
 				distance := float64(dx*dx + dy*dy)
 				weight := edgeWeight / (math.Sqrt(distance) + 1e-6)
-				sumR += float64(r) * weight
-				sumG += float64(g) * weight
-				sumB += float64(b) * weight
-				weightSum += weight
+				sum.add(img.At(bounds.Min.X+nx, bounds.Min.Y+ny), weight)
 			}
 		}
 	}
 	
-	// Avoid division by zero
-	if weightSum == 0 {
-		return img.At(x, y) // Use the original image color directly 
-	}
-
 	// Compute final blended color
-	return color.RGBA{
-		R: uint8((sumR / weightSum) / 256),
-		G: uint8((sumG / weightSum) / 256),
-		B: uint8((sumB / weightSum) / 256),
-		A: 255,
+	blended, ok := sum.color(alphaAt(img, bounds.Min.X+x, bounds.Min.Y+y))
+	if !ok {
+		return img.At(bounds.Min.X+x, bounds.Min.Y+y) // Avoid division by zero: use the original image color directly 
 	}
+	return blended
 }
 
 // InpaintByChunks performs image inpainting in parallel using chunk processing.
-func InpaintByChunks(img image.Image, mask [][]float64, edges [][]float64, numWorkers int) *image.RGBA {
+func InpaintByChunks(img image.Image, mask Mask, edges Mask, border BorderMode, numWorkers int) *image.NRGBA64 {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
-	output := image.NewRGBA(bounds)
+	output := image.NewNRGBA64(bounds)
 
 	// Compute chunk size for dividing the image into sections
 	chunkHeight := int(math.Ceil(float64(height) / math.Sqrt(2*float64(numWorkers))))
@@ -78,12 +111,13 @@ func InpaintByChunks(img image.Image, mask [][]float64, edges [][]float64, numWo
     defer wg.Done()
     for y := max(0, yStart-overlap); y < min(yEnd+overlap, height); y++ {
         for x := max(0, xStart-overlap); x < min(xEnd+overlap, width); x++ {
+            px, py := bounds.Min.X+x, bounds.Min.Y+y
             mu.Lock()
-            if mask[y][x] > 0 {
+            if mask.At(x, y) > 0 {
                 blendedColor := GetBlendedColorWithEdges(img, mask, edges, x, y)
-				output.Set(x, y, blendedColor)
+				output.Set(px, py, blendedColor)
             } else {
-                output.Set(x, y, img.At(x, y))
+                output.Set(px, py, img.At(px, py))
             }
             mu.Unlock()
         }
@@ -91,8 +125,8 @@ func InpaintByChunks(img image.Image, mask [][]float64, edges [][]float64, numWo
 }
 
 // Divide the image into chunks and process each in a goroutine
-	for yStart := 0; yStart < height; yStart += chunkHeight - overlap {
-		for xStart := 0; xStart < width; xStart += chunkWidth - overlap {
+	for yStart := 0; yStart < height; yStart += max(1, chunkHeight-overlap) {
+		for xStart := 0; xStart < width; xStart += max(1, chunkWidth-overlap) {
 			xEnd := min(xStart + chunkWidth, width)
 			yEnd := min(yStart + chunkHeight, height)
 	
@@ -104,7 +138,7 @@ func InpaintByChunks(img image.Image, mask [][]float64, edges [][]float64, numWo
 
 
 	wg.Wait()
-	return SmoothImageConcurrent(output, numWorkers) // Apply final smoothing step
+	return SmoothImageConcurrent(output, border, numWorkers) // Apply final smoothing step
 }
 
 // Utility function to return the maximum of two integers.
@@ -123,3 +157,14 @@ func min(a, b int) int {
     return b
 }
 
+
+// Utility function to restrict an integer to the [lo, hi] range.
+func clampInt(v, lo, hi int) int {
+    if v < lo {
+        return lo
+    }
+    if v > hi {
+        return hi
+    }
+    return v
+}
@@ -0,0 +1,109 @@
+package restoration
+
+import (
+	"image"
+	"math"
+)
+
+// GaussianPyramid builds a Gaussian image pyramid with up to levels levels.
+// Level 0 is the original image; each following level is blurred with a 5-tap binomial
+// kernel and halved in both dimensions. Construction stops early once a level would be
+// smaller than 8 pixels on a side. Pixels outside the image are read with the border mode.
+func GaussianPyramid(img image.Image, levels int, border BorderMode, numWorkers int) []*image.NRGBA64 {
+	pyramid := buildPyramid(toFloatImage(img, numWorkers), levels, border, numWorkers)
+	out := make([]*image.NRGBA64, len(pyramid))
+	for i, level := range pyramid {
+		out[i] = level.toNRGBA64(numWorkers)
+	}
+	return out
+}
+
+// MultiScaleEdgeDetection detects edges on every level of a Gaussian pyramid and combines the
+// responses at full resolution. Each level is normalised, upsampled bilinearly and averaged,
+// so structures present at several scales stay strong while grain, which only shows up on the
+// finest level, is diluted below opts.Threshold.
+func MultiScaleEdgeDetection(img image.Image, levels int, opts EdgeOptions, numWorkers int) *FloatMask {
+	src := toFloatImage(img, numWorkers)
+	width, height := src.Width, src.Height
+	pyramid := buildPyramid(src, levels, opts.Border, numWorkers)
+
+	combined := NewFloatMask(width, height)
+	for _, level := range pyramid {
+		edges := resizeMap(edgeStrength(level, opts, numWorkers), width, height, numWorkers)
+		parallelRows(height, numWorkers, func(startY, endY int) {
+			for i := startY * width; i < endY*width; i++ {
+				combined.Pix[i] += edges.Pix[i] / float32(len(pyramid))
+			}
+		})
+	}
+
+	// Renormalise and apply the cut-off on the combined response
+	normalizeEdges(combined, numWorkers)
+	for i, v := range combined.Pix {
+		if float64(v) < opts.Threshold {
+			combined.Pix[i] = 0.0
+		}
+	}
+	return combined
+}
+
+// buildPyramid builds the levels of a Gaussian pyramid from a working copy.
+func buildPyramid(src *floatImage, levels int, border BorderMode, numWorkers int) []*floatImage {
+	pyramid := []*floatImage{src}
+	for len(pyramid) < levels {
+		prev := pyramid[len(pyramid)-1]
+		if prev.Width < 16 || prev.Height < 16 {
+			break
+		}
+		pyramid = append(pyramid, pyramidDown(prev, border, numWorkers))
+	}
+	return pyramid
+}
+
+// pyramidDown blurs a working copy with a 5-tap binomial kernel and keeps every other pixel.
+func pyramidDown(src *floatImage, border BorderMode, numWorkers int) *floatImage {
+	binomial := NewSeparableKernel([]float64{1, 4, 6, 4, 1}, []float64{1, 4, 6, 4, 1})
+	binomial.Normalize = true
+	blurred := convolveImage(src, binomial, ConvolveOptions{Border: border, Channels: ChannelsAll, NumWorkers: numWorkers})
+
+	width, height := (src.Width+1)/2, (src.Height+1)/2
+	dst := newFloatImage(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			for x := 0; x < width; x++ {
+				copy(dst.Pix[dst.offset(x, y):dst.offset(x, y)+4], blurred.Pix[blurred.offset(2*x, 2*y):])
+			}
+		}
+	})
+	return dst
+}
+
+// resizePlane resamples src into dst with bilinear interpolation, aligning pixel centres.
+func resizePlane(dst, src plane, numWorkers int) {
+	scaleX := float64(src.width) / float64(dst.width)
+	scaleY := float64(src.height) / float64(dst.height)
+
+	parallelRows(dst.height, numWorkers, func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			sy := (float64(y)+0.5)*scaleY - 0.5
+			y0 := int(math.Floor(sy))
+			fy := float32(sy - float64(y0))
+			for x := 0; x < dst.width; x++ {
+				sx := (float64(x)+0.5)*scaleX - 0.5
+				x0 := int(math.Floor(sx))
+				fx := float32(sx - float64(x0))
+
+				top := src.sample(x0, y0, BorderClamp, 0)*(1-fx) + src.sample(x0+1, y0, BorderClamp, 0)*fx
+				bottom := src.sample(x0, y0+1, BorderClamp, 0)*(1-fx) + src.sample(x0+1, y0+1, BorderClamp, 0)*fx
+				dst.set(x, y, top*(1-fy)+bottom*fy)
+			}
+		}
+	})
+}
+
+// resizeMap resamples a weight map (mask or edge map) with bilinear interpolation.
+func resizeMap(m *FloatMask, width, height int, numWorkers int) *FloatMask {
+	out := NewFloatMask(width, height)
+	resizePlane(out.plane(), m.plane(), numWorkers)
+	return out
+}
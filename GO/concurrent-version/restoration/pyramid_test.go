@@ -0,0 +1,106 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestGaussianPyramidLevels(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		levels        int
+		want          []image.Point
+	}{
+		{"single level", 40, 30, 1, []image.Point{{40, 30}}},
+		{"no levels keeps the image", 40, 30, 0, []image.Point{{40, 30}}},
+		{"even sizes", 64, 48, 3, []image.Point{{64, 48}, {32, 24}, {16, 12}}},
+		{"odd sizes round up", 101, 37, 3, []image.Point{{101, 37}, {51, 19}, {26, 10}}},
+		{"stops below 16 pixels", 64, 48, 6, []image.Point{{64, 48}, {32, 24}, {16, 12}}},
+		{"too small to halve", 15, 200, 4, []image.Point{{15, 200}}},
+	}
+	for _, tt := range tests {
+		img := image.NewNRGBA64(image.Rect(5, 7, 5+tt.width, 7+tt.height))
+		pyramid := GaussianPyramid(img, tt.levels, BorderClamp, 3)
+		if len(pyramid) != len(tt.want) {
+			t.Errorf("%s: %d levels, want %d", tt.name, len(pyramid), len(tt.want))
+			continue
+		}
+		for i, level := range pyramid {
+			if size := level.Bounds().Size(); size != tt.want[i] {
+				t.Errorf("%s: level %d is %v, want %v", tt.name, i, size, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestGaussianPyramidKeepsFlatColour(t *testing.T) {
+	c := color.NRGBA64{0x4000, 0x8000, 0xc000, 0xffff}
+	img := image.NewNRGBA64(image.Rect(0, 0, 50, 34))
+	for y := 0; y < 34; y++ {
+		for x := 0; x < 50; x++ {
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	for _, border := range []BorderMode{BorderClamp, BorderReflect, BorderWrap} {
+		for i, level := range GaussianPyramid(img, 3, border, 2) {
+			b := level.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got := level.NRGBA64At(x, y); got != c {
+						t.Fatalf("border %v, level %d: pixel (%d, %d) = %v, want %v", border, i, x, y, got, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Multi-scale edges keep a step that shows up at every scale and dilute grain, which only
+// shows up at full resolution.
+func TestMultiScaleEdgesSuppressGrain(t *testing.T) {
+	const width, height = 64, 64
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := 0x3000
+			if x >= width/2 {
+				v = 0xb000
+			}
+			v += rng.Intn(0x2000) - 0x1000 // Grain
+			img.SetNRGBA64(x, y, color.NRGBA64{uint16(v), uint16(v), uint16(v), 0xffff})
+		}
+	}
+	opts := DefaultEdgeOptions()
+	opts.Threshold = 0.1
+
+	// Responses away from the step are grain; coarse levels spread the step over a few pixels
+	grain := func(edges *FloatMask) int {
+		n := 0
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if (x < width/2-12 || x >= width/2+12) && edges.At(x, y) > 0 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	single := EdgeDetectionWithOptions(img, opts, 3)
+	multi := MultiScaleEdgeDetection(img, 3, opts, 3)
+	before := grain(single)
+	if before < 100 {
+		t.Fatalf("only %d grain pixels at a single scale, the test image is too clean", before)
+	}
+	if got := grain(multi); got >= before/4 {
+		t.Errorf("%d grain pixels in the multi-scale map, want under a quarter of the %d of a single scale", got, before)
+	}
+	for y := 4; y < height-4; y++ {
+		if multi.At(width/2-1, y) < 0.3 && multi.At(width/2, y) < 0.3 {
+			t.Fatalf("row %d: step lost from the multi-scale map (%v, %v)", y, multi.At(width/2-1, y), multi.At(width/2, y))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"sync"
+)
+
+// rowStore keeps the rows of an image in a temporary file, so that the passes of RestoreTiled
+// can read them again without holding the whole photo in memory.
+type rowStore struct {
+	file          *os.File
+	width, height int
+	pixelBytes    int  // Bytes per pixel: 8 for 16-bit RGBA rows, 4 for 8-bit ones, 1 for gray
+	removed       bool // The file was unlinked as soon as it was created
+}
+
+// newRowStore creates an empty store for 16-bit RGBA rows of an image of the given size.
+func newRowStore(width, height int) (*rowStore, error) {
+	return newPixelStore(width, height, 8)
+}
+
+// newPixelStore creates an empty store for rows of pixelBytes bytes per pixel.
+func newPixelStore(width, height, pixelBytes int) (*rowStore, error) {
+	file, err := os.CreateTemp("", "restore-rows-*")
+	if err != nil {
+		return nil, err
+	}
+	// Where the system allows removing an open file, the rows go away with the process even
+	// when it exits without closing the store
+	removed := os.Remove(file.Name()) == nil
+	return &rowStore{file: file, width: width, height: height, pixelBytes: pixelBytes, removed: removed}, nil
+}
+
+// rowBytes returns the size of a stored row.
+func (s *rowStore) rowBytes() int {
+	return s.pixelBytes * s.width
+}
+
+// writeRows stores n rows of a band, starting at row top, as the rows from y on.
+func (s *rowStore) writeRows(band *image.NRGBA64, top, n, y int) error {
+	return s.writePix(band.Pix[top*band.Stride:], band.Stride, n, y)
+}
+
+// writePix stores n rows of pixel data laid out stride bytes apart as the rows from y on.
+func (s *rowStore) writePix(pix []byte, stride, n, y int) error {
+	rowBytes := s.rowBytes()
+	for r := 0; r < n; r++ {
+		if _, err := s.file.WriteAt(pix[r*stride:r*stride+rowBytes], int64(y+r)*int64(rowBytes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRows returns the stored rows [startY, endY) as an image with its origin at (0, 0).
+func (s *rowStore) readRows(startY, endY int) (*image.NRGBA64, error) {
+	band := image.NewNRGBA64(image.Rect(0, 0, s.width, endY-startY))
+	return band, s.readPix(band.Pix, startY)
+}
+
+// readPix reads consecutive stored rows from row startY into pix.
+func (s *rowStore) readPix(pix []byte, startY int) error {
+	_, err := s.file.ReadAt(pix, int64(startY)*int64(s.rowBytes()))
+	return err
+}
+
+// Close removes the temporary file.
+func (s *rowStore) Close() error {
+	err := s.file.Close()
+	if s.removed {
+		return err
+	}
+	if removeErr := os.Remove(s.file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// storedCacheBytes is the size of the band of rows a StoredImage keeps in memory for At.
+const storedCacheBytes = 4 << 20
+
+// StoredImage is an image whose rows are kept in a temporary file instead of memory, for scans
+// too large to hold whole. LoadImageToDisk decodes photos into one and RestoreTiledToDisk
+// restores into one; EncodeImage writes it band by band.
+//
+// At reads through a cache of a few megabytes of rows, so reading the image row after row, as
+// the encoders do, touches the file once per band. Close removes the file.
+type StoredImage struct {
+	store *rowStore
+	model color.Model // color.NRGBA64Model, color.NRGBAModel or color.GrayModel
+	rows  int         // Rows of a cached band
+
+	mu          sync.Mutex
+	cache       image.Image // Band of rows last read by At
+	cacheY      int         // First row of the cached band
+	translucent bool        // Some pixel written is not fully opaque
+}
+
+// newStoredImage creates an empty stored image of the given size, holding 16-bit RGBA pixels
+// for color.NRGBA64Model, 8-bit ones for color.NRGBAModel and gray ones for color.GrayModel.
+func newStoredImage(width, height int, model color.Model) (*StoredImage, error) {
+	pixelBytes := 8
+	switch model {
+	case color.NRGBAModel:
+		pixelBytes = 4
+	case color.GrayModel:
+		pixelBytes = 1
+	}
+	store, err := newPixelStore(width, height, pixelBytes)
+	if err != nil {
+		return nil, err
+	}
+	rows := max(16, storedCacheBytes/max(store.rowBytes(), 1))
+	return &StoredImage{store: store, model: model, rows: rows, cacheY: -1}, nil
+}
+
+// ColorModel returns the colour model of the stored pixels.
+func (m *StoredImage) ColorModel() color.Model { return m.model }
+
+// Bounds returns the size of the image, with its origin at (0, 0).
+func (m *StoredImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.store.width, m.store.height)
+}
+
+// At returns the colour of a pixel, reading the band of rows around it when it is not cached.
+// A pixel that cannot be read is transparent black.
+func (m *StoredImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Bounds())) {
+		return m.model.Convert(color.Transparent)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cache == nil || y < m.cacheY || y >= m.cacheY+m.cache.Bounds().Dy() {
+		// Bands are aligned on multiples of their height, so reading upwards (BMP) is as
+		// cheap as reading downwards
+		startY := y / m.rows * m.rows
+		band, err := m.band(startY, min(startY+m.rows, m.store.height))
+		if err != nil {
+			m.cache = nil
+			return m.model.Convert(color.Transparent)
+		}
+		m.cache, m.cacheY = band, startY
+	}
+	return m.cache.At(x, y-m.cacheY)
+}
+
+// Opaque reports whether every pixel written is fully opaque, so that encoders can leave out
+// the alpha channel without reading the image first.
+func (m *StoredImage) Opaque() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.translucent
+}
+
+// Close removes the temporary file holding the rows.
+func (m *StoredImage) Close() error {
+	return m.store.Close()
+}
+
+// band reads the rows [startY, endY) into an in-memory image of the matching type, with its
+// origin at (0, 0).
+func (m *StoredImage) band(startY, endY int) (image.Image, error) {
+	rect := image.Rect(0, 0, m.store.width, endY-startY)
+	var band image.Image
+	var pix []byte
+	switch m.model {
+	case color.NRGBAModel:
+		img := image.NewNRGBA(rect)
+		band, pix = img, img.Pix
+	case color.GrayModel:
+		img := image.NewGray(rect)
+		band, pix = img, img.Pix
+	default:
+		img := image.NewNRGBA64(rect)
+		band, pix = img, img.Pix
+	}
+	if err := m.store.readPix(pix, startY); err != nil {
+		return nil, fmt.Errorf("reading rows %d-%d of a stored image: %w", startY, endY, err)
+	}
+	return band, nil
+}
+
+// writeBand stores a band of the same type as the stored pixels as the rows from y on.
+func (m *StoredImage) writeBand(band image.Image, y int) error {
+	var pix []byte
+	var stride, pixelBytes int
+	switch b := band.(type) {
+	case *image.NRGBA64:
+		pix, stride, pixelBytes = b.Pix, b.Stride, 8
+	case *image.NRGBA:
+		pix, stride, pixelBytes = b.Pix, b.Stride, 4
+	case *image.Gray:
+		pix, stride, pixelBytes = b.Pix, b.Stride, 1
+	}
+	if pixelBytes != m.store.pixelBytes {
+		return fmt.Errorf("cannot store a band of type %T as %d-byte pixels", band, m.store.pixelBytes)
+	}
+
+	n := band.Bounds().Dy()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pixelBytes > 1 && !m.translucent {
+		m.translucent = !opaquePix(pix, stride, n, m.store.rowBytes(), pixelBytes)
+	}
+	m.cache = nil // The cached rows may be stale
+	return m.store.writePix(pix, stride, n, y)
+}
+
+// opaquePix reports whether the alpha samples of n rows of 8-bit (4 bytes per pixel) or 16-bit
+// (8 bytes per pixel) RGBA data laid out stride bytes apart are all at their maximum.
+func opaquePix(pix []byte, stride, n, rowBytes, pixelBytes int) bool {
+	sample := pixelBytes / 4 // Bytes per sample
+	for r := 0; r < n; r++ {
+		row := pix[r*stride : r*stride+rowBytes]
+		for i := 3 * sample; i < len(row); i += pixelBytes {
+			if row[i] != 0xff || row[i+sample-1] != 0xff {
+				return false
+			}
+		}
+	}
+	return true
+}
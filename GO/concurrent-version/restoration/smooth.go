@@ -2,262 +2,83 @@ package restoration
 
 import (
 	"image"
-	"image/color"
 	"math"
-	"sync"
 )
 
 // Apply gaussian blur and sharpening
 
-func ApplySmoothing(img image.Image, numWorkers int) image.Image {
+func ApplySmoothing(img image.Image, border BorderMode, numWorkers int) *image.NRGBA64 {
     // Apply Gaussian blur
     kernelSize := 3 // smaller kernel = finer smoothing
     sigma := 0.5    // medium smoothing
-    blurredImage := GaussianBlurConcurrent(img, kernelSize, sigma, numWorkers)
+    blurredImage := GaussianBlurConcurrent(img, kernelSize, sigma, border, numWorkers)
 
     // Sharpen the image using post-processing
-    sharpenedImage := PostProcessSharpenByChunks(blurredImage, numWorkers)
+    sharpenedImage := PostProcessSharpenByChunks(blurredImage, border, numWorkers)
 
     return sharpenedImage
 }
 
 
-func PostProcessSharpenByChunks(img image.Image, numWorkers int) image.Image {
-    bounds := img.Bounds()
-    width, height := bounds.Dx(), bounds.Dy()
-    output := image.NewRGBA(bounds)
-
-    // Sharpen kernel
-    kernel := [][]float64{
-        {0, -1, 0},
-        {-1, 5, -1},
-        {0, -1, 0},
-    }
-
-    offset := len(kernel) / 2 // Kernel size offset
-
-    // Calculate chunk dimensions with overlap
-    chunkWidth := int(math.Ceil(float64(width) / math.Sqrt(float64(numWorkers))))
-    chunkHeight := int(math.Ceil(float64(height) / math.Sqrt(float64(numWorkers))))
-    overlap := offset // Ensure overlap equals kernel offset
-
-    var wg sync.WaitGroup
-
-    // Worker function for processing a chunk
-    processChunk := func(xStart, xEnd, yStart, yEnd int) {
-        defer wg.Done()
-        for y := max(yStart, offset); y < min(yEnd, height-offset); y++ {
-            for x := max(xStart, offset); x < min(xEnd, width-offset); x++ {
-                var r, g, b float64
-                for ky := -offset; ky <= offset; ky++ {
-                    for kx := -offset; kx <= offset; kx++ {
-                        nx, ny := x+kx, y+ky
-                        px := img.At(nx, ny)
-                        pr, pg, pb, _ := px.RGBA()
-                        weight := kernel[ky+offset][kx+offset]
-                        r += float64(pr) * weight
-                        g += float64(pg) * weight
-                        b += float64(pb) * weight
-                    }
-                }
-
-                // Helper function to clamp color values to [0, 255]
-                clamp := func(value float64) uint8 {
-                    if value < 0 {
-                        return 0
-                    } else if value > 255*256 {
-                        return 255
-                    }
-                    return uint8(value / 256)
-                }
-
-                // Set the processed pixel in the output image
-                output.Set(x, y, color.RGBA{
-                    R: clamp(r),
-                    G: clamp(g),
-                    B: clamp(b),
-                    A: 255,
-                })
-            }
-        }
-    }
-
-    // Launch workers for each chunk
-    for yStart := 0; yStart < height; yStart += chunkHeight - overlap {
-        for xStart := 0; xStart < width; xStart += chunkWidth - overlap {
-            xEnd := min(xStart+chunkWidth, width)
-            yEnd := min(yStart+chunkHeight, height)
-
-            wg.Add(1)
-            go processChunk(max(0, xStart-overlap), min(width, xEnd+overlap), max(0, yStart-overlap), min(height, yEnd+overlap))
-        }
-    }
+// PostProcessSharpenByChunks sharpens an image with a fixed 3x3 kernel using the convolution engine.
+// Border pixels are read with the border mode, so the whole image is sharpened.
+func PostProcessSharpenByChunks(img image.Image, border BorderMode, numWorkers int) *image.NRGBA64 {
+	// Sharpen kernel
+	kernel := [][]float64{
+		{0, -1, 0},
+		{-1, 5, -1},
+		{0, -1, 0},
+	}
 
-    wg.Wait()
-    return output
+	return convolve(img, NewKernel(kernel), ConvolveOptions{Border: border, NumWorkers: numWorkers})
 }
 
 
 // Gaussian blurr for smoothing and then image sharpening
 
-// Generate a Gaussian kernel dynamically
-func generateGaussianKernel(size int, sigma float64) [][]float64 {
-	kernel := make([][]float64, size)
-	for i := range kernel {
-		kernel[i] = make([]float64, size)
-	}
-
-	center := size / 2
+// Generate normalised 1-D Gaussian weights for a kernel of 2*radius+1 taps.
+// The 2-D Gaussian is separable, so the same weights are used along rows and columns.
+func gaussianWeights(radius int, sigma float64) []float64 {
+	weights := make([]float64, 2*radius+1)
 	sum := 0.0 // To normalize the kernel
 
-	for y := 0; y < size; y++ {
-		for x := 0; x < size; x++ {
-			exponent := -((math.Pow(float64(x-center), 2) + math.Pow(float64(y-center), 2)) / (2 * sigma * sigma))
-			kernel[y][x] = math.Exp(exponent) / (2 * math.Pi * sigma * sigma)
-			sum += kernel[y][x]
-		}
+	for i := -radius; i <= radius; i++ {
+		weights[i+radius] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		sum += weights[i+radius]
 	}
 
 	// Normalize the kernel
-	for y := 0; y < size; y++ {
-		for x := 0; x < size; x++ {
-			kernel[y][x] /= sum
-		}
+	for i := range weights {
+		weights[i] /= sum
 	}
 
-	return kernel
+	return weights
+}
+
+// gaussianKernel1D builds normalised 1-D Gaussian weights covering three standard deviations.
+func gaussianKernel1D(sigma float64) []float64 {
+	if sigma <= 0 {
+		return []float64{1}
+	}
+	return gaussianWeights(int(math.Ceil(3*sigma)), sigma)
 }
 
 // Apply Gaussian blur with a dynamic kernel size
-func GaussianBlurConcurrent(img image.Image, kernelSize int, sigma float64, numWorkers int) image.Image {
+func GaussianBlurConcurrent(img image.Image, kernelSize int, sigma float64, border BorderMode, numWorkers int) *image.NRGBA64 {
 	if kernelSize%2 == 0 {
 		panic("Kernel size must be an odd number")
 	}
 
-	kernel := generateGaussianKernel(kernelSize, sigma)
-	bounds := img.Bounds()
-	height := bounds.Dy()
-	blurredImage := image.NewRGBA(bounds)
-	offset := kernelSize / 2
-
-	// Calculate chunk height based on the number of workers
-	chunkHeight := int(math.Ceil(float64(height) / float64(numWorkers)))
-
-	var wg sync.WaitGroup
-
-	// Worker function to process a chunk of the image
-	processChunk := func(startY, endY int) {
-		defer wg.Done()
-		for y := startY; y < endY; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				var r, g, b float64
-				for ky := -offset; ky <= offset; ky++ {
-					for kx := -offset; kx <= offset; kx++ {
-						nx := x + kx
-						ny := y + ky
-
-						// Handle edges by replicating border pixels
-						if nx < bounds.Min.X {
-							nx = bounds.Min.X
-						} else if nx >= bounds.Max.X {
-							nx = bounds.Max.X - 1
-						}
-						if ny < bounds.Min.Y {
-							ny = bounds.Min.Y
-						} else if ny >= bounds.Max.Y {
-							ny = bounds.Max.Y - 1
-						}
-
-						px := img.At(nx, ny)
-						pr, pg, pb, _ := px.RGBA()
-						weight := kernel[ky+offset][kx+offset]
-						r += float64(pr>>8) * weight
-						g += float64(pg>>8) * weight
-						b += float64(pb>>8) * weight
-					}
-				}
-				blurredImage.Set(x, y, color.RGBA{
-					R: uint8(r),
-					G: uint8(g),
-					B: uint8(b),
-					A: 255,
-				})
-			}
-		}
-	}
-
-	// Launch workers for each chunk
-	for startY := 0; startY < height; startY += chunkHeight {
-		endY := startY + chunkHeight
-		if endY > height {
-			endY = height
-		}
-		wg.Add(1)
-		go processChunk(startY, endY)
-	}
-
-	wg.Wait()
-	return blurredImage
+	weights := gaussianWeights(kernelSize/2, sigma)
+	return convolve(img, NewSeparableKernel(weights, weights), ConvolveOptions{Border: border, NumWorkers: numWorkers})
 }
 
-func SmoothImageConcurrent(img *image.RGBA, numWorkers int) *image.RGBA {
-	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	smoothed := image.NewRGBA(bounds)
-
-	kernel := [][]float64{
-		{1, 2, 1},
-		{2, 4, 2},
-		{1, 2, 1},
-	}
-	kernelSum := 16.0
-
-	// Calculate chunk height based on the number of workers
-	chunkHeight := int(math.Ceil(float64(height) / float64(numWorkers)))
-
-	var wg sync.WaitGroup
-
-	// Worker function to process a chunk of the image
-	processChunk := func(startY, endY int) {
-		defer wg.Done()
-		for y := startY; y < endY; y++ {
-			// Skip boundary rows (y == 0 or y == height-1)
-			if y <= 0 || y >= height-1 {
-				continue
-			}
-			for x := 1; x < width-1; x++ {
-				var sumR, sumG, sumB float64
-				for ky := -1; ky <= 1; ky++ {
-					for kx := -1; kx <= 1; kx++ {
-						nx := x + kx
-						ny := y + ky
-						r, g, b, _ := img.At(nx, ny).RGBA()
-						weight := kernel[ky+1][kx+1]
-						sumR += float64(r>>8) * weight
-						sumG += float64(g>>8) * weight
-						sumB += float64(b>>8) * weight
-					}
-				}
-				smoothed.Set(x, y, color.RGBA{
-					R: uint8(sumR / kernelSum),
-					G: uint8(sumG / kernelSum),
-					B: uint8(sumB / kernelSum),
-					A: 255,
-				})
-			}
-		}
-	}
-
-	// Launch workers for each chunk
-	for startY := 0; startY < height; startY += chunkHeight {
-		endY := startY + chunkHeight
-		if endY > height {
-			endY = height
-		}
-		wg.Add(1)
-		go processChunk(startY, endY)
-	}
+// SmoothImageConcurrent smooths an image with the 3x3 binomial kernel {1,2,1; 2,4,2; 1,2,1} / 16.
+// Border pixels are read with the border mode, so no black frame is left around the output.
+func SmoothImageConcurrent(img image.Image, border BorderMode, numWorkers int) *image.NRGBA64 {
+	binomial := []float64{1, 2, 1}
+	kernel := NewSeparableKernel(binomial, binomial)
+	kernel.Normalize = true
 
-	wg.Wait()
-	return smoothed
+	return convolve(img, kernel, ConvolveOptions{Border: border, NumWorkers: numWorkers})
 }
@@ -0,0 +1,197 @@
+package restoration
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+)
+
+// TIFF field types and tags written by encodeStoredTIFF
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffXResolution     = 282
+	tiffYResolution     = 283
+	tiffResolutionUnit  = 296
+	tiffExtraSamples    = 338
+)
+
+// tiffField is an entry of a TIFF image directory.
+type tiffField struct {
+	tag, kind uint16
+	values    []uint32 // Numerator and denominator pairs for rationals
+}
+
+// encodeStoredTIFF writes a stored image as a little-endian TIFF with one strip per band of
+// rows, so that only one band is held in memory. When w can seek, the strips are compressed
+// with Deflate, like the TIFF files EncodeImage writes from memory, and the offset of the image
+// directory is filled in at the end; otherwise they are written uncompressed, as their layout
+// must be known before the first one.
+func encodeStoredTIFF(w io.Writer, img *StoredImage) error {
+	width, height := img.store.width, img.store.height
+	rowBytes := img.store.rowBytes()
+
+	start := int64(-1)
+	seeker, ok := w.(io.WriteSeeker)
+	if ok {
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = pos // Pipes are files too, but cannot seek
+		}
+	}
+	compress := start >= 0
+
+	bw := bufio.NewWriter(w)
+	header := []byte("II*\x00\x00\x00\x00\x00")
+	if !compress {
+		size := int64(rowBytes)*int64(height) + 8
+		if size+size%2 > math.MaxUint32 {
+			return fmt.Errorf("a %dx%d image is too large for a TIFF file", width, height)
+		}
+		binary.LittleEndian.PutUint32(header[4:], uint32(size+size%2))
+	}
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var offsets, counts []uint32
+	pos := int64(len(header))
+	pix := make([]byte, min(img.rows, height)*rowBytes)
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	for y := 0; y < height; y += img.rows {
+		n := min(img.rows, height-y)
+		strip := pix[:n*rowBytes]
+		if err := img.store.readPix(strip, y); err != nil {
+			return fmt.Errorf("reading rows %d-%d of a stored image: %w", y, y+n, err)
+		}
+		if img.model == color.NRGBA64Model {
+			for i := 0; i < len(strip); i += 2 {
+				strip[i], strip[i+1] = strip[i+1], strip[i] // Samples are stored big-endian
+			}
+		}
+		if compress {
+			compressed.Reset()
+			zw.Reset(&compressed)
+			zw.Write(strip)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			strip = compressed.Bytes()
+		}
+		if pos+int64(len(strip)) > math.MaxUint32 {
+			return fmt.Errorf("a %dx%d image is too large for a TIFF file", width, height)
+		}
+		if _, err := bw.Write(strip); err != nil {
+			return err
+		}
+		offsets = append(offsets, uint32(pos))
+		counts = append(counts, uint32(len(strip)))
+		pos += int64(len(strip))
+	}
+	if pos%2 != 0 {
+		// The directory starts on a word boundary
+		if err := bw.WriteByte(0); err != nil {
+			return err
+		}
+		pos++
+	}
+
+	compression, photometric := uint32(1), uint32(2) // No compression, RGB
+	if compress {
+		compression = 8 // Deflate
+	}
+	bits, samples := []uint32{16, 16, 16, 16}, uint32(4)
+	switch img.model {
+	case color.NRGBAModel:
+		bits = []uint32{8, 8, 8, 8}
+	case color.GrayModel:
+		bits, samples, photometric = []uint32{8}, 1, 1 // Black is zero
+	}
+	fields := []tiffField{
+		{tiffImageWidth, tiffLong, []uint32{uint32(width)}},
+		{tiffImageLength, tiffLong, []uint32{uint32(height)}},
+		{tiffBitsPerSample, tiffShort, bits},
+		{tiffCompression, tiffShort, []uint32{compression}},
+		{tiffPhotometric, tiffShort, []uint32{photometric}},
+		{tiffStripOffsets, tiffLong, offsets},
+		{tiffSamplesPerPixel, tiffShort, []uint32{samples}},
+		{tiffRowsPerStrip, tiffLong, []uint32{uint32(img.rows)}},
+		{tiffStripByteCounts, tiffLong, counts},
+		{tiffXResolution, tiffRational, []uint32{72, 1}},
+		{tiffYResolution, tiffRational, []uint32{72, 1}},
+		{tiffResolutionUnit, tiffShort, []uint32{2}}, // Inch
+	}
+	if samples == 4 {
+		fields = append(fields, tiffField{tiffExtraSamples, tiffShort, []uint32{2}}) // Unassociated alpha
+	}
+	if _, err := bw.Write(tiffDirectory(fields, pos)); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if !compress {
+		return nil
+	}
+	// The header points at the directory
+	if _, err := seeker.Seek(start+4, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(seeker, binary.LittleEndian, uint32(pos)); err != nil {
+		return err
+	}
+	_, err := seeker.Seek(0, io.SeekEnd)
+	return err
+}
+
+// tiffDirectory builds a little-endian image directory at offset pos holding fields sorted by
+// tag, followed by the values that do not fit in their entries.
+func tiffDirectory(fields []tiffField, pos int64) []byte {
+	order := binary.LittleEndian
+	dir := order.AppendUint16(nil, uint16(len(fields)))
+	var values []byte
+	valuesPos := uint32(pos) + uint32(2+12*len(fields)+4)
+	for _, f := range fields {
+		var data []byte
+		count := len(f.values)
+		for _, v := range f.values {
+			if f.kind == tiffShort {
+				data = order.AppendUint16(data, uint16(v))
+			} else {
+				data = order.AppendUint32(data, v)
+			}
+		}
+		if f.kind == tiffRational {
+			count /= 2
+		}
+		dir = order.AppendUint16(dir, f.tag)
+		dir = order.AppendUint16(dir, f.kind)
+		dir = order.AppendUint32(dir, uint32(count))
+		if len(data) <= 4 {
+			dir = append(dir, data...)
+			dir = append(dir, make([]byte, 4-len(data))...)
+			continue
+		}
+		dir = order.AppendUint32(dir, valuesPos+uint32(len(values)))
+		values = append(values, data...)
+	}
+	dir = order.AppendUint32(dir, 0) // No next directory
+	return append(dir, values...)
+}
@@ -0,0 +1,492 @@
+package restoration
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+)
+
+// bandBytesPerPixel estimates the peak working memory of the tiled pipeline per pixel of a band:
+// float working copies, 16-bit intermediates and the mask, edge and feather maps.
+const bandBytesPerPixel = 192
+
+// RestoreTiled runs the restoration pipeline on horizontal bands of the image, so that the
+// working memory of the stages stays below memoryLimit bytes however large the scan is. The
+// limit does not cover the photo itself: img is read in place and the result is allocated
+// whole. RestoreTiledToDisk keeps the result in a temporary file instead, and LoadImageToDisk
+// the photo. Every band is read with a halo of extra rows above and below, covering how far the
+// enabled stages reach, and only its own rows are kept, so the result matches Restore with the
+// same options.
+//
+// Levels, white balance, contrast correction, colour transfer and toning preservation depend on
+// the whole photo: their histograms and statistics are gathered over every band in a first pass
+// and then applied band by band. The inpainted rows are kept in a temporary file meanwhile, and
+// the statistics summed in floating point (shades of gray, Reinhard transfer, toning) may differ
+// from those of Restore in the last bits. The gradient edge map is normalised by the strongest
+// edge of the whole photo, so the stages before edge detection also run over every band once to
+// find it, unless EdgeOptions.Scale is set.
+//
+// The Canny and multi-scale edge sources and coarse-to-fine inpainting need the whole image and
+// are rejected, as is the wrap border mode, which reads the opposite edge of the photo.
+//
+// The limit covers the working data of a band and the tables of the stages. The result has the
+// bit depth of the input: 8-bit photos come back as *image.NRGBA and 16-bit ones as *image.NRGBA64.
+func RestoreTiled(img image.Image, opts Options, memoryLimit int64) (*Result, error) {
+	return restoreTiled(img, opts, memoryLimit, false)
+}
+
+// RestoreTiledToDisk is RestoreTiled writing the restored rows, and the debug mask, to temporary
+// files instead of memory: Result.Image is a *StoredImage, which EncodeImage writes band by band.
+// With a photo loaded by LoadImageToDisk, only memoryLimit and the caches of the stored images
+// are held in memory. Close Result.Image once it is saved.
+func RestoreTiledToDisk(img image.Image, opts Options, memoryLimit int64) (*Result, error) {
+	return restoreTiled(img, opts, memoryLimit, true)
+}
+
+// restoreTiled runs RestoreTiled, keeping the result in memory or, with toDisk, in a temporary file.
+func restoreTiled(img image.Image, opts Options, memoryLimit int64, toDisk bool) (result *Result, err error) {
+	if err := checkTiled(opts); err != nil {
+		return nil, err
+	}
+	opts = opts.withBorder()
+	bounds := img.Bounds()
+	t := &tiledRun{img: img, opts: opts, width: bounds.Dx(), height: bounds.Dy()}
+	t.edgeHalo, t.repairHalo, t.smoothHalo = tiledHalo(opts)
+	halo := t.repairHalo + t.smoothHalo
+	t.stages = tiledStages(opts, t.width, t.height, memoryLimit)
+
+	// Band height left by the limit once the tables of the stages and the halo are paid for
+	var tables int64
+	for _, stage := range t.stages {
+		tables += stage.tableBytes()
+	}
+	rowBytes := int64(bandBytesPerPixel) * int64(t.width)
+	t.rows = int((memoryLimit-tables)/max64(rowBytes, 1)) - 2*halo
+	if t.rows < 1 {
+		return nil, fmt.Errorf("memory limit of %d bytes is too small for %d-pixel wide bands with a %d-row halo (at least %d bytes needed)",
+			memoryLimit, t.width, halo, tables+rowBytes*int64(2*halo+1))
+	}
+
+	result = &Result{Cast: NeutralCast}
+	if opts.PreserveToning {
+		if result.Toning, err = measureToning(img, opts, t.rows); err != nil {
+			return nil, err
+		}
+		t.toning = result.Toning
+	}
+	if err := t.measureEdgeScale(); err != nil {
+		return nil, err
+	}
+
+	if toDisk {
+		model := color.NRGBAModel
+		if is16Bit(img) {
+			model = color.NRGBA64Model
+		}
+		out, err := newStoredImage(t.width, t.height, model)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if result == nil {
+				out.Close() // Failed: nobody else will remove the file
+			}
+		}()
+		t.out = out
+		if opts.MaskPath != "" {
+			maskImg, err := newStoredImage(t.width, t.height, color.GrayModel)
+			if err != nil {
+				return nil, err
+			}
+			defer maskImg.Close()
+			t.maskImg = maskImg
+		}
+	} else {
+		if is16Bit(img) {
+			t.out = image.NewNRGBA64(bounds)
+		} else {
+			t.out = image.NewNRGBA(bounds)
+		}
+		if opts.MaskPath != "" {
+			t.maskImg = image.NewGray(image.Rect(0, 0, t.width, t.height))
+		}
+	}
+
+	if anyMeasured(t.stages) {
+		err = t.runMeasured()
+	} else {
+		err = t.runSingle()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range t.stages {
+		if cast, ok := stage.(*castStage); ok {
+			result.Cast = cast.cast
+		}
+	}
+
+	if t.maskImg != nil {
+		if err := saveMask(t.maskImg, opts.MaskPath); err != nil {
+			return nil, err
+		}
+	}
+	result.Image = t.out
+	return result, nil
+}
+
+// checkTiled rejects the options RestoreTiled cannot run band by band.
+func checkTiled(opts Options) error {
+	if err := checkOptions(opts); err != nil {
+		return err
+	}
+	var stage string
+	switch {
+	case tiledWraps(opts):
+		stage = "the wrap border mode"
+	case opts.Edges == EdgeSourceCanny:
+		stage = "the Canny edge source"
+	case opts.Edges == EdgeSourceMultiScale:
+		stage = "the multi-scale edge source"
+	case opts.PyramidLevels > 1:
+		stage = "coarse-to-fine inpainting"
+	default:
+		return nil
+	}
+	return errors.New(stage + " needs the whole image and cannot run in tiled mode")
+}
+
+// tiledWraps reports whether a stage reads pixels beyond the image from its opposite side, which
+// the halo of a band cannot provide.
+func tiledWraps(opts Options) bool {
+	opts = opts.withBorder()
+	return opts.Border == BorderWrap || opts.EdgeOptions.Border == BorderWrap ||
+		opts.Denoise && opts.NLMeans.Border == BorderWrap ||
+		opts.Sharpen == SharpenUnsharp && opts.Unsharp.Border == BorderWrap
+}
+
+// tiledHalo returns how many rows around a band the stages up to edge detection (edgeHalo), the
+// stages up to inpainting (repairHalo) and the final smoothing (smoothHalo) read. Every stage
+// adds its reach to that of the stages before it, so a band read with repairHalo + smoothHalo
+// rows runs the whole pipeline.
+func tiledHalo(opts Options) (edgeHalo, repairHalo, smoothHalo int) {
+	if opts.NoiseFilter != NoiseFilterNone {
+		edgeHalo += opts.MedianRadius
+	}
+	if opts.Denoise {
+		edgeHalo += opts.NLMeans.SearchRadius + opts.NLMeans.PatchRadius
+	}
+	if opts.DustMaxArea > 0 {
+		edgeHalo += opts.DustMaxArea + opts.DustRadius // A speck cut by the band border must be seen whole
+	}
+	if opts.EdgeOptions.Operator == OperatorLoG {
+		edgeHalo += int(math.Ceil(3*opts.EdgeOptions.LoGSigma)) + 1 // Kernel and zero crossing
+	} else {
+		edgeHalo++ // 3x3 gradient kernels
+	}
+
+	repairHalo = edgeHalo + opts.FeatherRadius + 5 + 1 // Feathering, blending window and inpainting smoothing
+	if opts.FollowIsophotes {
+		repairHalo += 1 + int(math.Ceil(3*opts.TensorSigma))
+	}
+	smoothHalo = 1 // Final blur
+	if opts.Sharpen == SharpenUnsharp {
+		smoothHalo += int(math.Ceil(3 * opts.Unsharp.Radius))
+	} else {
+		smoothHalo++
+	}
+	return edgeHalo, repairHalo, smoothHalo
+}
+
+// tiledRun holds what the passes of RestoreTiled share.
+type tiledRun struct {
+	img                              image.Image
+	opts                             Options
+	width, height                    int
+	rows                             int // Rows of a band, without its halo
+	edgeHalo, repairHalo, smoothHalo int
+	toning                           ToningAnalysis
+	stages                           []bandStage
+	out                              image.Image // *image.NRGBA64, *image.NRGBA or *StoredImage
+	maskImg                          image.Image // *image.Gray or *StoredImage
+}
+
+// bands calls fn with the first row and the height of every band in turn.
+func (t *tiledRun) bands(fn func(y, n int) error) error {
+	for y := 0; y < t.height; y += t.rows {
+		if err := fn(y, min(t.rows, t.height-y)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// measureEdgeScale sets the scale of the gradient edge map to the strongest edge of the whole
+// photo, measured on the own rows of every band.
+func (t *tiledRun) measureEdgeScale() error {
+	opts := &t.opts
+	if opts.Edges != EdgeSourceGradient || opts.EdgeOptions.Scale != 0 {
+		return nil
+	}
+	err := t.bands(func(y, n int) error {
+		band, top, err := readBand(t.img, y, y+n, t.edgeHalo)
+		if err != nil {
+			return err
+		}
+		prepared, _, err := t.prepareBand(band, nil)
+		if err != nil {
+			return err
+		}
+		edges := edgeMagnitude(toFloatImage(prepared, opts.NumWorkers), opts.EdgeOptions, opts.NumWorkers)
+		opts.EdgeOptions.Scale = math.Max(opts.EdgeOptions.Scale, maxEdge(edges.rows(top, top+n), opts.NumWorkers))
+		return nil
+	})
+	if opts.EdgeOptions.Scale == 0 {
+		opts.EdgeOptions.Scale = 1 // Flat photo: no edges to normalise
+	}
+	return err
+}
+
+// runSingle runs the pipeline in one pass when no stage needs to measure the photo: every band
+// is read with the whole halo, inpainted, mapped and smoothed.
+func (t *tiledRun) runSingle() error {
+	for _, stage := range t.stages {
+		stage.finish()
+	}
+	return t.bands(func(y, n int) error {
+		band, top, err := readBand(t.img, y, y+n, t.repairHalo+t.smoothHalo)
+		if err != nil {
+			return err
+		}
+		restored, err := t.repairBand(band, top, n, y)
+		if err != nil {
+			return err
+		}
+		return t.finishBand(restored, y-top, top, n)
+	})
+}
+
+// runMeasured inpaints every band into a temporary row store, measures the stages one after the
+// other over the stored rows, each seeing the rows mapped by the stages before it, and finally
+// maps and smooths the stored bands.
+func (t *tiledRun) runMeasured() error {
+	store, err := newRowStore(t.width, t.height)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = t.bands(func(y, n int) error {
+		band, top, err := readBand(t.img, y, y+n, t.repairHalo)
+		if err != nil {
+			return err
+		}
+		restored, err := t.repairBand(band, top, n, y)
+		if err != nil {
+			return err
+		}
+		return store.writeRows(restored, top, n, y)
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, stage := range t.stages {
+		if stage.measured() {
+			err := t.bands(func(y, n int) error {
+				rows, err := store.readRows(y, y+n)
+				if err != nil {
+					return err
+				}
+				stage.measure(mapBand(t.stages[:k], rows, y), y)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		stage.finish()
+	}
+
+	return t.bands(func(y, n int) error {
+		top := min(t.smoothHalo, y)
+		rows, err := store.readRows(y-top, min(y+n+t.smoothHalo, t.height))
+		if err != nil {
+			return err
+		}
+		return t.finishBand(rows, y-top, top, n)
+	})
+}
+
+// repairBand runs the pipeline up to inpainting on a band whose n own rows start at row top of
+// the band and at row y of the photo, drawing its scratch mask into the debug mask.
+func (t *tiledRun) repairBand(band image.Image, top, n, y int) (*image.NRGBA64, error) {
+	var keepMask func(Mask)
+	var maskErr error
+	if t.maskImg != nil {
+		keepMask = func(mask Mask) { maskErr = storeMaskRows(t.maskImg, mask, top, n, y) }
+	}
+	prepared, mask, err := t.prepareBand(band, keepMask)
+	if err == nil {
+		err = maskErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repairDamage(prepared, mask, t.opts.FeatherRadius, t.opts), nil
+}
+
+// finishBand maps an inpainted band whose first row is row y of the photo through the stages,
+// smooths it, gives it its toning back and writes its n own rows, from row top, into the result.
+func (t *tiledRun) finishBand(band *image.NRGBA64, y, top, n int) error {
+	opts := t.opts
+	restored := finalSmoothing(mapBand(t.stages, band, y), opts)
+	if t.toning.Kind != ToningColor {
+		restored = applyToning(restored, t.toning, rgbSpaceOf(opts), opts.NumWorkers)
+	}
+	if opts.Profile != nil {
+		restored = ProfileFromWorkingConcurrent(restored, opts.Profile, opts.OutputProfile, opts.NumWorkers)
+	}
+	return writeBand(t.out, restored, top, n, y+top, opts.NumWorkers)
+}
+
+// prepareBand runs the stages before edge detection on a band: conversion to the working space,
+// desaturation of toned prints, noise filtering, mask creation and dust repair. keepMask, when
+// not nil, receives the scratch mask before dust repair.
+func (t *tiledRun) prepareBand(band image.Image, keepMask func(Mask)) (image.Image, Mask, error) {
+	opts := t.opts
+	numWorkers := opts.NumWorkers
+	if opts.Profile != nil {
+		band = ProfileToWorkingConcurrent(band, opts.Profile, numWorkers)
+	}
+	if t.toning.Kind != ToningColor {
+		band = desaturate(band, rgbSpaceOf(opts), numWorkers)
+	}
+	band = filterNoise(band, opts)
+	damage, err := CreateMaskByChunks(band, "", numWorkers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keepMask != nil {
+		keepMask(damage)
+	}
+	var mask Mask = damage
+	if opts.DustMaxArea > 0 {
+		band, mask = RepairDustConcurrent(band, mask, opts.DustMaxArea, opts.DustRadius, numWorkers)
+	}
+	return band, SparseMask(mask), nil
+}
+
+// readBand returns the local rows [startY, endY) of an image and up to halo rows on either side,
+// starting at (0, 0), and the row of startY in it. The rows of a *StoredImage are read from its
+// file, those of other images are viewed in place by viewBand.
+func readBand(img image.Image, startY, endY, halo int) (image.Image, int, error) {
+	if stored, ok := img.(*StoredImage); ok {
+		top := min(halo, startY)
+		band, err := stored.band(startY-top, min(endY+halo, stored.Bounds().Dy()))
+		return band, top, err
+	}
+	band, top := viewBand(img, startY, endY, halo)
+	return band, top, nil
+}
+
+// viewBand returns a view of the local rows [startY, endY) of an image and up to halo rows on
+// either side, starting at (0, 0), and the row of startY in it. The view reads the image itself,
+// so every stage sees the same colours as in Restore.
+func viewBand(img image.Image, startY, endY, halo int) (image.Image, int) {
+	bounds := img.Bounds()
+	top := min(halo, startY)
+	bottom := min(endY+halo, bounds.Dy())
+	rect := image.Rect(bounds.Min.X, bounds.Min.Y+startY-top, bounds.Max.X, bounds.Min.Y+bottom)
+	return bandView{img: img, rect: rect}, top
+}
+
+// bandView shows a rectangle of an image as an image of its own with its origin at (0, 0).
+type bandView struct {
+	img  image.Image
+	rect image.Rectangle
+}
+
+// ColorModel returns the colour model of the viewed image.
+func (v bandView) ColorModel() color.Model { return v.img.ColorModel() }
+
+// Bounds returns the size of the viewed rectangle, with its origin at (0, 0).
+func (v bandView) Bounds() image.Rectangle { return image.Rect(0, 0, v.rect.Dx(), v.rect.Dy()) }
+
+// At returns the colour of the viewed image at the matching position.
+func (v bandView) At(x, y int) color.Color { return v.img.At(v.rect.Min.X+x, v.rect.Min.Y+y) }
+
+// writeBand copies n rows of a processed band, starting at row top, into the result at local
+// row y.
+func writeBand(out image.Image, band *image.NRGBA64, top, n, y, numWorkers int) error {
+	bounds := out.Bounds()
+	if stored, ok := out.(*StoredImage); ok {
+		var rows image.Image = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), n))
+		if stored.ColorModel() == color.NRGBA64Model {
+			rows = image.NewNRGBA64(rows.Bounds())
+		}
+		writeBand(rows, band, top, n, 0, numWorkers)
+		return stored.writeBand(rows, y)
+	}
+	parallelRows(n, numWorkers, func(y0, y1 int) {
+		for r := y0; r < y1; r++ {
+			src := band.Pix[(top+r)*band.Stride : (top+r)*band.Stride+8*bounds.Dx()]
+			switch dst := out.(type) {
+			case *image.NRGBA64:
+				copy(dst.Pix[(y+r)*dst.Stride:], src)
+			case *image.NRGBA:
+				row := dst.Pix[(y+r)*dst.Stride:]
+				for i := range row[:4*bounds.Dx()] {
+					v := float32(uint16(src[2*i])<<8|uint16(src[2*i+1])) / 0xffff
+					row[i] = uint8(clamp01(v)*0xff + 0.5) // Rounded as floatImage.toNRGBA does
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// storeMaskRows draws n rows of the scratch mask of a band, starting at row top, into the
+// debug mask image at row y.
+func storeMaskRows(maskImg image.Image, mask Mask, top, n, y int) error {
+	width, _ := mask.Size()
+	if stored, ok := maskImg.(*StoredImage); ok {
+		rows := image.NewGray(image.Rect(0, 0, width, n))
+		storeMaskRows(rows, mask, top, n, 0)
+		return stored.writeBand(rows, y)
+	}
+	dst := maskImg.(*image.Gray)
+	for r := 0; r < n; r++ {
+		for x := 0; x < width; x++ {
+			if mask.At(x, top+r) == 1.0 {
+				dst.Pix[(y+r)*dst.Stride+x] = 0xff
+			}
+		}
+	}
+	return nil
+}
+
+// saveMask writes the debug scratch mask as a JPEG image.
+func saveMask(maskImg image.Image, outputPath string) error {
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	if err := jpeg.Encode(outputFile, maskImg, nil); err != nil {
+		return err
+	}
+	return outputFile.Close()
+}
+
+// max64 returns the larger of two int64 values.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,304 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bandLimit returns a memory limit giving bands of the given height for a photo of the given size.
+func bandLimit(opts Options, width, height, rows int) int64 {
+	_, repairHalo, smoothHalo := tiledHalo(opts)
+	var tables int64
+	for _, stage := range tiledStages(opts, width, height, 1<<30) {
+		tables += stage.tableBytes()
+	}
+	return tables + int64(bandBytesPerPixel)*int64(width)*int64(rows+2*(repairHalo+smoothHalo))
+}
+
+// closeImages reports the first pixel where a channel of two images differs by more than tolerance.
+func closeImages(t *testing.T, got, want image.Image, tolerance int) {
+	t.Helper()
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Size() != wb.Size() {
+		t.Fatalf("size %v, want %v", gb.Size(), wb.Size())
+	}
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			g := color.NRGBA64Model.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.NRGBA64)
+			w := color.NRGBA64Model.Convert(want.At(wb.Min.X+x, wb.Min.Y+y)).(color.NRGBA64)
+			for _, d := range []int{int(g.R) - int(w.R), int(g.G) - int(w.G), int(g.B) - int(w.B), int(g.A) - int(w.A)} {
+				if d < -tolerance || d > tolerance {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+// sepiaPhoto returns scratchedPhoto toned brown, as an old sepia print.
+func sepiaPhoto(width, height int) *image.NRGBA64 {
+	img := scratchedPhoto(width, height)
+	for i := 0; i < len(img.Pix); i += 8 {
+		v := (uint32(img.Pix[i])<<8 | uint32(img.Pix[i+1])) / 2
+		v += (uint32(img.Pix[i+2])<<8 | uint32(img.Pix[i+3])) / 2
+		for c, scale := range []uint32{100, 85, 65} {
+			w := v * scale / 100
+			img.Pix[i+2*c], img.Pix[i+2*c+1] = uint8(w>>8), uint8(w)
+		}
+	}
+	return img
+}
+
+func TestRestoreTiledMatchesRestore(t *testing.T) {
+	photo := scratchedPhoto(64, 48)
+
+	stages := []struct {
+		name string
+		set  func(*Options)
+	}{
+		{"plain", func(*Options) {}},
+		{"isophotes and unsharp", func(o *Options) {
+			o.FollowIsophotes = true
+			o.Sharpen = SharpenUnsharp
+		}},
+		{"median, denoise and dust", func(o *Options) {
+			o.NoiseFilter = NoiseFilterMedian
+			o.Denoise = true
+			o.DustMaxArea = 4
+		}},
+		{"laplacian of gaussian", func(o *Options) {
+			o.EdgeOptions.Operator = OperatorLoG
+			o.EdgeOptions.LoGSigma = 1
+		}},
+	}
+	for _, border := range []string{"clamp", "reflect", "constant"} {
+		mode, err := ParseBorderMode(border)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stage := range stages {
+			t.Run(border+"/"+stage.name, func(t *testing.T) {
+				opts := testOptions()
+				opts.Border = mode
+				stage.set(&opts)
+
+				want, err := Restore(photo, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := RestoreTiled(photo, opts, bandLimit(opts, 64, 48, 5))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sameImages(t, got.Image, want.Image)
+			})
+		}
+	}
+}
+
+func TestRestoreTiledGlobalStages(t *testing.T) {
+	photo, sepia := scratchedPhoto(64, 48), sepiaPhoto(64, 48)
+	reference := randomImage(40, 30, false, 5)
+
+	tests := []struct {
+		name      string
+		photo     image.Image
+		set       func(*Options)
+		tolerance int // Largest difference per 16-bit channel, for statistics summed in floating point
+	}{
+		{"default options", photo, func(*Options) {}, 0},
+		{"automatic levels", photo, func(o *Options) {
+			o.AdjustLevels = true
+			o.LevelsOptions.Gamma = [3]float64{1.2, 1, 0.9}
+		}, 0},
+		{"manual levels only", photo, func(o *Options) {
+			o.AdjustLevels = true
+			o.LevelsOptions = LevelsOptions{Black: [3]float64{10, 20, 30}}
+			o.ColorCorrection = ColorCorrectionNone
+		}, 0},
+		{"gray world", photo, func(o *Options) { o.WhiteBalance.Method = WhiteBalanceGrayWorld }, 0},
+		{"white patch", photo, func(o *Options) { o.WhiteBalance.Method = WhiteBalanceWhitePatch }, 0},
+		{"shades of gray", photo, func(o *Options) {
+			o.WhiteBalance.Method = WhiteBalanceShadesOfGray
+			o.ColorCorrection = ColorCorrectionNone
+		}, 2},
+		{"equalised L*", photo, func(o *Options) { o.EqualizeSpace = ColorSpaceLab }, 0},
+		{"CLAHE", photo, func(o *Options) { o.ColorCorrection = ColorCorrectionCLAHE }, 0},
+		{"CLAHE on Y", photo, func(o *Options) {
+			o.ColorCorrection = ColorCorrectionCLAHE
+			o.EqualizeSpace = ColorSpaceYCbCr
+		}, 0},
+		{"histogram transfer", photo, func(o *Options) {
+			o.Transfer = TransferHistogram
+			o.Reference = reference
+		}, 0},
+		{"Reinhard transfer", photo, func(o *Options) {
+			o.ColorCorrection = ColorCorrectionNone
+			o.Transfer = TransferReinhard
+			o.Reference = reference
+		}, 2},
+		{"toning", sepia, func(o *Options) { o.PreserveToning = true }, 2},
+		{"every stage", photo, func(o *Options) {
+			o.AdjustLevels = true
+			o.WhiteBalance.Method = WhiteBalanceWhitePatch
+			o.ColorCorrection = ColorCorrectionCLAHE
+			o.EqualizeSpace = ColorSpaceHSV
+			o.Transfer = TransferHistogram
+			o.Reference = reference
+			o.Sharpen = SharpenUnsharp
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			tt.set(&opts)
+			bounds := tt.photo.Bounds()
+
+			want, err := Restore(tt.photo, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := RestoreTiled(tt.photo, opts, bandLimit(opts, bounds.Dx(), bounds.Dy(), 5))
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeImages(t, got.Image, want.Image, tt.tolerance)
+			for _, d := range []float64{got.Cast.R - want.Cast.R, got.Cast.G - want.Cast.G, got.Cast.B - want.Cast.B} {
+				if math.Abs(d) > 1e-9 {
+					t.Errorf("cast %v, want %v", got.Cast, want.Cast)
+				}
+			}
+			if got.Toning.Kind != want.Toning.Kind {
+				t.Errorf("toning %v, want %v", got.Toning.Kind, want.Toning.Kind)
+			}
+		})
+	}
+	if toning := DetectToning(sepia, 3); toning.Kind != ToningSepia {
+		t.Errorf("test photo has %v toning, want sepia", toning.Kind)
+	}
+}
+
+// storedCopy copies an image into a StoredImage of the given colour model, removed at the end
+// of the test.
+func storedCopy(t *testing.T, img image.Image, model color.Model) *StoredImage {
+	t.Helper()
+	bounds := img.Bounds()
+	stored, err := newStoredImage(bounds.Dx(), bounds.Dy(), model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stored.Close() })
+	var band draw.Image
+	switch model {
+	case color.NRGBAModel:
+		band = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	case color.GrayModel:
+		band = image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	default:
+		band = image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	}
+	draw.Draw(band, band.Bounds(), img, bounds.Min, draw.Src)
+	if err := stored.writeBand(band, 0); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestRestoreTiledToDisk(t *testing.T) {
+	photo := scratchedPhoto(64, 48)
+	photo8 := image.NewNRGBA(photo.Bounds())
+	draw.Draw(photo8, photo8.Bounds(), photo, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name  string
+		photo image.Image
+		set   func(*Options)
+	}{
+		{"16-bit", photo, func(*Options) {}},
+		{"8-bit", photo8, func(o *Options) { o.Sharpen = SharpenUnsharp }},
+		{"stored 16-bit", storedCopy(t, photo, color.NRGBA64Model), func(o *Options) {
+			o.NoiseFilter = NoiseFilterMedian
+			o.DustMaxArea = 4
+		}},
+		{"stored 8-bit with global stages", storedCopy(t, photo8, color.NRGBAModel), func(o *Options) {
+			o.AdjustLevels = true
+			o.WhiteBalance.Method = WhiteBalanceWhitePatch
+			o.ColorCorrection = ColorCorrectionCLAHE
+		}},
+		{"toning", storedCopy(t, sepiaPhoto(64, 48), color.NRGBA64Model), func(o *Options) { o.PreserveToning = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			tt.set(&opts)
+			limit := bandLimit(opts, 64, 48, 5)
+			dir := t.TempDir()
+
+			opts.MaskPath = filepath.Join(dir, "want.jpg")
+			want, err := RestoreTiled(tt.photo, opts, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.MaskPath = filepath.Join(dir, "got.jpg")
+			got, err := RestoreTiledToDisk(tt.photo, opts, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, ok := got.Image.(*StoredImage)
+			if !ok {
+				t.Fatalf("result is a %T, want a *StoredImage", got.Image)
+			}
+			defer stored.Close()
+
+			sameImages(t, stored, want.Image)
+			if is16Bit(stored) != is16Bit(want.Image) {
+				t.Errorf("16-bit result %v, want %v", is16Bit(stored), is16Bit(want.Image))
+			}
+			if got.Cast != want.Cast || got.Toning.Kind != want.Toning.Kind {
+				t.Errorf("cast %v and %v toning, want %v and %v", got.Cast, got.Toning.Kind, want.Cast, want.Toning.Kind)
+			}
+
+			// The stored mask is written as a colour JPEG, the in-memory one as a gray JPEG
+			gotMask, err := LoadImage(filepath.Join(dir, "got.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantMask, err := LoadImage(filepath.Join(dir, "want.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeImages(t, gotMask, wantMask, 0x800)
+		})
+	}
+}
+
+func TestRestoreTiledRejectsWrap(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*Options)
+	}{
+		{"pipeline border", func(o *Options) { o.Border = BorderWrap }},
+		{"edge border", func(o *Options) { o.EdgeOptions.Border = BorderWrap }},
+		{"denoise border", func(o *Options) {
+			o.Denoise = true
+			o.NLMeans.Border = BorderWrap
+		}},
+		{"unsharp border", func(o *Options) {
+			o.Sharpen = SharpenUnsharp
+			o.Unsharp.Border = BorderWrap
+		}},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		tt.set(&opts)
+		_, err := RestoreTiled(scratchedPhoto(16, 16), opts, 1<<30)
+		if err == nil || !strings.Contains(err.Error(), "wrap") {
+			t.Errorf("%s: error %v, want the wrap border rejected", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package restoration
+
+import (
+	"image"
+)
+
+// bandStage is a stage run after inpainting that maps every pixel on its own, once it has
+// measured the whole photo. RestoreTiled measures it over every band first, then applies it
+// band by band, so its histograms and statistics are those of the whole photo.
+type bandStage interface {
+	measured() bool                                  // Whether the stage needs a measuring pass over the photo
+	measure(band *image.NRGBA64, y int)              // Accumulate the statistics of rows whose first is image row y
+	finish()                                         // Turn the statistics into the mapping of the stage
+	apply(band *image.NRGBA64, y int) *image.NRGBA64 // Map rows whose first is image row y
+	tableBytes() int64                               // Memory held by the statistics and the mapping
+}
+
+// tiledStages returns the stages that Restore runs between inpainting and the final smoothing,
+// in the same order, for a photo of the given size. The reference of the colour transfer is
+// measured here, in bands that fit memoryLimit.
+func tiledStages(opts Options, width, height int, memoryLimit int64) []bandStage {
+	numWorkers := opts.NumWorkers
+	rgb := rgbSpaceOf(opts)
+	bins := histogramBins(width * height)
+
+	var stages []bandStage
+	if opts.AdjustLevels {
+		stages = append(stages, &levelsStage{opts: opts.LevelsOptions, bins: bins, numWorkers: numWorkers})
+	}
+	if opts.WhiteBalance.Method != WhiteBalanceNone {
+		stages = append(stages, &castStage{opts: opts.WhiteBalance, bins: bins, numWorkers: numWorkers})
+	}
+	switch opts.ColorCorrection {
+	case ColorCorrectionHistEqual:
+		stages = append(stages, &equalizeStage{
+			space: opts.EqualizeSpace, rgb: rgb, channels: lightnessChannels(opts.EqualizeSpace),
+			bins: bins, numWorkers: numWorkers,
+		})
+	case ColorCorrectionCLAHE:
+		grid := newCLAHEGrid(width, height, opts.CLAHE, lightnessChannels(opts.EqualizeSpace))
+		stages = append(stages, &claheStage{
+			grid: grid, space: opts.EqualizeSpace, rgb: rgb, clipLimit: opts.CLAHE.ClipLimit,
+			hists: make([][4][]float64, len(grid.luts)), totals: make([]float64, len(grid.luts)),
+			numWorkers: numWorkers,
+		})
+	}
+	switch opts.Transfer {
+	case TransferReinhard:
+		stage := &reinhardStage{rgb: rgb, numWorkers: numWorkers}
+		var ref moments
+		measureReference(opts, memoryLimit, func(band *floatImage) {
+			ref.add(toColorSpace(band, ColorSpaceLab, rgb, numWorkers), numWorkers)
+		})
+		stage.refMean, stage.refStd = ref.meanStd()
+		stages = append(stages, stage)
+	case TransferHistogram:
+		refBounds := opts.Reference.Bounds()
+		stage := &matchStage{bins: histogramBins(max(width*height, refBounds.Dx()*refBounds.Dy())), numWorkers: numWorkers}
+		measureReference(opts, memoryLimit, func(band *floatImage) {
+			for c, hist := range rgbHistograms(band, stage.bins, numWorkers) {
+				stage.refHists[c] = addCounts(stage.refHists[c], hist)
+			}
+		})
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// measureReference passes the reference photo of the colour transfer to fn in bands that fit
+// memoryLimit, converted to the space the pipeline works in as workingReference does.
+func measureReference(opts Options, memoryLimit int64, fn func(band *floatImage)) {
+	bounds := opts.Reference.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rows := clampInt(int(memoryLimit/max64(int64(bandBytesPerPixel)*int64(width), 1)), 1, max(height, 1))
+	for y := 0; y < height; y += rows {
+		band, _ := viewBand(opts.Reference, y, min(y+rows, height), 0)
+		if opts.Profile != nil {
+			band = ProfileToWorkingConcurrent(band, srgbProfile, opts.NumWorkers)
+		}
+		fn(toFloatImage(band, opts.NumWorkers))
+	}
+}
+
+// mapBand applies stages to rows of the photo whose first is image row y.
+func mapBand(stages []bandStage, band *image.NRGBA64, y int) *image.NRGBA64 {
+	for _, stage := range stages {
+		band = stage.apply(band, y)
+	}
+	return band
+}
+
+// levelsStage is the levels and curves stage; automatic levels measure the channel histograms.
+type levelsStage struct {
+	opts       LevelsOptions
+	bins       int
+	hists      [3][]int
+	luts       [3][]float32
+	numWorkers int
+}
+
+func (s *levelsStage) measured() bool { return s.opts.Auto }
+
+func (s *levelsStage) measure(band *image.NRGBA64, y int) {
+	for c, hist := range rgbHistograms(toFloatImage(band, s.numWorkers), s.bins, s.numWorkers) {
+		s.hists[c] = addCounts(s.hists[c], hist)
+	}
+}
+
+func (s *levelsStage) finish() {
+	black, white := s.opts.Black, s.opts.White
+	if s.opts.Auto {
+		black, white = levelsFromHistograms(s.hists, s.opts.Clip)
+		s.hists = [3][]int{}
+	}
+	s.luts = levelsLUTs(s.opts, black, white)
+}
+
+func (s *levelsStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	return applyLUTs(toFloatImage(band, s.numWorkers), s.luts, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+func (s *levelsStage) tableBytes() int64 { return 3*8*int64(s.bins) + 3*4*lutSize }
+
+// castStage is the white balance stage, measuring what the estimator of opts.Method needs.
+type castStage struct {
+	opts WhiteBalanceOptions
+	bins int
+
+	sums   [3]uint64  // Gray world: sums of the 16-bit values
+	count  uint64     // Gray world: visible pixels
+	hists  [3][]int   // White patch: channel histograms
+	powers [3]float64 // Shades of gray: sums of v^p
+	n      float64    // Shades of gray: visible pixels
+
+	cast       ColorCast
+	numWorkers int
+}
+
+func (s *castStage) measured() bool { return true }
+
+func (s *castStage) measure(band *image.NRGBA64, y int) {
+	switch s.opts.Method {
+	case WhiteBalanceGrayWorld:
+		sums, count := colorSums(band)
+		for c := range s.sums {
+			s.sums[c] += sums[c]
+		}
+		s.count += count
+	case WhiteBalanceWhitePatch:
+		for c, hist := range rgbHistograms(toFloatImage(band, s.numWorkers), s.bins, s.numWorkers) {
+			s.hists[c] = addCounts(s.hists[c], hist)
+		}
+	case WhiteBalanceShadesOfGray:
+		powers, n := minkowskiSums(toFloatImage(band, s.numWorkers), s.opts.Norm, s.numWorkers)
+		for c := range s.powers {
+			s.powers[c] += powers[c]
+		}
+		s.n += n
+	}
+}
+
+func (s *castStage) finish() {
+	var r, g, b float64
+	switch s.opts.Method {
+	case WhiteBalanceGrayWorld:
+		avgR, avgG, avgB, _ := averageColor(s.sums, s.count).RGBA()
+		r, g, b = float64(avgR), float64(avgG), float64(avgB)
+	case WhiteBalanceWhitePatch:
+		r, g, b = whitePatchFromHistograms(s.hists, s.opts.Percentile)
+		s.hists = [3][]int{}
+	case WhiteBalanceShadesOfGray:
+		r, g, b = minkowskiFromSums(s.powers, s.n, s.opts.Norm)
+	}
+	s.cast = castOf(r, g, b)
+}
+
+func (s *castStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	return removeCast(toFloatImage(band, s.numWorkers), s.cast, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+func (s *castStage) tableBytes() int64 { return 3 * 8 * int64(s.bins) }
+
+// equalizeStage is global histogram equalisation of the lightness of a colour space.
+type equalizeStage struct {
+	space      ColorSpace
+	rgb        *rgbSpace
+	channels   Channels
+	bins       int
+	hists      [4][]int
+	luts       [4][]float32
+	numWorkers int
+}
+
+func (s *equalizeStage) measured() bool { return true }
+
+func (s *equalizeStage) measure(band *image.NRGBA64, y int) {
+	src := toColorSpace(toFloatImage(band, s.numWorkers), s.space, s.rgb, s.numWorkers)
+	for c := range s.hists {
+		if s.channels&(1<<c) != 0 {
+			s.hists[c] = addCounts(s.hists[c], channelHistogram(src, c, s.bins, s.numWorkers))
+		}
+	}
+}
+
+func (s *equalizeStage) finish() {
+	for c, hist := range s.hists {
+		if hist != nil {
+			s.luts[c] = equalizationLUT(hist)
+		}
+	}
+	s.hists = [4][]int{}
+}
+
+func (s *equalizeStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	src := toColorSpace(toFloatImage(band, s.numWorkers), s.space, s.rgb, s.numWorkers)
+	equalized := applyChannelLUTs(src, s.luts, s.numWorkers)
+	return fromColorSpace(equalized, s.space, s.rgb, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+func (s *equalizeStage) tableBytes() int64 { return 4 * (8 + 4) * int64(s.bins) }
+
+// claheStage is CLAHE on the lightness of a colour space. The histogram of a tile is turned
+// into its lookup table as soon as the bands have covered the tile, so only the histograms of
+// the tiles under the current band are held.
+type claheStage struct {
+	grid       *claheGrid
+	space      ColorSpace
+	rgb        *rgbSpace
+	clipLimit  float64
+	hists      [][4][]float64 // Histograms of the tiles not yet covered
+	totals     []float64      // Visible pixels counted in every tile
+	numWorkers int
+}
+
+func (s *claheStage) measured() bool { return true }
+
+func (s *claheStage) measure(band *image.NRGBA64, y int) {
+	src := toColorSpace(toFloatImage(band, s.numWorkers), s.space, s.rgb, s.numWorkers)
+	channels := s.grid.channels
+	parallelRows(len(s.hists), s.numWorkers, func(start, end int) {
+		for t := start; t < end; t++ {
+			x0, x1, y0, y1 := s.grid.tile(t)
+			rowStart, rowEnd := max(y0, y), min(y1, y+src.Height)
+			if rowStart >= rowEnd {
+				continue
+			}
+			bins := tileBins(x0, x1, y0, y1)
+			for c := 0; c < 4; c++ {
+				if channels&(1<<c) != 0 && s.hists[t][c] == nil {
+					s.hists[t][c] = make([]float64, bins)
+				}
+			}
+			for row := rowStart; row < rowEnd; row++ {
+				for x := x0; x < x1; x++ {
+					i := src.offset(x, row-y)
+					if src.transparent(i) {
+						continue
+					}
+					for c := 0; c < 4; c++ {
+						if channels&(1<<c) != 0 {
+							s.hists[t][c][binOf(src.Pix[i+c], bins)]++
+						}
+					}
+					s.totals[t]++
+				}
+			}
+
+			// The last rows of the tile: its table is final
+			if rowEnd == y1 {
+				for c, hist := range s.hists[t] {
+					if hist != nil {
+						s.grid.luts[t][c] = clippedEqualization(hist, s.totals[t], s.clipLimit)
+					}
+				}
+				s.hists[t] = [4][]float64{}
+			}
+		}
+	})
+}
+
+func (s *claheStage) finish() {}
+
+func (s *claheStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	src := toColorSpace(toFloatImage(band, s.numWorkers), s.space, s.rgb, s.numWorkers)
+	equalized := s.grid.apply(src, y, s.numWorkers)
+	return fromColorSpace(equalized, s.space, s.rgb, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+// tableBytes counts the tables of every tile and the histograms of two rows of tiles, as a band
+// may straddle a tile border.
+func (s *claheStage) tableBytes() int64 {
+	g := s.grid
+	channels := int64(0)
+	for c := 0; c < 4; c++ {
+		if g.channels&(1<<c) != 0 {
+			channels++
+		}
+	}
+	x0, x1, y0, y1 := g.tile(0)
+	bins := int64(histogramBins((x1 - x0 + 1) * (y1 - y0 + 1)))
+	return channels * bins * (4*int64(len(g.luts)) + 8*2*int64(g.tilesX))
+}
+
+// reinhardStage matches the L*a*b* mean and standard deviation of the photo to the reference.
+type reinhardStage struct {
+	rgb             *rgbSpace
+	moments         moments
+	srcMean, srcStd [3]float64
+	refMean, refStd [3]float64
+	numWorkers      int
+}
+
+func (s *reinhardStage) measured() bool { return true }
+
+func (s *reinhardStage) measure(band *image.NRGBA64, y int) {
+	s.moments.add(toColorSpace(toFloatImage(band, s.numWorkers), ColorSpaceLab, s.rgb, s.numWorkers), s.numWorkers)
+}
+
+func (s *reinhardStage) finish() { s.srcMean, s.srcStd = s.moments.meanStd() }
+
+func (s *reinhardStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	src := toColorSpace(toFloatImage(band, s.numWorkers), ColorSpaceLab, s.rgb, s.numWorkers)
+	dst := transferLab(src, s.srcMean, s.srcStd, s.refMean, s.refStd, s.numWorkers)
+	return fromColorSpace(dst, ColorSpaceLab, s.rgb, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+func (s *reinhardStage) tableBytes() int64 { return 0 }
+
+// matchStage matches the R, G and B histograms of the photo to those of the reference.
+type matchStage struct {
+	bins            int
+	hists, refHists [3][]int
+	luts            [3][]float32
+	numWorkers      int
+}
+
+func (s *matchStage) measured() bool { return true }
+
+func (s *matchStage) measure(band *image.NRGBA64, y int) {
+	for c, hist := range rgbHistograms(toFloatImage(band, s.numWorkers), s.bins, s.numWorkers) {
+		s.hists[c] = addCounts(s.hists[c], hist)
+	}
+}
+
+func (s *matchStage) finish() {
+	for c := range s.luts {
+		s.luts[c] = matchLUT(cdfFractions(s.hists[c]), cdfFractions(s.refHists[c]))
+	}
+	s.hists, s.refHists = [3][]int{}, [3][]int{}
+}
+
+func (s *matchStage) apply(band *image.NRGBA64, y int) *image.NRGBA64 {
+	return applyLUTs(toFloatImage(band, s.numWorkers), s.luts, s.numWorkers).toNRGBA64(s.numWorkers)
+}
+
+func (s *matchStage) tableBytes() int64 { return 3 * (8 + 8 + 4) * int64(s.bins) }
+
+// measureToning accumulates the toning statistics of the photo band by band, converted to the
+// working space as in Restore.
+func measureToning(img image.Image, opts Options, rows int) (ToningAnalysis, error) {
+	var stats toningStats
+	height := img.Bounds().Dy()
+	for y := 0; y < height; y += rows {
+		band, _, err := readBand(img, y, min(y+rows, height), 0)
+		if err != nil {
+			return ToningAnalysis{}, err
+		}
+		if opts.Profile != nil {
+			band = ProfileToWorkingConcurrent(band, opts.Profile, opts.NumWorkers)
+		}
+		stats.add(toFloatImage(band, opts.NumWorkers), rgbSpaceOf(opts), opts.NumWorkers)
+	}
+	return stats.analysis(), nil
+}
+
+// anyMeasured reports whether one of the stages needs a measuring pass.
+func anyMeasured(stages []bandStage) bool {
+	for _, stage := range stages {
+		if stage.measured() {
+			return true
+		}
+	}
+	return false
+}
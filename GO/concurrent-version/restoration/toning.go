@@ -0,0 +1,190 @@
+package restoration
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// Toning classifies the colour content of a photo.
+type Toning int
+
+const (
+	ToningColor      Toning = iota // Full colour photo
+	ToningMonochrome               // Neutral black and white print
+	ToningSepia                    // Print toned with a single hue (sepia, selenium, cyanotype)
+)
+
+// String returns the lower case name of the toning.
+func (t Toning) String() string {
+	switch t {
+	case ToningMonochrome:
+		return "monochrome"
+	case ToningSepia:
+		return "sepia"
+	}
+	return "color"
+}
+
+const (
+	toningBins         = 16  // Lightness bands in which the toning is measured
+	toningMaxSpread    = 6.0 // Photos whose a*, b* standard deviation is below this have a single hue
+	toningMaxNeutral   = 3.0 // Single-hue photos whose mean chroma is below this are neutral
+	toningMinBinWeight = 1e-3
+)
+
+// ToningAnalysis is the result of DetectToning.
+type ToningAnalysis struct {
+	Kind   Toning  // Detected toning
+	Chroma float64 // Mean chroma in CIE L*a*b*
+	Spread float64 // Standard deviation of a* and b* around their mean, low when every pixel has the same hue
+
+	// Mean a* and b* in each lightness band, so the toning can be re-applied
+	// with its natural variation from shadows to highlights
+	bands [toningBins][2]float64
+}
+
+// DetectToning decides from chroma statistics in CIE L*a*b* whether a photo is in colour,
+// a neutral black and white print or a toned (sepia) print. A monochrome or toned print has
+// all its pixels close to a single a*, b* point; a neutral one has that point near gray.
+func DetectToning(img image.Image, numWorkers int) ToningAnalysis {
+	return detectToning(img, srgbSpace, numWorkers)
+}
+
+// detectToning measures the toning of an image in the RGB space rgb.
+func detectToning(img image.Image, rgb *rgbSpace, numWorkers int) ToningAnalysis {
+	var stats toningStats
+	stats.add(toFloatImage(img, numWorkers), rgb, numWorkers)
+	return stats.analysis()
+}
+
+// toningStats accumulates the chroma statistics of DetectToning, so they can be gathered over
+// several parts of an image.
+type toningStats struct {
+	n                                float64
+	sumA, sumB, sumA2, sumB2, chroma float64
+	bands                            [toningBins][3]float64 // a*, b*, count
+}
+
+// add accumulates the visible pixels of a working copy in the RGB space rgb, reading rows in parallel.
+func (s *toningStats) add(src *floatImage, rgb *rgbSpace, numWorkers int) {
+	var mu sync.Mutex
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		var a, b, a2, b2, chroma, count float64
+		var bands [toningBins][3]float64
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			if src.transparent(i) {
+				continue
+			}
+			count++
+			l, pa, pb := rgb.toLab(float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2]))
+			a += pa
+			b += pb
+			a2 += pa * pa
+			b2 += pb * pb
+			chroma += math.Hypot(pa, pb)
+
+			band := toningBand(l)
+			bands[band][0] += pa
+			bands[band][1] += pb
+			bands[band][2]++
+		}
+
+		mu.Lock()
+		s.sumA, s.sumB, s.sumA2, s.sumB2, s.chroma = s.sumA+a, s.sumB+b, s.sumA2+a2, s.sumB2+b2, s.chroma+chroma
+		s.n += count
+		for i := range s.bands {
+			for j := range s.bands[i] {
+				s.bands[i][j] += bands[i][j]
+			}
+		}
+		mu.Unlock()
+	})
+}
+
+// analysis classifies the toning from the accumulated statistics.
+func (s *toningStats) analysis() ToningAnalysis {
+	n := math.Max(s.n, 1) // A fully transparent image reads as neutral
+	meanA, meanB := s.sumA/n, s.sumB/n
+	variance := math.Max(0, s.sumA2/n-meanA*meanA) + math.Max(0, s.sumB2/n-meanB*meanB)
+	analysis := ToningAnalysis{
+		Chroma: s.chroma / n,
+		Spread: math.Sqrt(variance),
+	}
+	switch {
+	case analysis.Spread >= toningMaxSpread:
+		analysis.Kind = ToningColor
+	case analysis.Chroma < toningMaxNeutral:
+		analysis.Kind = ToningMonochrome
+	default:
+		analysis.Kind = ToningSepia
+	}
+
+	// Per-band toning; empty bands borrow the mean toning of the photo
+	for i, b := range s.bands {
+		analysis.bands[i] = [2]float64{meanA, meanB}
+		if b[2] > toningMinBinWeight*n {
+			analysis.bands[i] = [2]float64{b[0] / b[2], b[1] / b[2]}
+		}
+	}
+	return analysis
+}
+
+// DesaturateConcurrent replaces every pixel with the neutral gray of the same CIE L* lightness,
+// so a monochrome or toned print can be processed as a single luminance channel.
+func DesaturateConcurrent(img image.Image, numWorkers int) *image.NRGBA64 {
+	return desaturate(img, srgbSpace, numWorkers)
+}
+
+// desaturate replaces every pixel with the gray of its lightness in the RGB space rgb.
+func desaturate(img image.Image, rgb *rgbSpace, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			l, _, _ := rgb.toLab(float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2]))
+			gray, _, _ := rgb.fromLab(l, 0, 0)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = float32(gray), float32(gray), float32(gray)
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst.toNRGBA64(numWorkers)
+}
+
+// ApplyToningConcurrent re-applies the toning measured by DetectToning to an image: every pixel
+// keeps its lightness and takes the a*, b* the original print had at that lightness.
+func ApplyToningConcurrent(img image.Image, toning ToningAnalysis, numWorkers int) *image.NRGBA64 {
+	return applyToning(img, toning, srgbSpace, numWorkers)
+}
+
+// applyToning re-applies a toning to an image in the RGB space rgb.
+func applyToning(img image.Image, toning ToningAnalysis, rgb *rgbSpace, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			l, _, _ := rgb.toLab(float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2]))
+			a, b := toning.at(l)
+			r, g, bl := rgb.fromLab(l, a, b)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = float32(r), float32(g), float32(bl)
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst.toNRGBA64(numWorkers)
+}
+
+// at interpolates the toning between the centres of the lightness bands.
+func (t ToningAnalysis) at(l float64) (a, b float64) {
+	pos := l/100*toningBins - 0.5
+	i := clampInt(int(math.Floor(pos)), 0, toningBins-1)
+	j := min(i+1, toningBins-1)
+	frac := math.Max(0, math.Min(1, pos-float64(i)))
+	a = t.bands[i][0]*(1-frac) + t.bands[j][0]*frac
+	b = t.bands[i][1]*(1-frac) + t.bands[j][1]*frac
+	return a, b
+}
+
+// toningBand returns the lightness band of an L* value.
+func toningBand(l float64) int {
+	return clampInt(int(l/100*toningBins), 0, toningBins-1)
+}
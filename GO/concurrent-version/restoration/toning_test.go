@@ -0,0 +1,94 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// grayPhoto returns scratchedPhoto turned into a neutral black and white print.
+func grayPhoto(width, height int) *image.NRGBA64 {
+	img := scratchedPhoto(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.NRGBA64At(x, y)
+			v := uint16((uint32(c.R) + uint32(c.G) + uint32(c.B)) / 3)
+			img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, c.A})
+		}
+	}
+	return img
+}
+
+// sepiaRamp returns a clean sepia print fading from black on the left to white on the right.
+func sepiaRamp(width, height int) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := float64(x) / float64(width-1) * 0xffff
+			img.SetNRGBA64(x, y, color.NRGBA64{uint16(v), uint16(v * 0.85), uint16(v * 0.65), 0xffff})
+		}
+	}
+	return img
+}
+
+func TestDetectToning(t *testing.T) {
+	tests := []struct {
+		name  string
+		photo image.Image
+		want  Toning
+	}{
+		{"colour", randomImage(64, 48, false, 5), ToningColor},
+		{"black and white", grayPhoto(64, 48), ToningMonochrome},
+		{"sepia", sepiaPhoto(64, 48), ToningSepia},
+		{"transparent", image.NewNRGBA64(image.Rect(0, 0, 8, 8)), ToningMonochrome},
+	}
+	for _, tt := range tests {
+		if got := DetectToning(tt.photo, 3); got.Kind != tt.want {
+			t.Errorf("%s: detected %v (chroma %.2f, spread %.2f), want %v", tt.name, got.Kind, got.Chroma, got.Spread, tt.want)
+		}
+	}
+}
+
+func TestToningRoundTrip(t *testing.T) {
+	// Desaturating a sepia print and re-applying its toning gives the print back
+	ramp := sepiaRamp(256, 8)
+	gray := DesaturateConcurrent(ramp, 3)
+	if got := DetectToning(gray, 3); got.Kind != ToningMonochrome || got.Chroma > 0.5 {
+		t.Errorf("desaturated print is %v with chroma %.2f, want neutral", got.Kind, got.Chroma)
+	}
+	closeImages(t, ApplyToningConcurrent(gray, DetectToning(ramp, 3), 3), ramp, 0x200)
+
+	// Equalising the channels separately strips the toning of a print; restoring it as luminance
+	// keeps the toning of every lightness band
+	photo := sepiaPhoto(64, 48)
+	toning := DetectToning(photo, 3)
+	opts := testOptions()
+	result, err := Restore(photo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := DetectToning(result.Image, 3).Kind; kind == ToningSepia {
+		t.Fatal("restoring the channels separately kept the toning, the test photo is too mild")
+	}
+	opts.PreserveToning = true
+	result, err = Restore(photo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Toning.Kind != ToningSepia {
+		t.Fatalf("restored as %v, want sepia", result.Toning.Kind)
+	}
+	restored := DetectToning(result.Image, 3)
+	if restored.Kind != ToningSepia {
+		t.Fatalf("restored print is %v (chroma %.2f, spread %.2f), want sepia", restored.Kind, restored.Chroma, restored.Spread)
+	}
+	// The print spans L* 15-40 plus its white scratches, where the sRGB gamut limits the chroma
+	for l := 15.0; l < 90; l += 10 {
+		a, b := toning.at(l)
+		ra, rb := restored.at(l)
+		if d := math.Hypot(ra-a, rb-b); d > 2 {
+			t.Errorf("L* %.0f: toning a* %.2f b* %.2f, want %.2f %.2f", l, ra, rb, a, b)
+		}
+	}
+}
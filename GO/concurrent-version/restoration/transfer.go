@@ -0,0 +1,187 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// TransferMethod selects how the colours of a reference photo are transferred.
+type TransferMethod int
+
+const (
+	TransferNone      TransferMethod = iota // No colour transfer
+	TransferReinhard                        // Match mean and standard deviation of L*, a* and b* (Reinhard et al.)
+	TransferHistogram                       // Match the full histogram of R, G and B
+)
+
+// ParseTransferMethod converts a command line name (none, reinhard, histogram) into a TransferMethod.
+func ParseTransferMethod(name string) (TransferMethod, error) {
+	switch name {
+	case "none":
+		return TransferNone, nil
+	case "reinhard":
+		return TransferReinhard, nil
+	case "histogram":
+		return TransferHistogram, nil
+	}
+	return TransferNone, fmt.Errorf("unknown colour transfer method %q", name)
+}
+
+// ColorTransferConcurrent maps the colour statistics of img to those of reference in CIE L*a*b*:
+// every channel is shifted and scaled so that its mean and standard deviation match the
+// reference. Photos of the same album restored this way share the same overall look.
+func ColorTransferConcurrent(img, reference image.Image, numWorkers int) *image.NRGBA64 {
+	return colorTransfer(img, reference, srgbSpace, numWorkers)
+}
+
+// colorTransfer matches the L*a*b* statistics of two images in the RGB space rgb.
+func colorTransfer(img, reference image.Image, rgb *rgbSpace, numWorkers int) *image.NRGBA64 {
+	src := toColorSpace(toFloatImage(img, numWorkers), ColorSpaceLab, rgb, numWorkers)
+	ref := toColorSpace(toFloatImage(reference, numWorkers), ColorSpaceLab, rgb, numWorkers)
+	srcMean, srcStd := channelStats(src, numWorkers)
+	refMean, refStd := channelStats(ref, numWorkers)
+	dst := transferLab(src, srcMean, srcStd, refMean, refStd, numWorkers)
+	return fromColorSpace(dst, ColorSpaceLab, rgb, numWorkers).toNRGBA64(numWorkers)
+}
+
+// transferLab shifts and scales every L*a*b* channel of a working copy from the source mean and
+// standard deviation to those of the reference.
+func transferLab(src *floatImage, srcMean, srcStd, refMean, refStd [3]float64, numWorkers int) *floatImage {
+	var scale [3]float32
+	for c := range scale {
+		scale[c] = 1
+		if srcStd[c] > 1e-6 {
+			scale[c] = float32(refStd[c] / srcStd[c])
+		}
+	}
+
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = (src.Pix[i+c]-float32(srcMean[c]))*scale[c] + float32(refMean[c])
+			}
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst
+}
+
+// HistogramMatchConcurrent remaps every R, G and B level of img so that the channel histograms
+// follow those of reference: a level at a given fraction of the source distribution takes the
+// value found at the same fraction of the reference distribution.
+func HistogramMatchConcurrent(img, reference image.Image, numWorkers int) *image.NRGBA64 {
+	src := toFloatImage(img, numWorkers)
+	ref := toFloatImage(reference, numWorkers)
+
+	bins := histogramBins(max(src.Width*src.Height, ref.Width*ref.Height))
+	var luts [3][]float32
+	for c := range luts {
+		luts[c] = matchLUT(normalizedCDF(src, c, bins, numWorkers), normalizedCDF(ref, c, bins, numWorkers))
+	}
+	return applyLUTs(src, luts, numWorkers).toNRGBA64(numWorkers)
+}
+
+// matchLUT maps every level of a source distribution to the level found at the same fraction
+// of the reference distribution. Both cumulative distributions have the same number of bins.
+func matchLUT(srcCDF, refCDF []float64) []float32 {
+	bins := len(srcCDF)
+	lut := make([]float32, bins)
+	level := 0
+	for v := range lut {
+		// Fraction of the source below the middle of this level
+		target := srcCDF[v] / 2
+		if v > 0 {
+			target = (srcCDF[v-1] + srcCDF[v]) / 2
+		}
+
+		// Invert the reference distribution, interpolating within the level it falls in
+		for level < bins-1 && refCDF[level] < target {
+			level++
+		}
+		below := 0.0
+		if level > 0 {
+			below = refCDF[level-1]
+		}
+		frac := 0.5
+		if refCDF[level] > below {
+			frac = math.Max(0, math.Min(1, (target-below)/(refCDF[level]-below)))
+		}
+		lut[v] = clamp01((float32(level) + float32(frac) - 0.5) / float32(bins-1))
+	}
+	return lut
+}
+
+// channelStats returns the mean and standard deviation of the first three channels of a working copy.
+func channelStats(src *floatImage, numWorkers int) (mean, std [3]float64) {
+	var m moments
+	m.add(src, numWorkers)
+	return m.meanStd()
+}
+
+// moments accumulates the sums and squared sums of the first three channels of the visible
+// pixels, so statistics can be gathered over several parts of an image.
+type moments struct {
+	sum, sum2 [3]float64
+	n         float64
+}
+
+// add accumulates the samples of a working copy, reading rows in parallel.
+func (m *moments) add(src *floatImage, numWorkers int) {
+	var mu sync.Mutex
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		var local, local2 [3]float64
+		var count float64
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			if src.transparent(i) {
+				continue
+			}
+			count++
+			for c := 0; c < 3; c++ {
+				v := float64(src.Pix[i+c])
+				local[c] += v
+				local2[c] += v * v
+			}
+		}
+		mu.Lock()
+		for c := range m.sum {
+			m.sum[c] += local[c]
+			m.sum2[c] += local2[c]
+		}
+		m.n += count
+		mu.Unlock()
+	})
+}
+
+// meanStd returns the mean and standard deviation of every channel.
+func (m *moments) meanStd() (mean, std [3]float64) {
+	if m.n == 0 {
+		return mean, std
+	}
+	for c := range mean {
+		mean[c] = m.sum[c] / m.n
+		std[c] = math.Sqrt(math.Max(0, m.sum2[c]/m.n-mean[c]*mean[c]))
+	}
+	return mean, std
+}
+
+// normalizedCDF returns the cumulative distribution of one channel, scaled to [0, 1].
+func normalizedCDF(src *floatImage, c, bins int, numWorkers int) []float64 {
+	return cdfFractions(channelHistogram(src, c, bins, numWorkers))
+}
+
+// cdfFractions returns the cumulative distribution of a histogram, scaled to [0, 1].
+func cdfFractions(hist []int) []float64 {
+	cdf := computeCDF(hist)
+	bins := len(cdf)
+	out := make([]float64, bins)
+	if cdf[bins-1] == 0 {
+		return out // Fully transparent image
+	}
+	for v, count := range cdf {
+		out[v] = float64(count) / float64(cdf[bins-1])
+	}
+	return out
+}
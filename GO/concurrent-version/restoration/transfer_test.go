@@ -0,0 +1,120 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// labPhoto returns a photo whose pixels are drawn uniformly from the given L*, a* and b* ranges,
+// all inside the sRGB gamut.
+func labPhoto(width, height int, low, high [3]float64, seed int64) *image.NRGBA64 {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var lab [3]float64
+			for c := range lab {
+				lab[c] = low[c] + (high[c]-low[c])*rng.Float64()
+			}
+			r, g, b := srgbSpace.fromLab(lab[0], lab[1], lab[2])
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				uint16(clamp01(float32(r))*0xffff + 0.5),
+				uint16(clamp01(float32(g))*0xffff + 0.5),
+				uint16(clamp01(float32(b))*0xffff + 0.5),
+				0xffff,
+			})
+		}
+	}
+	return img
+}
+
+// labStats returns the mean and standard deviation of L* (scaled to [0, 1]), a* and b* of a photo.
+func labStats(img image.Image) (mean, std [3]float64) {
+	return channelStats(toColorSpace(toFloatImage(img, 3), ColorSpaceLab, srgbSpace, 3), 3)
+}
+
+func TestColorTransferMatchesMoments(t *testing.T) {
+	// A dull, slightly blue print and a warm, contrasty reference from the same album
+	img := labPhoto(96, 64, [3]float64{35, -8, -15}, [3]float64{55, 2, -5}, 1)
+	reference := labPhoto(96, 64, [3]float64{30, 0, 5}, [3]float64{80, 20, 35}, 2)
+
+	got := ColorTransferConcurrent(img, reference, 3)
+	gotMean, gotStd := labStats(got)
+	refMean, refStd := labStats(reference)
+	for c, scale := range []float64{100, 1, 1} {
+		if d := scale * math.Abs(gotMean[c]-refMean[c]); d > 0.5 {
+			t.Errorf("channel %d: mean %.3f, want %.3f", c, scale*gotMean[c], scale*refMean[c])
+		}
+		if d := scale * math.Abs(gotStd[c]-refStd[c]); d > 0.5 {
+			t.Errorf("channel %d: standard deviation %.3f, want %.3f", c, scale*gotStd[c], scale*refStd[c])
+		}
+	}
+
+	// A photo transferred to itself is unchanged
+	closeImages(t, ColorTransferConcurrent(reference, reference, 3), reference, 0x40)
+}
+
+func TestHistogramMatchFollowsReference(t *testing.T) {
+	// The photo spreads every channel evenly, the reference crowds R into the shadows, G into
+	// the highlights and B into the midtones
+	const width, height = 128, 96
+	rng := rand.New(rand.NewSource(4))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	reference := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), 0xffff,
+			})
+			u := rng.Float64()
+			reference.SetNRGBA64(x, y, color.NRGBA64{
+				uint16(u * u * 0xffff),
+				uint16(math.Sqrt(rng.Float64()) * 0xffff),
+				uint16((0.4 + 0.2*rng.Float64()) * 0xffff),
+				0xffff,
+			})
+		}
+	}
+
+	got := HistogramMatchConcurrent(img, reference, 3)
+	gotMean, gotStd := channelStats(toFloatImage(got, 3), 3)
+	refMean, refStd := channelStats(toFloatImage(reference, 3), 3)
+	for c := range gotMean {
+		if math.Abs(gotMean[c]-refMean[c]) > 0.005 || math.Abs(gotStd[c]-refStd[c]) > 0.005 {
+			t.Errorf("channel %d: mean %.4f std %.4f, want %.4f %.4f", c, gotMean[c], gotStd[c], refMean[c], refStd[c])
+		}
+	}
+
+	// The cumulative distributions agree at every level
+	bins := 256
+	for c := 0; c < 3; c++ {
+		gotCDF := normalizedCDF(toFloatImage(got, 3), c, bins, 3)
+		refCDF := normalizedCDF(toFloatImage(reference, 3), c, bins, 3)
+		for v := range gotCDF {
+			if math.Abs(gotCDF[v]-refCDF[v]) > 0.02 {
+				t.Fatalf("channel %d: %.3f of the pixels below level %d, want %.3f", c, gotCDF[v], v, refCDF[v])
+			}
+		}
+	}
+
+	// Matching a photo to itself leaves it unchanged, up to the 2048 bins of its histograms
+	closeImages(t, HistogramMatchConcurrent(reference, reference, 3), reference, 0x80)
+}
+
+func TestParseTransferMethod(t *testing.T) {
+	for name, want := range map[string]TransferMethod{
+		"none":      TransferNone,
+		"reinhard":  TransferReinhard,
+		"histogram": TransferHistogram,
+	} {
+		if got, err := ParseTransferMethod(name); err != nil || got != want {
+			t.Errorf("ParseTransferMethod(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseTransferMethod("lab"); err == nil {
+		t.Error("ParseTransferMethod accepted an unknown method")
+	}
+}
@@ -0,0 +1,180 @@
+package restoration
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// WhiteBalanceMethod selects how the colour of the illuminant is estimated.
+type WhiteBalanceMethod int
+
+const (
+	WhiteBalanceNone         WhiteBalanceMethod = iota // No white balancing
+	WhiteBalanceGrayWorld                              // The average colour of the scene is gray
+	WhiteBalanceWhitePatch                             // The brightest colour of the scene is white (max-RGB)
+	WhiteBalanceShadesOfGray                           // The Minkowski p-norm of the scene is gray
+)
+
+// ParseWhiteBalanceMethod converts a command line name (none, grayworld, whitepatch, shadesofgray)
+// into a WhiteBalanceMethod.
+func ParseWhiteBalanceMethod(name string) (WhiteBalanceMethod, error) {
+	switch name {
+	case "none":
+		return WhiteBalanceNone, nil
+	case "grayworld":
+		return WhiteBalanceGrayWorld, nil
+	case "whitepatch":
+		return WhiteBalanceWhitePatch, nil
+	case "shadesofgray":
+		return WhiteBalanceShadesOfGray, nil
+	}
+	return WhiteBalanceNone, fmt.Errorf("unknown white balance method %q", name)
+}
+
+// WhiteBalanceOptions tunes the white balance stage.
+type WhiteBalanceOptions struct {
+	Method     WhiteBalanceMethod // Illuminant estimator
+	Norm       float64            // Minkowski norm of shades-of-gray (1 is gray world, larger values approach white patch)
+	Percentile float64            // Fraction of the brightest pixels ignored by white patch, so specular spots and dust do not count
+}
+
+// DefaultWhiteBalanceOptions returns white balancing disabled, with the usual settings of each method.
+func DefaultWhiteBalanceOptions() WhiteBalanceOptions {
+	return WhiteBalanceOptions{
+		Method:     WhiteBalanceNone,
+		Norm:       6,
+		Percentile: 0.01,
+	}
+}
+
+// ColorCast is the colour of the light an image appears to be lit with.
+// The components are scaled so that their mean is 1: (1, 1, 1) is neutral, and a faded
+// yellow print gives R and G above 1 and B below.
+type ColorCast struct {
+	R, G, B float64
+}
+
+// NeutralCast is the cast of an image without colour cast.
+var NeutralCast = ColorCast{R: 1, G: 1, B: 1}
+
+// String formats the cast for logs and the server metadata.
+func (c ColorCast) String() string {
+	return fmt.Sprintf("R %.3f G %.3f B %.3f", c.R, c.G, c.B)
+}
+
+// EstimateColorCast estimates the colour cast of an image with the given method.
+// WhiteBalanceNone returns NeutralCast.
+func EstimateColorCast(img image.Image, opts WhiteBalanceOptions, numWorkers int) ColorCast {
+	var r, g, b float64
+	switch opts.Method {
+	case WhiteBalanceGrayWorld:
+		avgR, avgG, avgB, _ := GetGlobalAverageColor(img).RGBA()
+		r, g, b = float64(avgR), float64(avgG), float64(avgB)
+	case WhiteBalanceWhitePatch:
+		r, g, b = whitePatch(toFloatImage(img, numWorkers), opts.Percentile, numWorkers)
+	case WhiteBalanceShadesOfGray:
+		r, g, b = minkowskiMean(toFloatImage(img, numWorkers), opts.Norm, numWorkers)
+	default:
+		return NeutralCast
+	}
+	return castOf(r, g, b)
+}
+
+// castOf scales an estimated illuminant so that the mean of its components is 1.
+func castOf(r, g, b float64) ColorCast {
+	mean := (r + g + b) / 3
+	if r <= 0 || g <= 0 || b <= 0 {
+		return NeutralCast // A missing channel cannot be balanced
+	}
+	return ColorCast{R: r / mean, G: g / mean, B: b / mean}
+}
+
+// WhiteBalanceConcurrent removes the colour cast of an image: it estimates the illuminant with
+// opts.Method and divides every channel by it (von Kries scaling), keeping the overall brightness.
+// The estimated cast is returned alongside the corrected image.
+func WhiteBalanceConcurrent(img image.Image, opts WhiteBalanceOptions, numWorkers int) (*image.NRGBA64, ColorCast) {
+	cast := EstimateColorCast(img, opts, numWorkers)
+	return removeCast(toFloatImage(img, numWorkers), cast, numWorkers).toNRGBA64(numWorkers), cast
+}
+
+// removeCast divides the R, G and B channels of a working copy by a colour cast.
+func removeCast(src *floatImage, cast ColorCast, numWorkers int) *floatImage {
+	gains := [3]float32{float32(1 / cast.R), float32(1 / cast.G), float32(1 / cast.B)}
+	dst := newFloatImage(src.Rect)
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			dst.Pix[i] = src.Pix[i] * gains[0]
+			dst.Pix[i+1] = src.Pix[i+1] * gains[1]
+			dst.Pix[i+2] = src.Pix[i+2] * gains[2]
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst
+}
+
+// whitePatch returns the per-channel value below which all but the given fraction of pixels lie.
+func whitePatch(src *floatImage, percentile float64, numWorkers int) (r, g, b float64) {
+	bins := histogramBins(src.Width * src.Height)
+	return whitePatchFromHistograms(rgbHistograms(src, bins, numWorkers), percentile)
+}
+
+// whitePatchFromHistograms reads the white patch of every channel from its histogram.
+func whitePatchFromHistograms(hists [3][]int, percentile float64) (r, g, b float64) {
+	var values [3]float64
+	for c, hist := range hists {
+		bins := len(hist)
+		skip := int(percentile * float64(histogramTotal(hist)))
+		count := 0
+		for v := bins - 1; v >= 0; v-- {
+			count += hist[v]
+			if count > skip {
+				values[c] = float64(v) / float64(bins-1)
+				break
+			}
+		}
+	}
+	return values[0], values[1], values[2]
+}
+
+// minkowskiMean returns the per-channel Minkowski p-norm mean, (mean of v^p)^(1/p).
+func minkowskiMean(src *floatImage, p float64, numWorkers int) (r, g, b float64) {
+	sums, n := minkowskiSums(src, p, numWorkers)
+	return minkowskiFromSums(sums, n, p)
+}
+
+// minkowskiSums returns the per-channel sums of v^p over the visible pixels and their count.
+func minkowskiSums(src *floatImage, p float64, numWorkers int) (sums [3]float64, n float64) {
+	p = math.Max(p, 1)
+	var mu sync.Mutex
+	parallelRows(src.Height, numWorkers, func(startY, endY int) {
+		var local [3]float64
+		var count float64
+		for i := src.offset(0, startY); i < src.offset(0, endY); i += 4 {
+			if src.transparent(i) {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				local[c] += math.Pow(float64(src.Pix[i+c]), p)
+			}
+			count++
+		}
+		mu.Lock()
+		for c := range sums {
+			sums[c] += local[c]
+		}
+		n += count
+		mu.Unlock()
+	})
+	return sums, n
+}
+
+// minkowskiFromSums turns the sums of minkowskiSums into the p-norm mean of every channel.
+func minkowskiFromSums(sums [3]float64, n, p float64) (r, g, b float64) {
+	p = math.Max(p, 1)
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return math.Pow(sums[0]/n, 1/p), math.Pow(sums[1]/n, 1/p), math.Pow(sums[2]/n, 1/p)
+}
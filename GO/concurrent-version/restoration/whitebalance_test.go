@@ -0,0 +1,142 @@
+package restoration
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// yellowCast is the cast of a print faded towards yellow, scaled to a mean of 1.
+var yellowCast = ColorCast{R: 1.2, G: 1, B: 0.8}
+
+// grayScene returns blocks of random neutral grays between 0.1 and 0.7 with a white card of
+// level 0.8 along the top, so every estimator sees a neutral scene.
+func grayScene(width, height int) *image.NRGBA64 {
+	rng := rand.New(rand.NewSource(3))
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for by := 0; by < height; by += 4 {
+		for bx := 0; bx < width; bx += 4 {
+			v := uint16((0.1 + 0.6*rng.Float64()) * 0xffff)
+			if by < height/10 {
+				v = 0.8 * 0xffff
+			}
+			for y := by; y < by+4 && y < height; y++ {
+				for x := bx; x < bx+4 && x < width; x++ {
+					img.SetNRGBA64(x, y, color.NRGBA64{v, v, v, 0xffff})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// castScene returns a copy of img lit with the given cast.
+func castScene(img *image.NRGBA64, cast ColorCast) *image.NRGBA64 {
+	dst := image.NewNRGBA64(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			c := img.NRGBA64At(x, y)
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				uint16(math.Min(float64(c.R)*cast.R, 0xffff) + 0.5),
+				uint16(math.Min(float64(c.G)*cast.G, 0xffff) + 0.5),
+				uint16(math.Min(float64(c.B)*cast.B, 0xffff) + 0.5),
+				c.A,
+			})
+		}
+	}
+	return dst
+}
+
+// closeCast reports a cast that differs from want by more than tolerance in any component.
+func closeCast(t *testing.T, name string, got, want ColorCast, tolerance float64) {
+	t.Helper()
+	if math.Abs(got.R-want.R) > tolerance || math.Abs(got.G-want.G) > tolerance || math.Abs(got.B-want.B) > tolerance {
+		t.Errorf("%s: estimated cast %v, want %v", name, got, want)
+	}
+}
+
+func TestWhiteBalanceRemovesCast(t *testing.T) {
+	scene := grayScene(128, 96)
+	cast := castScene(scene, yellowCast)
+	tests := []struct {
+		name string
+		opts WhiteBalanceOptions
+	}{
+		{"gray world", WhiteBalanceOptions{Method: WhiteBalanceGrayWorld}},
+		{"white patch", WhiteBalanceOptions{Method: WhiteBalanceWhitePatch, Percentile: 0.01}},
+		{"shades of gray", WhiteBalanceOptions{Method: WhiteBalanceShadesOfGray, Norm: 6}},
+		{"shades of gray p=1", WhiteBalanceOptions{Method: WhiteBalanceShadesOfGray, Norm: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closeCast(t, "neutral scene", EstimateColorCast(scene, tt.opts, 3), NeutralCast, 0.002)
+
+			got, estimated := WhiteBalanceConcurrent(cast, tt.opts, 3)
+			closeCast(t, "yellow scene", estimated, yellowCast, 0.002)
+
+			// Dividing by the cast gives back the neutral scene at its brightness
+			closeImages(t, got, scene, 0x40)
+		})
+	}
+}
+
+func TestWhitePatchIgnoresSpecularSpots(t *testing.T) {
+	// Clipped highlights are white whatever the cast: with no pixels ignored they make the
+	// scene look neutral, ignoring the brightest 1% finds the cast on the white card
+	img := castScene(grayScene(128, 96), yellowCast)
+	for i := 0; i < 40; i++ {
+		img.SetNRGBA64(7+i*3, 50, color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+	}
+	opts := WhiteBalanceOptions{Method: WhiteBalanceWhitePatch}
+	closeCast(t, "max-RGB", EstimateColorCast(img, opts, 3), NeutralCast, 0.002)
+	opts.Percentile = 0.01
+	closeCast(t, "1% ignored", EstimateColorCast(img, opts, 3), yellowCast, 0.002)
+}
+
+func TestWhiteBalanceIgnoresTransparentPixels(t *testing.T) {
+	img := castScene(grayScene(64, 48), yellowCast)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{0, 0xffff, 0, 0}) // Green, fully transparent
+		}
+	}
+	for _, method := range []WhiteBalanceMethod{WhiteBalanceGrayWorld, WhiteBalanceShadesOfGray} {
+		opts := DefaultWhiteBalanceOptions()
+		opts.Method = method
+		closeCast(t, "transparent margin", EstimateColorCast(img, opts, 3), yellowCast, 0.002)
+	}
+}
+
+func TestColorCastOf(t *testing.T) {
+	tests := []struct {
+		r, g, b float64
+		want    ColorCast
+	}{
+		{0.5, 0.5, 0.5, NeutralCast},
+		{0.6, 0.5, 0.4, yellowCast},
+		{0.3, 0.3, 0.6, ColorCast{R: 0.75, G: 0.75, B: 1.5}},
+		{0.6, 0.5, 0, NeutralCast}, // No blue to scale
+		{0, 0, 0, NeutralCast},
+	}
+	for _, tt := range tests {
+		closeCast(t, "castOf", castOf(tt.r, tt.g, tt.b), tt.want, 1e-9)
+	}
+}
+
+func TestParseWhiteBalanceMethod(t *testing.T) {
+	for name, want := range map[string]WhiteBalanceMethod{
+		"none":         WhiteBalanceNone,
+		"grayworld":    WhiteBalanceGrayWorld,
+		"whitepatch":   WhiteBalanceWhitePatch,
+		"shadesofgray": WhiteBalanceShadesOfGray,
+	} {
+		if got, err := ParseWhiteBalanceMethod(name); err != nil || got != want {
+			t.Errorf("ParseWhiteBalanceMethod(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseWhiteBalanceMethod("auto"); err == nil {
+		t.Error("ParseWhiteBalanceMethod accepted an unknown method")
+	}
+}